@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	xmpp "github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
+)
+
+// newRegistrationFormWidget renders whatever fields the server asked for in a
+// registration query. The returned apply function copies the entered values
+// back into the query before it is submitted.
+func newRegistrationFormWidget(query *xmpp.RegisterQuery) (fyne.CanvasObject, func()) {
+    box := container.NewVBox()
+
+    if query.Instructions != "" {
+        instructions := widget.NewLabel(query.Instructions)
+        instructions.Wrapping = fyne.TextWrapWord
+        box.Add(instructions)
+    }
+
+    if query.IsRedirect() {
+        box.Add(newRedirectLink(query.OOB.URL))
+        return box, func() {}
+    }
+
+    if query.Form != nil {
+        formWidget, apply := newDataFormWidget(query.Form, func(uri string) fyne.Resource {
+            return bobResource(query, uri)
+        })
+        box.Add(formWidget)
+        return box, apply
+    }
+
+    var appliers []func()
+    for i := range query.Fields {
+        field := &query.Fields[i]
+        name := field.XMLName.Local
+
+        var entry *widget.Entry
+        if name == "password" {
+            entry = widget.NewPasswordEntry()
+        } else {
+            entry = widget.NewEntry()
+        }
+        entry.SetPlaceHolder(strings.ToUpper(name[:1]) + name[1:])
+        entry.SetText(field.Value)
+        box.Add(entry)
+
+        appliers = append(appliers, func() {
+            field.Value = entry.Text
+        })
+    }
+
+    return box, func() {
+        for _, apply := range appliers {
+            apply()
+        }
+    }
+}
+
+// newDataFormWidget renders an XEP-0004 data form. media resolves the URIs of
+// media elements (CAPTCHA images) to resources, returning nil when it can't.
+func newDataFormWidget(form *xmpp.DataForm, media func(uri string) fyne.Resource) (fyne.CanvasObject, func()) {
+    box := container.NewVBox()
+    if form.Title != "" {
+        box.Add(widget.NewLabelWithStyle(form.Title, fyne.TextAlignLeading, fyne.TextStyle{Bold: true}))
+    }
+    for _, instructions := range form.Instructions {
+        label := widget.NewLabel(instructions)
+        label.Wrapping = fyne.TextWrapWord
+        box.Add(label)
+    }
+
+    var appliers []func()
+    for i := range form.Fields {
+        field := &form.Fields[i]
+        if field.Type == "hidden" {
+            continue
+        }
+
+        label := field.Label
+        if label == "" {
+            label = field.Var
+        }
+        if field.IsRequired() {
+            label += " *"
+        }
+
+        for _, m := range field.Media {
+            box.Add(newMediaWidget(m, media))
+        }
+
+        switch field.Type {
+        case "fixed":
+            text := widget.NewLabel(strings.Join(field.Values, "\n"))
+            text.Wrapping = fyne.TextWrapWord
+            box.Add(text)
+
+        case "boolean":
+            check := widget.NewCheck(label, nil)
+            check.SetChecked(field.Value() == "1" || field.Value() == "true")
+            box.Add(check)
+            appliers = append(appliers, func() {
+                if check.Checked {
+                    field.SetValue("1")
+                } else {
+                    field.SetValue("0")
+                }
+            })
+
+        case "list-single":
+            labels, values := optionLabels(field.Options)
+            sel := widget.NewSelect(labels, nil)
+            for j, value := range values {
+                if value == field.Value() {
+                    sel.SetSelectedIndex(j)
+                }
+            }
+            box.Add(widget.NewLabel(label))
+            box.Add(sel)
+            appliers = append(appliers, func() {
+                if idx := sel.SelectedIndex(); idx >= 0 {
+                    field.SetValue(values[idx])
+                }
+            })
+
+        case "list-multi":
+            labels, values := optionLabels(field.Options)
+            group := widget.NewCheckGroup(labels, nil)
+            var selected []string
+            for j, value := range values {
+                for _, current := range field.Values {
+                    if value == current {
+                        selected = append(selected, labels[j])
+                    }
+                }
+            }
+            group.SetSelected(selected)
+            box.Add(widget.NewLabel(label))
+            box.Add(group)
+            appliers = append(appliers, func() {
+                field.Values = nil
+                for j, l := range labels {
+                    for _, s := range group.Selected {
+                        if l == s {
+                            field.Values = append(field.Values, values[j])
+                        }
+                    }
+                }
+            })
+
+        case "text-multi", "jid-multi":
+            entry := widget.NewMultiLineEntry()
+            entry.SetPlaceHolder(label)
+            entry.SetText(strings.Join(field.Values, "\n"))
+            box.Add(entry)
+            appliers = append(appliers, func() {
+                field.Values = strings.Split(entry.Text, "\n")
+            })
+
+        default:
+            var entry *widget.Entry
+            if field.Type == "text-private" {
+                entry = widget.NewPasswordEntry()
+            } else {
+                entry = widget.NewEntry()
+            }
+            entry.SetPlaceHolder(label)
+            entry.SetText(field.Value())
+            box.Add(entry)
+            appliers = append(appliers, func() {
+                field.SetValue(entry.Text)
+            })
+        }
+
+        if field.Desc != "" {
+            box.Add(widget.NewLabelWithStyle(field.Desc, fyne.TextAlignLeading, fyne.TextStyle{Italic: true}))
+        }
+    }
+
+    return box, func() {
+        for _, apply := range appliers {
+            apply()
+        }
+    }
+}
+
+// newMediaWidget shows the first media URI that can be displayed: embedded
+// image data as an image, web links as a hyperlink.
+func newMediaWidget(m xmpp.FormMedia, media func(uri string) fyne.Resource) fyne.CanvasObject {
+    for _, uri := range m.URIs {
+        if res := media(uri.Value); res != nil {
+            img := canvas.NewImageFromResource(res)
+            img.FillMode = canvas.ImageFillContain
+            width, height := float32(m.Width), float32(m.Height)
+            if width == 0 || height == 0 {
+                width, height = 200, 80
+            }
+            img.SetMinSize(fyne.NewSize(width, height))
+            return img
+        }
+        if parsed, err := url.Parse(uri.Value); err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") {
+            return widget.NewHyperlink(uri.Value, parsed)
+        }
+    }
+    return widget.NewLabel("(media not available)")
+}
+
+// bobResource turns a Bits of Binary payload referenced by uri into a resource.
+func bobResource(query *xmpp.RegisterQuery, uri string) fyne.Resource {
+    data, ok := query.BoB(uri)
+    if !ok {
+        return nil
+    }
+    content, err := data.Bytes()
+    if err != nil {
+        uiLog().Warn("failed to decode media", "uri", uri, "err", err)
+        return nil
+    }
+    return fyne.NewStaticResource(data.CID, content)
+}
+
+// newRedirectLink shows a link to a web page where registration has to be completed.
+func newRedirectLink(rawURL string) fyne.CanvasObject {
+    parsed, err := url.Parse(rawURL)
+    if err != nil {
+        return widget.NewLabel(rawURL)
+    }
+    return container.NewVBox(
+        widget.NewLabel("This server requires registration on its website:"),
+        widget.NewHyperlink(rawURL, parsed),
+    )
+}
+
+// optionLabels splits list options into display labels and the values to submit.
+func optionLabels(options []xmpp.FormOption) ([]string, []string) {
+    labels := make([]string, len(options))
+    values := make([]string, len(options))
+    for i, option := range options {
+        labels[i] = option.Label
+        if labels[i] == "" {
+            labels[i] = option.Value
+        }
+        values[i] = option.Value
+    }
+    return labels, values
+}
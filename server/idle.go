@@ -0,0 +1,95 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/driver/desktop"
+    "fyne.io/fyne/v2/widget"
+    xmpp "github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
+)
+
+// Preferences holding the idle times, in minutes, after which the presence
+// becomes away and extended away. Zero disables the step.
+const (
+    prefAutoAwayMinutes = "autoAwayMinutes"
+    prefAutoXAMinutes   = "autoXAMinutes"
+)
+
+// autoAway changes the presence of the session while the user is idle. It
+// is set when the contacts window opens.
+var autoAway *xmpp.AutoAway
+
+// idleThresholds returns the idle times stored in the preferences.
+func idleThresholds(app fyne.App) (away, xa time.Duration) {
+    prefs := app.Preferences()
+    away = time.Duration(prefs.IntWithFallback(prefAutoAwayMinutes, 5)) * time.Minute
+    xa = time.Duration(prefs.IntWithFallback(prefAutoXAMinutes, 20)) * time.Minute
+    return away, xa
+}
+
+// userActivity tells autoAway that the user did something.
+func userActivity() {
+    if autoAway != nil {
+        autoAway.Activity()
+    }
+}
+
+// watchActivity makes the mouse and keyboard activity in a window count as
+// user activity. Fyne has no global input hook, so the content is wrapped
+// in a widget that sees the mouse moving over the parts of the window that
+// don't handle hovering themselves, and key presses that no widget takes.
+// Entries report typing through trackTyping.
+func watchActivity(window fyne.Window, content fyne.CanvasObject) {
+    window.Canvas().SetOnTypedKey(func(*fyne.KeyEvent) { userActivity() })
+    window.Canvas().SetOnTypedRune(func(rune) { userActivity() })
+    window.SetContent(newActivityWatcher(content))
+}
+
+// trackTyping counts typing in entry as user activity.
+func trackTyping(entry *widget.Entry) {
+    onChanged := entry.OnChanged
+    entry.OnChanged = func(text string) {
+        userActivity()
+        if onChanged != nil {
+            onChanged(text)
+        }
+    }
+}
+
+// activityWatcher shows its content and reports mouse movement over it.
+type activityWatcher struct {
+    widget.BaseWidget
+    content fyne.CanvasObject
+}
+
+var _ desktop.Hoverable = (*activityWatcher)(nil)
+
+func newActivityWatcher(content fyne.CanvasObject) *activityWatcher {
+    w := &activityWatcher{content: content}
+    w.ExtendBaseWidget(w)
+    return w
+}
+
+func (w *activityWatcher) CreateRenderer() fyne.WidgetRenderer {
+    return widget.NewSimpleRenderer(w.content)
+}
+
+func (w *activityWatcher) MouseIn(*desktop.MouseEvent)    { userActivity() }
+func (w *activityWatcher) MouseMoved(*desktop.MouseEvent) { userActivity() }
+func (w *activityWatcher) MouseOut()                      {}
+
+// formatIdle returns how long a contact has been idle, as "idle 12m".
+func formatIdle(since time.Time) string {
+    idle := time.Since(since)
+    switch {
+    case idle < time.Minute:
+        return "idle"
+    case idle < time.Hour:
+        return fmt.Sprintf("idle %dm", int(idle.Minutes()))
+    case idle < 24*time.Hour:
+        return fmt.Sprintf("idle %dh", int(idle.Hours()))
+    }
+    return fmt.Sprintf("idle %dd", int(idle.Hours()/24))
+}
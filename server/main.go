@@ -1,5 +1,39 @@
 package main
 
+import (
+    "flag"
+    "log/slog"
+    "os"
+
+    xmpp "github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
+)
+
 func main() {
+    logLevel := flag.String("log-level", "info", "minimum level to log: debug, info, warn or error")
+    debug := flag.Bool("debug", false, "log at debug level, including passwords, SASL payloads and message bodies")
+    flag.Parse()
+
+    setupLogging(*logLevel, *debug)
     ShowLoginWindow()
-}
\ No newline at end of file
+}
+
+// setupLogging installs the logger shared by the UI and the xmpp package.
+func setupLogging(level string, debug bool) {
+    var min slog.Level
+    levelErr := min.UnmarshalText([]byte(level))
+    if levelErr != nil {
+        min = slog.LevelInfo
+    }
+    if debug {
+        min = slog.LevelDebug
+    }
+
+    logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: min}))
+    slog.SetDefault(logger)
+    xmpp.SetLogger(logger)
+    xmpp.SetDebug(debug)
+
+    if levelErr != nil {
+        logger.Warn("unknown log level, using info", "level", level)
+    }
+}
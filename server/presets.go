@@ -0,0 +1,210 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "sync"
+
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+    xmpp "github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
+)
+
+// Preferences holding the saved status presets and the statuses used last,
+// as JSON.
+const (
+    prefStatusPresets  = "statusPresets"
+    prefRecentStatuses = "recentStatuses"
+)
+
+// recentStatusCount is how many of the statuses used last are remembered.
+const recentStatusCount = 5
+
+// statusPreset is a presence the user can switch to in one step.
+type statusPreset struct {
+    Name     string    `json:"name,omitempty"` // empty for a recent status
+    Show     xmpp.Show `json:"show,omitempty"`
+    Status   string    `json:"status,omitempty"`
+    Priority int       `json:"priority,omitempty"`
+}
+
+// defaultPresets are the presets until the user saves their own.
+var defaultPresets = []statusPreset{
+    {Name: "Available", Show: xmpp.ShowAvailable},
+    {Name: "Away", Show: xmpp.ShowAway, Status: "Away"},
+    {Name: "Busy", Show: xmpp.ShowDND, Status: "Busy"},
+}
+
+// sameStatus reports whether two presets set the same presence.
+func (p statusPreset) sameStatus(other statusPreset) bool {
+    return p.Show == other.Show && p.Status == other.Status && p.Priority == other.Priority
+}
+
+// label returns how the preset is shown in the status menu.
+func (p statusPreset) label() string {
+    text := p.Show.String()
+    if p.Status != "" {
+        text = fmt.Sprintf("%s (%s)", p.Status, p.Show)
+    }
+    if p.Name == "" {
+        return "Recent: " + text
+    }
+    return p.Name
+}
+
+// loadPresets returns the presets saved in the preferences.
+func loadPresets(app fyne.App) []statusPreset {
+    text := app.Preferences().String(prefStatusPresets)
+    if text == "" {
+        return append([]statusPreset(nil), defaultPresets...)
+    }
+    return decodePresets(text, prefStatusPresets)
+}
+
+// savePresets replaces the saved presets.
+func savePresets(app fyne.App, presets []statusPreset) {
+    encodePresets(app, prefStatusPresets, presets)
+    statusMenu.Refresh()
+}
+
+// addPreset saves a preset, replacing the one with the same name.
+func addPreset(app fyne.App, preset statusPreset) {
+    presets := loadPresets(app)
+    for i, saved := range presets {
+        if saved.Name == preset.Name {
+            presets[i] = preset
+            savePresets(app, presets)
+            return
+        }
+    }
+    savePresets(app, append(presets, preset))
+}
+
+// removePreset deletes the preset with a name.
+func removePreset(app fyne.App, name string) {
+    var presets []statusPreset
+    for _, saved := range loadPresets(app) {
+        if saved.Name != name {
+            presets = append(presets, saved)
+        }
+    }
+    // An empty list is saved as such, not replaced by the defaults.
+    if presets == nil {
+        presets = []statusPreset{}
+    }
+    savePresets(app, presets)
+}
+
+// recentStatuses returns the statuses used last, the newest first.
+func recentStatuses(app fyne.App) []statusPreset {
+    return decodePresets(app.Preferences().String(prefRecentStatuses), prefRecentStatuses)
+}
+
+// rememberStatus puts a status at the front of the recent ones.
+func rememberStatus(app fyne.App, show xmpp.Show, status string, priority int) {
+    used := statusPreset{Show: show, Status: status, Priority: priority}
+    recent := []statusPreset{used}
+    for _, old := range recentStatuses(app) {
+        if !old.sameStatus(used) && len(recent) < recentStatusCount {
+            recent = append(recent, old)
+        }
+    }
+    encodePresets(app, prefRecentStatuses, recent)
+    statusMenu.Refresh()
+}
+
+// applyPreset sets our presence to a preset.
+func applyPreset(app fyne.App, handler *xmpp.XMPPHandler, preset statusPreset) error {
+    if err := handler.SetAvailability(preset.Show, preset.Status, preset.Priority); err != nil {
+        return err
+    }
+    uiLog().Info("presence changed", "show", preset.Show, "priority", preset.Priority)
+    rememberStatus(app, preset.Show, preset.Status, preset.Priority)
+    return nil
+}
+
+func decodePresets(text, pref string) []statusPreset {
+    if text == "" {
+        return nil
+    }
+    var presets []statusPreset
+    if err := json.Unmarshal([]byte(text), &presets); err != nil {
+        uiLog().Warn("ignoring corrupt preference", "preference", pref, "err", err)
+        return nil
+    }
+    return presets
+}
+
+func encodePresets(app fyne.App, pref string, presets []statusPreset) {
+    data, err := json.Marshal(presets)
+    if err != nil {
+        uiLog().Error("failed to save preference", "preference", pref, "err", err)
+        return
+    }
+    app.Preferences().SetString(pref, string(data))
+}
+
+// quickStatusMenu is the status dropdown of the contacts window. There is at
+// most one, and it is refreshed when the presets or recent statuses change.
+type quickStatusMenu struct {
+    mu      sync.Mutex
+    refresh func()
+}
+
+var statusMenu quickStatusMenu
+
+// Refresh reloads the options of the menu, if it is shown.
+func (m *quickStatusMenu) Refresh() {
+    m.mu.Lock()
+    refresh := m.refresh
+    m.mu.Unlock()
+    if refresh != nil {
+        refresh()
+    }
+}
+
+// newStatusMenu returns a dropdown that sets our presence to a preset or a
+// recent status as soon as one is chosen.
+func newStatusMenu(app fyne.App, handler *xmpp.XMPPHandler, parent fyne.Window) *widget.Select {
+    var options map[string]statusPreset
+    menu := widget.NewSelect(nil, nil)
+    menu.PlaceHolder = "Set status..."
+    menu.OnChanged = func(label string) {
+        preset, ok := options[label]
+        if !ok {
+            return
+        }
+        if err := applyPreset(app, handler, preset); err != nil {
+            uiLog().Error("failed to change presence", "err", err)
+            dialog.ShowError(err, parent)
+        }
+    }
+
+    refresh := func() {
+        options = make(map[string]statusPreset)
+        var labels []string
+        for _, preset := range append(loadPresets(app), recentStatuses(app)...) {
+            label := preset.label()
+            if _, repeated := options[label]; !repeated {
+                options[label] = preset
+                labels = append(labels, label)
+            }
+        }
+        menu.Options = labels
+        menu.ClearSelected()
+    }
+    refresh()
+
+    statusMenu.mu.Lock()
+    statusMenu.refresh = refresh
+    statusMenu.mu.Unlock()
+    return menu
+}
+
+// closeStatusMenu forgets the menu when its window closes.
+func closeStatusMenu() {
+    statusMenu.mu.Lock()
+    statusMenu.refresh = nil
+    statusMenu.mu.Unlock()
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
+	"github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
 	"github.com/adrianfulla/Proyecto1-Redes/server/xmpp-functions"
 )
 
@@ -17,7 +17,7 @@ import (
 func LogInTest(){
 	conn, err := xmppfunctions.Login("alumchat.lol", "5222", "aa-test3", "12345")
 	if err != nil{
-		fmt.Println(err.Error())
+		xmpp.Logger("test").Error("login failed", "err", err)
 		return 
 	}
 
@@ -26,14 +26,14 @@ func LogInTest(){
 	// xmppfunctions.SendMessage(conn, "afp21592@alumchat.lol", "Hello there!")
 
 	// xmppfunctions.GetContacts(conn)
-	conn.SendPresence("presence", "Online")
+	conn.SetAvailability(xmpp.ShowAvailable, "Online", 0)
 	xmppfunctions.ReceiveMessages(conn)
 }
 
 func CreateUserTest(){
 	err := xmppfunctions.CreateUser("alumchat.lol", "5222", "aa-test3", "12345")
 	if err != nil{
-		fmt.Println(err.Error())
+		xmpp.Logger("test").Error("user creation failed", "err", err)
 		return 
 	}
 }
@@ -45,7 +45,8 @@ func homePageHandler(w http.ResponseWriter, r *http.Request) {
 
 func checkError(err error) {
 	if err != nil {
-		log.Panic(err)
+		xmpp.Logger("http").Error("request failed", "err", err)
+		panic(err)
 	}
 }
 
@@ -58,10 +59,10 @@ func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&decoded)
 	if err != nil {
-		fmt.Printf("Got a thumbnail")
+		xmpp.Logger("http").Warn("invalid thumbnail request", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Printf("Got the following url: %s\n", decoded.Url)
+	xmpp.Logger("http").Info("thumbnail requested", "url", decoded.Url)
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -11,13 +14,24 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	xmpp "github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
+	"github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
 	xmppfunctions "github.com/adrianfulla/Proyecto1-Redes/server/xmpp-functions"
 )
 
+// appID identifies the application to Fyne, for its preferences and storage.
+const appID = "com.github.adrianfulla.xmppclient"
+
+// uiLog returns the logger for the user interface.
+func uiLog() *slog.Logger {
+    return xmpp.Logger("ui")
+}
+
 func ShowLoginWindow() {
-    myApp := app.New()
+    // The ID gives the app persistent preferences.
+    myApp := app.NewWithID(appID)
     myWindow := myApp.NewWindow("XMPP Chat Client")
 
     serverEntry := widget.NewEntry()
@@ -42,7 +56,7 @@ func ShowLoginWindow() {
 
         handler, err := xmppfunctions.Login(hostPort[0], hostPort[1], username, password)
         if err != nil {
-            log.Printf("Login failed: %v", err)
+            uiLog().Error("login failed", "err", err)
             dialog.ShowError(err, myWindow)
             return
         }
@@ -69,30 +83,239 @@ func ShowLoginWindow() {
 }
 
 
-// ShowContactsWindow displays the user's contact list.
-func ShowChatWindow(app fyne.App, handler *xmpp.XMPPHandler, recipient string, contact xmppfunctions.Contact) *xmpp.ChatWindow {
-    chatWindow := app.NewWindow("Chat with " + recipient)
+// historyPage is how many messages of the history a chat window loads at a
+// time.
+const historyPage = 30
+
+// ChatWindow is an open conversation with a contact.
+type ChatWindow struct {
+    Window       fyne.Window
+    ChatContent  *fyne.Container
+    Handler      *xmpp.XMPPHandler
+    Recipient    jid.JID
+
+    mu          sync.Mutex
+    scroll      *container.Scroll
+    shown       int                      // messages of the history shown, for paging
+    labels      map[string]*widget.Label // our messages by stanza ID, to show their delivery state
+    archive     string                   // archive ID to back-fill the conversation from
+    archiveDone bool                     // the archive has nothing older
+}
+
+// chatWindowSet holds the open conversations, keyed by bare JID. It is read
+// by the stanza reader when a message arrives and written by the UI.
+type chatWindowSet struct {
+    mu      sync.Mutex
+    windows map[jid.JID]*ChatWindow
+}
+
+var chatWindows = &chatWindowSet{windows: make(map[jid.JID]*ChatWindow)}
+
+func (s *chatWindowSet) Get(contact jid.JID) (*ChatWindow, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    cw, ok := s.windows[contact.Bare()]
+    return cw, ok
+}
+
+func (s *chatWindowSet) Put(contact jid.JID, cw *ChatWindow) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.windows[contact.Bare()] = cw
+}
+
+func (s *chatWindowSet) Remove(contact jid.JID) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.windows, contact.Bare())
+}
+
+// AddMessage shows a message at the end of the conversation. sent is set
+// for the messages we sent.
+func (cw *ChatWindow) AddMessage(msg *xmpp.Message, sent bool) {
+    record := xmpp.HistoryRecord{ID: msg.ID, Contact: cw.Recipient, Body: msg.Body, Time: msg.SentAt(), State: xmpp.MessageReceived}
+    if sent {
+        record.Direction, record.State = xmpp.Outbound, xmpp.MessageSent
+    }
+    cw.ChatContent.Add(cw.messageLabel(record))
+    cw.mu.Lock()
+    cw.shown++
+    cw.mu.Unlock()
+
+    // Refresh the window to display the new message
+    cw.Window.Content().Refresh()
+    cw.scroll.ScrollToBottom()
+}
+
+// LoadOlder shows the page of the history before the messages shown, and
+// reports whether there may be more.
+func (cw *ChatWindow) LoadOlder() (bool, error) {
+    cw.mu.Lock()
+    shown := cw.shown
+    cw.mu.Unlock()
+    records, err := cw.Handler.ChatHistory(cw.Recipient, shown, historyPage)
+    if err != nil {
+        return true, err
+    }
+
+    labels := make([]fyne.CanvasObject, 0, len(records)+len(cw.ChatContent.Objects))
+    for _, record := range records {
+        labels = append(labels, cw.messageLabel(record))
+    }
+    cw.ChatContent.Objects = append(labels, cw.ChatContent.Objects...)
+    cw.ChatContent.Refresh()
+
+    cw.mu.Lock()
+    cw.shown += len(records)
+    cw.mu.Unlock()
+    return len(records) == historyPage, nil
+}
+
+// Reload shows the history again, extra messages more than were shown, after
+// messages older than the last one were added to it.
+func (cw *ChatWindow) Reload(extra int) error {
+    cw.mu.Lock()
+    count := cw.shown + extra
+    cw.mu.Unlock()
+    if count < historyPage {
+        count = historyPage
+    }
+    records, err := cw.Handler.ChatHistory(cw.Recipient, 0, count)
+    if err != nil {
+        return err
+    }
+
+    cw.mu.Lock()
+    cw.labels = make(map[string]*widget.Label)
+    cw.shown = len(records)
+    cw.mu.Unlock()
+    labels := make([]fyne.CanvasObject, 0, len(records))
+    for _, record := range records {
+        labels = append(labels, cw.messageLabel(record))
+    }
+    cw.ChatContent.Objects = labels
+    cw.ChatContent.Refresh()
+    return nil
+}
+
+// LoadArchived fetches the page of the server archive before the one fetched
+// last, the most recent the first time, and shows the messages the history
+// missed. It reports whether the archive has older ones.
+func (cw *ChatWindow) LoadArchived() (bool, error) {
+    cw.mu.Lock()
+    before, done := cw.archive, cw.archiveDone
+    cw.mu.Unlock()
+    if done {
+        return false, nil
+    }
+    page, added, err := cw.Handler.BackfillConversation(cw.Recipient, before)
+    if err != nil {
+        return false, err
+    }
+
+    more := !page.Complete && page.First != ""
+    cw.mu.Lock()
+    cw.archive, cw.archiveDone = page.First, !more
+    cw.mu.Unlock()
+    if added > 0 {
+        return more, cw.Reload(added)
+    }
+    return more, nil
+}
+
+// SetState shows the new delivery state of a message we sent.
+func (cw *ChatWindow) SetState(id string, state xmpp.DeliveryState) {
+    cw.mu.Lock()
+    label, ok := cw.labels[id]
+    cw.mu.Unlock()
+    if ok {
+        text, _, _ := strings.Cut(label.Text, stateSeparator)
+        label.SetText(text + stateText(state))
+    }
+}
+
+// messageLabel returns the label of a message, remembering those we sent.
+func (cw *ChatWindow) messageLabel(record xmpp.HistoryRecord) *widget.Label {
+    sender := record.Contact.String()
+    if record.Direction == xmpp.Outbound {
+        sender = "Me"
+    }
+    label := widget.NewLabel(fmt.Sprintf("[%s] %s: %s", record.Time.Local().Format("Jan 2 15:04"), sender, record.Body))
+    label.Wrapping = fyne.TextWrapWord
+    if record.Direction == xmpp.Outbound && record.ID != "" {
+        label.Text += stateText(record.State)
+        cw.mu.Lock()
+        cw.labels[record.ID] = label
+        cw.mu.Unlock()
+    }
+    return label
+}
+
+// stateSeparator sets the delivery state apart from the message in a label.
+const stateSeparator = "  ·"
+
+// stateText returns how the delivery state of a message we sent is shown.
+func stateText(state xmpp.DeliveryState) string {
+    switch state {
+    case xmpp.MessageDelivered:
+        return stateSeparator + " delivered"
+    case xmpp.MessageFailed:
+        return stateSeparator + " not delivered"
+    }
+    return ""
+}
+
+// ShowChatWindow opens a conversation with recipient, showing the last
+// messages of the history, the ones that arrived while it was closed
+// included. Older ones are loaded a page at a time, from the server archive
+// once the history runs out. The last page of the archive is fetched as the
+// window opens, for the messages exchanged from other clients.
+func ShowChatWindow(app fyne.App, handler *xmpp.XMPPHandler, recipient jid.JID, contact xmppfunctions.Contact) *ChatWindow {
+    chatWindow := app.NewWindow("Chat with " + recipient.String())
 
     messageEntry := widget.NewEntry()
     messageEntry.SetPlaceHolder("Type your message...")
+    trackTyping(messageEntry)
 
     chatContent := container.NewVBox()
+    cw := &ChatWindow{
+        Window:      chatWindow,
+        ChatContent: chatContent,
+        Handler:     handler,
+        Recipient:   recipient,
+        labels:      make(map[string]*widget.Label),
+    }
 
-    if queuedMessages, ok := handler.MessageQueue[recipient]; ok {
-        for _, msg := range queuedMessages {
-            chatContent.Add(widget.NewLabel(fmt.Sprintf("%s: %s", strings.Split(msg.From, "/")[0], msg.Body)))
+    // The unread messages are in the history, shown below.
+    handler.MarkRead(recipient)
+
+    var olderButton *widget.Button
+    olderButton = widget.NewButton("Load Older Messages", func() {
+        more, err := cw.LoadOlder()
+        if err != nil {
+            uiLog().Error("failed to load the chat history", "jid", recipient, "err", err)
+            dialog.ShowError(err, chatWindow)
+            return
         }
-        delete(handler.MessageQueue, recipient) // Clear the queue after displaying
-    }
+        if !more {
+            if more, err = cw.LoadArchived(); err != nil {
+                uiLog().Warn("failed to back-fill the conversation", "jid", recipient, "err", err)
+            }
+        }
+        if !more {
+            olderButton.Hide()
+        }
+    })
 
     sendMessageButton := widget.NewButton("Send", func() {
         message := messageEntry.Text
         if message != "" {
+            // The message is shown when the handler reports it sent.
             err := xmppfunctions.SendMessage(handler, recipient, message)
             if err != nil {
-                log.Printf("Failed to send message: %v", err)
+                uiLog().Error("failed to send message", "to", recipient, "err", err)
+                dialog.ShowError(err, chatWindow)
             } else {
-                chatContent.Add(widget.NewLabel("Me: " + message))
                 messageEntry.SetText("")
             }
         }
@@ -107,121 +330,399 @@ func ShowChatWindow(app fyne.App, handler *xmpp.XMPPHandler, recipient string, c
     messageRow := container.New(layout.NewGridLayoutWithColumns(2), messageEntry, sendMessageButton)
     buttonRow := container.NewHBox(contactDetailsButton)
 
-    chatWindow.SetContent(container.NewBorder(
-        chatContent,
+    cw.scroll = container.NewVScroll(container.NewVBox(olderButton, chatContent))
+    watchActivity(chatWindow, container.NewBorder(
+        nil,
         container.NewVBox(messageRow, buttonRow),
         nil, nil,
+        cw.scroll,
     ))
 
-    // Handle incoming messages in a separate goroutine
-    go func() {
-        for {
-            err := handler.HandleIncomingStanzas()
-            if err != nil {
-                log.Printf("Error handling stanzas: %v", err)
-                continue
-            }
-
-            chatContent.Add(widget.NewLabel("Received a new message...")) // Example, replace with actual data
-            chatWindow.Content().Refresh()
-        }
-    }()
+    if more, err := cw.LoadOlder(); err != nil {
+        uiLog().Error("failed to load the chat history", "jid", recipient, "err", err)
+    } else if !more {
+        olderButton.Hide()
+    }
 
     chatWindow.Resize(fyne.NewSize(400, 500))
     chatWindow.Show()
+    cw.scroll.ScrollToBottom()
+
+    go func() {
+        more, err := cw.LoadArchived()
+        if err != nil {
+            uiLog().Info("conversation not back-filled", "jid", recipient, "err", err)
+            return
+        }
+        if more {
+            olderButton.Show()
+        }
+        cw.scroll.ScrollToBottom()
+    }()
 
     chatWindow.SetOnClosed(func() {
-        delete(handler.ChatWindows, recipient)
+        chatWindows.Remove(recipient)
     })
 
-    return &xmpp.ChatWindow{
-        Window:      chatWindow,
-        ChatContent: chatContent,
-        Handler:     handler,
-        Recipient:   recipient,
+    return cw
+}
+
+// handleMessage shows an incoming message in its chat window, or counts it as
+// unread until the conversation is opened. Messages we sent from another
+// client are only added to an open conversation. Messages without a body,
+// such as receipts, and bounces are left out, as the history leaves them
+// out; a bounce shows as the delivery state of the message it returns.
+func handleMessage(app fyne.App, handler *xmpp.XMPPHandler, msg *xmpp.Message, sent bool) {
+    if msg.Body == "" || msg.Type == "error" {
+        return
+    }
+    if sent {
+        if chatWindow, ok := chatWindows.Get(msg.To); ok {
+            chatWindow.AddMessage(msg, true)
+        }
+        return
+    }
+
+    sender := msg.From.Bare()
+    if chatWindow, ok := chatWindows.Get(sender); ok && chatWindow != nil {
+        chatWindow.AddMessage(msg, false)
+    } else {
+        handler.MarkUnread(sender)
     }
+    app.SendNotification(&fyne.Notification{
+        Title:   "New Message",
+        Content: fmt.Sprintf("%s: %s", sender, msg.Body),
+    })
 }
 
-func ShowContactsWindow(app fyne.App, handler *xmpp.XMPPHandler) {
-    contactWindow := app.NewWindow("Contacts - " + handler.Username)
+// handleSubscription tells the user about a subscription change. Incoming
+// requests are collected in the subscription inbox.
+func handleSubscription(app fyne.App, handler *xmpp.XMPPHandler, ev *xmpp.SubscriptionEvent) {
+    switch ev.Type {
+    case "subscribe":
+        app.SendNotification(&fyne.Notification{
+            Title:   "Subscription Request",
+            Content: fmt.Sprintf("%s wants to subscribe to your presence", ev.From),
+        })
+        ShowSubscriptionInbox(app, handler)
+    case "subscribed":
+        // Your subscription request was accepted
+        app.SendNotification(&fyne.Notification{
+            Title:   "Subscription Accepted",
+            Content: fmt.Sprintf("%s accepted your subscription request", ev.From),
+        })
+    case "unsubscribe":
+        // Someone wants to unsubscribe from your presence
+        app.SendNotification(&fyne.Notification{
+            Title:   "Unsubscription Request",
+            Content: fmt.Sprintf("%s wants to unsubscribe from your presence", ev.From),
+        })
+        subscriptionInbox.Refresh()
+    case "unsubscribed":
+        // Your subscription request was rejected or someone unsubscribed
+        app.SendNotification(&fyne.Notification{
+            Title:   "Subscription Rejected",
+            Content: fmt.Sprintf("%s has rejected your subscription or unsubscribed", ev.From),
+        })
+    }
+}
 
-    var contacts []xmppfunctions.Contact
+// inboxWindow is the window of pending subscription requests. There is at
+// most one, and it is refreshed when requests come in or are answered.
+type inboxWindow struct {
+    mu      sync.Mutex
+    window  fyne.Window
+    refresh func()
+}
 
-    // Function to refresh the contact list
-    refreshContactList := func(contactList *widget.List) {
-        fmt.Printf("Obtaining contacts, first")
-        var err error
-        contacts, err = xmppfunctions.GetContacts(handler)
-        if err != nil {
-            log.Printf("Failed to get contacts: %v", err)
-            dialog.ShowError(err, contactWindow)
-            return
-        }
+var subscriptionInbox inboxWindow
 
-        contactList.Length = func() int {
-            return len(contacts)
-        }
-        contactList.UpdateItem = func(i widget.ListItemID, o fyne.CanvasObject) {
-			jid := contacts[i].JID
-			queuedMessages := len(handler.MessageQueue[jid])
-            displayText := fmt.Sprintf("%s - %s",jid,contacts[i].Status)
+// Refresh redraws the inbox, if it is open.
+func (w *inboxWindow) Refresh() {
+    w.mu.Lock()
+    refresh := w.refresh
+    w.mu.Unlock()
+    if refresh != nil {
+        refresh()
+    }
+}
 
-            if queuedMessages > 0 {
-                displayText = fmt.Sprintf("%s (%d) - %s", jid, queuedMessages, contacts[i].Status)
-            }
+// ShowSubscriptionInbox shows the subscription requests that were not
+// answered yet. Closing the window defers them: they stay in the inbox.
+func ShowSubscriptionInbox(app fyne.App, handler *xmpp.XMPPHandler) {
+    subscriptionInbox.mu.Lock()
+    defer subscriptionInbox.mu.Unlock()
+    if subscriptionInbox.window != nil {
+        subscriptionInbox.window.Show()
+        subscriptionInbox.window.RequestFocus()
+        go subscriptionInbox.Refresh()
+        return
+    }
+
+    inbox := app.NewWindow("Subscription Requests")
+    requestsBox := container.NewVBox()
 
-            o.(*widget.Label).SetText(displayText)
-			
+    var refresh func()
+    answer := func(from jid.JID, action func(jid.JID) error) {
+        if err := action(from); err != nil {
+            uiLog().Error("failed to answer subscription request", "from", from, "err", err)
+            dialog.ShowError(err, inbox)
         }
+        refresh()
+    }
+    refresh = func() {
+        requests := handler.PendingSubscriptions()
+        rows := make([]fyne.CanvasObject, 0, len(requests)+1)
+        if len(requests) == 0 {
+            rows = append(rows, widget.NewLabel("No pending requests"))
+        }
+        for _, request := range requests {
+            from := request.From
+            text := fmt.Sprintf("%s wants to see your presence (%s)", from, request.Received.Format("15:04"))
+            if request.Status != "" {
+                text += fmt.Sprintf("\n\"%s\"", request.Status)
+            }
+            label := widget.NewLabel(text)
+            label.Wrapping = fyne.TextWrapWord
+
+            rows = append(rows, container.NewVBox(
+                label,
+                container.NewHBox(
+                    widget.NewButton("Accept", func() { answer(from, handler.AcceptSubscription) }),
+                    widget.NewButton("Accept and Add Back", func() { answer(from, handler.AcceptAndSubscribe) }),
+                    widget.NewButton("Deny", func() { answer(from, handler.DenySubscription) }),
+                ),
+                widget.NewSeparator(),
+            ))
+        }
+        requestsBox.Objects = rows
+        requestsBox.Refresh()
+    }
 
-        contactList.Refresh()
+    laterButton := widget.NewButton("Decide Later", func() { inbox.Close() })
+    inbox.SetContent(container.NewBorder(nil, laterButton, nil, nil, container.NewVScroll(requestsBox)))
+    inbox.SetOnClosed(func() {
+        subscriptionInbox.mu.Lock()
+        defer subscriptionInbox.mu.Unlock()
+        subscriptionInbox.window = nil
+        subscriptionInbox.refresh = nil
+    })
+    subscriptionInbox.window = inbox
+    subscriptionInbox.refresh = refresh
+
+    refresh()
+    inbox.Resize(fyne.NewSize(420, 300))
+    inbox.Show()
+}
+
+func ShowContactsWindow(app fyne.App, handler *xmpp.XMPPHandler) {
+    contactWindow := app.NewWindow("Contacts - " + handler.Username)
+
+    // contacts is replaced by the presence poller while the tree reads it;
+    // groups is contacts sorted into the sections of the tree.
+    var (
+        contactsMu      sync.Mutex
+        contacts        []xmppfunctions.Contact
+        groups          []xmppfunctions.ContactGroup
+        separateOffline = true
+        knownSections   = make(map[string]bool)
+    )
+    regroup := func() {
+        groups = xmppfunctions.GroupContacts(contacts, separateOffline)
+    }
+    sectionAt := func(id widget.TreeNodeID) (xmppfunctions.ContactGroup, bool) {
+        contactsMu.Lock()
+        defer contactsMu.Unlock()
+        for _, group := range groups {
+            if sectionID(group) == id {
+                return group, true
+            }
+        }
+        return xmppfunctions.ContactGroup{}, false
+    }
+    contactAt := func(id widget.TreeNodeID) (xmppfunctions.Contact, xmppfunctions.ContactGroup, bool) {
+        sectionNode, address, ok := parseContactID(id)
+        if !ok {
+            return xmppfunctions.Contact{}, xmppfunctions.ContactGroup{}, false
+        }
+        section, ok := sectionAt(sectionNode)
+        if !ok {
+            return xmppfunctions.Contact{}, xmppfunctions.ContactGroup{}, false
+        }
+        contactsMu.Lock()
+        defer contactsMu.Unlock()
+        for _, contact := range contacts {
+            if contact.JID.String() == address {
+                return contact, section, true
+            }
+        }
+        return xmppfunctions.Contact{}, xmppfunctions.ContactGroup{}, false
     }
 
-    contactList := widget.NewList(
-        func() int {
-            return len(contacts)
+    contactTree := widget.NewTree(
+        func(id widget.TreeNodeID) []widget.TreeNodeID {
+            if id == "" {
+                contactsMu.Lock()
+                defer contactsMu.Unlock()
+                ids := make([]widget.TreeNodeID, 0, len(groups))
+                for _, group := range groups {
+                    ids = append(ids, sectionID(group))
+                }
+                return ids
+            }
+            group, _ := sectionAt(id)
+            ids := make([]widget.TreeNodeID, 0, len(group.Contacts))
+            for _, contact := range group.Contacts {
+                ids = append(ids, contactID(id, contact.JID))
+            }
+            return ids
         },
-        func() fyne.CanvasObject {
-            return widget.NewLabel("")
+        func(id widget.TreeNodeID) bool {
+            return id == "" || strings.HasPrefix(id, "section:")
+        },
+        func(branch bool) fyne.CanvasObject {
+            if branch {
+                return widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+            }
+            menuButton := widget.NewButtonWithIcon("", theme.MoreVerticalIcon(), nil)
+            return container.NewBorder(nil, nil, nil, menuButton, widget.NewLabel(""))
+        },
+        func(id widget.TreeNodeID, branch bool, o fyne.CanvasObject) {
+            if branch {
+                group, _ := sectionAt(id)
+                o.(*widget.Label).SetText(fmt.Sprintf("%s (%d)", group.Name, len(group.Contacts)))
+                return
+            }
+            contact, section, ok := contactAt(id)
+            if !ok {
+                return
+            }
+            unread := handler.UnreadCount(contact.JID)
+            displayText := fmt.Sprintf("%s - %s", contactLabel(contact), contact.Status)
+
+            if unread > 0 {
+                displayText = fmt.Sprintf("%s (%d) - %s", contactLabel(contact), unread, contact.Status)
+            }
+            if !contact.IdleSince.IsZero() {
+                displayText += " (" + formatIdle(contact.IdleSince) + ")"
+            }
+            if !contact.LastSeen.IsZero() {
+                displayText += " (" + formatLastSeen(contact.LastSeen) + ")"
+            }
+            displayText += userEventsText(contact.Mood, contact.Activity, contact.Tune)
+
+            row := o.(*fyne.Container)
+            row.Objects[0].(*widget.Label).SetText(displayText)
+            menuButton := row.Objects[1].(*widget.Button)
+            menuButton.OnTapped = func() {
+                showContactMenu(app, handler, contact, section, contactWindow, menuButton)
+            }
         },
-        func(i widget.ListItemID, o fyne.CanvasObject) {},
     )
 
-    refreshContactList(contactList)
+    // refreshContactTree redraws the tree after contacts or groups changed.
+    // New sections start open, except for the offline contacts.
+    refreshContactTree := func() {
+        contactsMu.Lock()
+        var opened []widget.TreeNodeID
+        for _, group := range groups {
+            id := sectionID(group)
+            if !knownSections[id] {
+                knownSections[id] = true
+                if !group.Synthetic || group.Name != xmppfunctions.OfflineSection {
+                    opened = append(opened, id)
+                }
+            }
+        }
+        contactsMu.Unlock()
+
+        for _, id := range opened {
+            contactTree.OpenBranch(id)
+        }
+        contactTree.Refresh()
+    }
+
+    // Function to refresh the contact list
+    refreshContactList := func() {
+        uiLog().Debug("obtaining contacts")
+        list, err := xmppfunctions.GetContacts(handler)
+        if err != nil {
+            uiLog().Error("failed to get contacts", "err", err)
+            dialog.ShowError(err, contactWindow)
+            return
+        }
+        contactsMu.Lock()
+        contacts = list
+        regroup()
+        contactsMu.Unlock()
+
+        refreshContactTree()
+    }
 
-    contactList.OnSelected = func(id widget.ListItemID) {
-        if id >= 0 && id < len(contacts) {
-            selectedContact := contacts[id]
+    refreshContactList()
+
+    contactTree.OnSelected = func(id widget.TreeNodeID) {
+        if strings.HasPrefix(id, "section:") {
+            contactTree.ToggleBranch(id)
+            contactTree.Unselect(id)
+            return
+        }
+        if selectedContact, _, ok := contactAt(id); ok {
             chatWindow := ShowChatWindow(app, handler, selectedContact.JID, selectedContact)
-            handler.ChatWindows[selectedContact.JID] = chatWindow
+            chatWindows.Put(selectedContact.JID, chatWindow)
 
             chatWindow.Window.SetOnClosed(func() {
-                contactList.Unselect(id)
-                delete(handler.ChatWindows, selectedContact.JID)
+                contactTree.Unselect(id)
+                chatWindows.Remove(selectedContact.JID)
             })
         } else {
-            log.Printf("Invalid selection: %d", id)
+            uiLog().Warn("invalid contact selection", "id", id)
         }
     }
 
+    offlineCheck := widget.NewCheck("Offline contacts in their own section", func(on bool) {
+        contactsMu.Lock()
+        separateOffline = on
+        regroup()
+        contactsMu.Unlock()
+        refreshContactTree()
+    })
+    offlineCheck.SetChecked(separateOffline)
+
+    newGroupButton := widget.NewButton("New Group", func() {
+        contactsMu.Lock()
+        options := make([]string, 0, len(contacts))
+        for _, contact := range contacts {
+            options = append(options, contact.JID.String())
+        }
+        contactsMu.Unlock()
+        ShowNewGroupDialog(handler, options, contactWindow)
+    })
+
     addContactButton := widget.NewButton("Add Contact", func() {
         jidEntry := widget.NewEntry()
         jidEntry.SetPlaceHolder("Enter contact JID (e.g., user@example.com)")
+        nameEntry := widget.NewEntry()
+        nameEntry.SetPlaceHolder("Name (optional)")
+        groupsEntry := widget.NewEntry()
+        groupsEntry.SetPlaceHolder("Groups, separated by commas (optional)")
 
         dialog.ShowCustomConfirm("Add Contact", "Add", "Cancel", container.NewVBox(
             widget.NewLabel("Add a new contact"),
             jidEntry,
+            nameEntry,
+            groupsEntry,
         ), func(ok bool) {
             if ok {
                 newJID := jidEntry.Text
                 if newJID != "" {
-                    err := xmppfunctions.AddContact(handler, newJID)
+                    // The list is refreshed when the server pushes the new item.
+                    err := xmppfunctions.AddContact(handler, newJID, nameEntry.Text, splitGroups(groupsEntry.Text))
                     if err != nil {
-                        log.Printf("Failed to add contact: %v", err)
+                        uiLog().Error("failed to add contact", "jid", newJID, "err", err)
                         dialog.ShowError(err, contactWindow)
                     } else {
-                        log.Printf("Contact added: %s", newJID)
-                        refreshContactList(contactList)
+                        uiLog().Info("contact added", "jid", newJID)
                     }
                 }
             }
@@ -232,37 +733,295 @@ func ShowContactsWindow(app fyne.App, handler *xmpp.XMPPHandler) {
         ShowUserSettingsWindow(app, handler)
     })
 
-    contactWindow.SetContent(
+    requestsButton := widget.NewButton("Subscription Requests", func() {
+        ShowSubscriptionInbox(app, handler)
+    })
+
+    watchActivity(contactWindow,
         container.NewBorder(
-            container.NewVBox(settingsButton, addContactButton, widget.NewLabel("Your Contacts")),
+            container.NewVBox(
+                newStatusMenu(app, handler, contactWindow),
+                container.NewGridWithColumns(2, settingsButton, requestsButton),
+                container.NewGridWithColumns(2, addContactButton, newGroupButton),
+                widget.NewLabel("Your Contacts"),
+                offlineCheck,
+            ),
             nil, nil, nil,
-            container.NewVScroll(contactList),
+            contactTree,
         ),
     )
 
-    contactWindow.Resize(fyne.NewSize(300, 400))
+    contactWindow.Resize(fyne.NewSize(350, 450))
     contactWindow.Show()
-	
-	go func() {
+
+    // Closed with the window, to stop what runs for it.
+    closed := make(chan struct{})
+
+    go func() {
+        ticker := time.NewTicker(2 * time.Second)
+        defer ticker.Stop()
         for {
+            contactsMu.Lock()
             contacts = xmppfunctions.CheckContacts(handler, contacts)
-            for _, queuedMessages := range handler.MessageQueue {
-                if len(queuedMessages) > 0 {
-                    contactList.Refresh()
+            regroup()
+            contactsMu.Unlock()
+            // Presence changes can move contacts to or from the offline section.
+            refreshContactTree()
+
+            select {
+            case <-ticker.C:
+            case <-closed:
+                return
+            }
+        }
+    }()
+
+    unsubscribe := handler.Subscribe(xmpp.SubscriberFunc(func(ev xmpp.Event) {
+        switch ev := ev.(type) {
+        case *xmpp.MessageEvent:
+            handleMessage(app, handler, ev.Message, ev.Sent)
+            contactTree.Refresh()
+        case *xmpp.SubscriptionEvent:
+            handleSubscription(app, handler, ev)
+        case *xmpp.DeliveryEvent:
+            if chatWindow, ok := chatWindows.Get(ev.Contact); ok {
+                chatWindow.SetState(ev.ID, ev.State)
+            }
+        case *xmpp.ArchiveSyncEvent:
+            // Messages exchanged while we were offline, or from other clients.
+            for _, contact := range ev.Contacts {
+                if chatWindow, ok := chatWindows.Get(contact); ok {
+                    if err := chatWindow.Reload(0); err != nil {
+                        uiLog().Error("failed to load the chat history", "jid", contact, "err", err)
+                    }
                 }
             }
+            app.SendNotification(&fyne.Notification{
+                Title:   "Messages synced",
+                Content: fmt.Sprintf("%d messages from the server archive", ev.Added),
+            })
+        case *xmpp.RosterEvent:
+            refreshContactList()
+        case *xmpp.ConnectionStateEvent:
+            if ev.State == xmpp.StateOnline {
+                // Once the presences of the contacts came in, ask the server
+                // about those that are still offline.
+                go func() {
+                    time.Sleep(xmppfunctions.PresenceSettleTime)
+                    contactsMu.Lock()
+                    known := append([]xmppfunctions.Contact(nil), contacts...)
+                    contactsMu.Unlock()
+                    xmppfunctions.QueryLastSeen(handler, known)
+                    refreshContactList()
+                }()
+            }
+            if ev.State == xmpp.StateDisconnected {
+                uiLog().Warn("connection lost", "err", ev.Err)
+                app.SendNotification(&fyne.Notification{
+                    Title:   "Disconnected",
+                    Content: "The connection to the server was lost",
+                })
+            }
+        }
+    }))
+
+    // Go away while the user is idle, for as long as the session lasts.
+    away, xa := idleThresholds(app)
+    autoAway = xmpp.NewAutoAway(handler, away, xa)
+    go autoAway.Run(closed)
+
+    contactWindow.SetOnClosed(func() {
+        unsubscribe()
+        closeStatusMenu()
+        close(closed)
+    })
+
+    // The contacts appear when the roster arrives.
+    go handler.ListenForIncomingStanzas()
+}
+
+// contactLabel returns how a contact is shown: its name and address, or just
+// its address.
+func contactLabel(contact xmppfunctions.Contact) string {
+    if contact.Name == "" {
+        return contact.JID.String()
+    }
+    return fmt.Sprintf("%s <%s>", contact.Name, contact.JID)
+}
+
+// Tree node IDs of the contacts window: a roster group is
+// "section:group:<name>", the Ungrouped and Offline sections are
+// "section:list:<name>" so that a group of the same name is apart, and a
+// contact in a section "contact:<section ID>\n<jid>", since a contact can be
+// in several sections.
+func sectionID(group xmppfunctions.ContactGroup) widget.TreeNodeID {
+    if group.Synthetic {
+        return "section:list:" + group.Name
+    }
+    return "section:group:" + group.Name
+}
+
+func contactID(section widget.TreeNodeID, contact jid.JID) widget.TreeNodeID {
+    return "contact:" + section + "\n" + contact.String()
+}
 
-            time.Sleep(2 * time.Second)
+func parseContactID(id widget.TreeNodeID) (section widget.TreeNodeID, address string, ok bool) {
+    rest, ok := strings.CutPrefix(id, "contact:")
+    if !ok {
+        return "", "", false
+    }
+    i := strings.LastIndex(rest, "\n")
+    if i < 0 {
+        return "", "", false
+    }
+    return rest[:i], rest[i+1:], true
+}
+
+// showContactMenu shows the actions on a contact of the tree under its
+// menu button.
+func showContactMenu(app fyne.App, handler *xmpp.XMPPHandler, contact xmppfunctions.Contact, section xmppfunctions.ContactGroup, parent fyne.Window, button fyne.CanvasObject) {
+    items := []*fyne.MenuItem{
+        fyne.NewMenuItem("Move to Group...", func() {
+            ShowMoveContactDialog(handler, contact, section, parent)
+        }),
+        fyne.NewMenuItem("Send Directed Presence...", func() {
+            ShowDirectedPresenceDialog(handler, contact, parent)
+        }),
+    }
+    for _, pres := range handler.DirectedPresences() {
+        if pres.To == contact.JID.Bare() {
+            items = append(items, fyne.NewMenuItem("End Directed Presence", func() {
+                err := handler.SendPresence(xmpp.NewPresence(pres.To, "unavailable", xmpp.ShowAvailable, "", 0))
+                if err != nil {
+                    dialog.ShowError(err, parent)
+                }
+            }))
         }
-    }()
+    }
+    items = append(items, fyne.NewMenuItem("Details", func() {
+        ShowContactDetailsWindow(app, handler, contact)
+    }))
 
-    go func() {
-        for msg := range handler.MessageChan {
-            handler.DispatchMessage(msg)
+    position := app.Driver().AbsolutePositionForObject(button).AddXY(0, button.Size().Height)
+    widget.ShowPopUpMenuAtPosition(fyne.NewMenu("", items...), parent.Canvas(), position)
+}
+
+// ShowDirectedPresenceDialog sends a presence to a single contact, which
+// it sees even while we are invisible, until it is ended or we log out.
+func ShowDirectedPresenceDialog(handler *xmpp.XMPPHandler, contact xmppfunctions.Contact, parent fyne.Window) {
+    shows := make([]string, len(xmpp.Shows))
+    for i, show := range xmpp.Shows {
+        shows[i] = show.String()
+    }
+    showSelect := widget.NewSelect(shows, nil)
+    showSelect.SetSelected(xmpp.ShowAvailable.String())
+    statusEntry := widget.NewEntry()
+    statusEntry.SetPlaceHolder("Status message (optional)")
+
+    dialog.ShowForm("Presence for "+contactLabel(contact), "Send", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Show", showSelect),
+        widget.NewFormItem("Status", statusEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
         }
-    }()
+        show, err := xmpp.ParseShow(showSelect.Selected)
+        if err == nil {
+            err = handler.SendPresence(xmpp.NewPresence(contact.JID.Bare(), "", show, statusEntry.Text, 0))
+        }
+        if err != nil {
+            uiLog().Error("failed to send directed presence", "to", contact.JID, "err", err)
+            dialog.ShowError(err, parent)
+        }
+    }, parent)
+}
+
+// ShowMoveContactDialog asks for the group to move a contact to from one of
+// the sections it is listed in. Typing a name that is not a group yet
+// creates it.
+func ShowMoveContactDialog(handler *xmpp.XMPPHandler, contact xmppfunctions.Contact, section xmppfunctions.ContactGroup, parent fyne.Window) {
+    // Only a roster group can be left; from the other sections the contact is
+    // added to the new group, unless it is in just one group.
+    from := section.Name
+    if section.Synthetic {
+        from = ""
+        if section.Name == xmppfunctions.OfflineSection && len(contact.Groups) == 1 {
+            from = contact.Groups[0]
+        }
+    }
 
-    handler.ListenForIncomingStanzas()
+    var options []string
+    for _, group := range handler.Roster().Groups() {
+        if group != from {
+            options = append(options, group)
+        }
+    }
+    if from != "" {
+        options = append(options, xmppfunctions.UngroupedSection)
+    }
+    groupEntry := widget.NewSelectEntry(options)
+    groupEntry.SetPlaceHolder("Group, or the name of a new one")
+
+    dialog.ShowForm("Move "+contactLabel(contact), "Move", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("To group", groupEntry),
+    }, func(ok bool) {
+        to := strings.TrimSpace(groupEntry.Text)
+        if !ok || to == "" {
+            return
+        }
+        if to == xmppfunctions.OfflineSection {
+            dialog.ShowError(fmt.Errorf("%q is reserved", to), parent)
+            return
+        }
+        if to == xmppfunctions.UngroupedSection {
+            to = ""
+        }
+        // The tree is refreshed when the server pushes the changed item.
+        if err := xmppfunctions.MoveContact(handler, contact.JID, from, to); err != nil {
+            uiLog().Error("failed to move contact", "jid", contact.JID, "err", err)
+            dialog.ShowError(err, parent)
+        }
+    }, parent)
+}
+
+// ShowNewGroupDialog asks for the name of a new group and the contacts to
+// put in it, chosen among the given addresses.
+func ShowNewGroupDialog(handler *xmpp.XMPPHandler, addresses []string, parent fyne.Window) {
+    nameEntry := widget.NewEntry()
+    nameEntry.SetPlaceHolder("Group name")
+    members := widget.NewCheckGroup(addresses, nil)
+
+    content := container.NewBorder(nameEntry, nil, nil, nil, container.NewVScroll(members))
+    form := dialog.NewCustomConfirm("New Group", "Create", "Cancel", content, func(ok bool) {
+        if !ok {
+            return
+        }
+        var contacts []jid.JID
+        for _, address := range members.Selected {
+            contactJID, err := jid.Parse(address)
+            if err != nil {
+                continue
+            }
+            contacts = append(contacts, contactJID)
+        }
+        if err := xmppfunctions.CreateGroup(handler, nameEntry.Text, contacts); err != nil {
+            uiLog().Error("failed to create group", "group", nameEntry.Text, "err", err)
+            dialog.ShowError(err, parent)
+        }
+    }, parent)
+    form.Resize(fyne.NewSize(300, 350))
+    form.Show()
+}
+
+// splitGroups parses a comma-separated list of group names.
+func splitGroups(text string) []string {
+    var groups []string
+    for _, group := range strings.Split(text, ",") {
+        if group = strings.TrimSpace(group); group != "" {
+            groups = append(groups, group)
+        }
+    }
+    return groups
 }
 
 
@@ -272,10 +1031,10 @@ func ShowUserSettingsWindow(app fyne.App, handler *xmpp.XMPPHandler) {
     logoutButton := widget.NewButton("Logout", func() {
         err := xmppfunctions.Logout(handler)
         if err != nil {
-            log.Printf("Logout failed: %v", err)
+            uiLog().Error("logout failed", "err", err)
             dialog.ShowError(err, settingsWindow)
         } else {
-            log.Println("Logged out successfully")
+            uiLog().Info("logged out")
             CloseAllWindows(app)
             settingsWindow.Close()
             app.Quit()
@@ -287,11 +1046,11 @@ func ShowUserSettingsWindow(app fyne.App, handler *xmpp.XMPPHandler) {
             if confirm {
                 err := xmppfunctions.RemoveAccount(handler)
                 if err != nil {
-                    log.Printf("Account removal failed: %v", err)
+                    uiLog().Error("account removal failed", "err", err)
                     dialog.ShowError(err, settingsWindow)
                     app.Quit()
                 } else {
-                    log.Println("Account removed successfully")
+                    uiLog().Info("account removed")
                     settingsWindow.Close()
                     app.Quit()
                 }
@@ -306,11 +1065,53 @@ func ShowUserSettingsWindow(app fyne.App, handler *xmpp.XMPPHandler) {
         ChangePresenceWindow(app, handler)
     })
 
+    changePasswordButton := widget.NewButton("Change Password", func() {
+        ShowChangePasswordWindow(app, handler)
+    })
+
+    // Idle times after which the presence changes on its own; 0 disables.
+    away, xa := idleThresholds(app)
+    awayEntry := widget.NewEntry()
+    awayEntry.SetText(strconv.Itoa(int(away.Minutes())))
+    xaEntry := widget.NewEntry()
+    xaEntry.SetText(strconv.Itoa(int(xa.Minutes())))
+    minutes := func(text string) error {
+        if n, err := strconv.Atoi(strings.TrimSpace(text)); err != nil || n < 0 {
+            return errors.New("enter a number of minutes, or 0 to disable")
+        }
+        return nil
+    }
+    awayEntry.Validator = minutes
+    xaEntry.Validator = minutes
+
+    idleForm := widget.NewForm(
+        widget.NewFormItem("Away after (min)", awayEntry),
+        widget.NewFormItem("Extended away after (min)", xaEntry),
+    )
+    idleForm.SubmitText = "Save Idle Settings"
+    idleForm.OnSubmit = func() {
+        awayMinutes, _ := strconv.Atoi(strings.TrimSpace(awayEntry.Text))
+        xaMinutes, _ := strconv.Atoi(strings.TrimSpace(xaEntry.Text))
+        app.Preferences().SetInt(prefAutoAwayMinutes, awayMinutes)
+        app.Preferences().SetInt(prefAutoXAMinutes, xaMinutes)
+        if autoAway != nil {
+            autoAway.SetThresholds(idleThresholds(app))
+        }
+        uiLog().Info("idle settings saved", "away", awayMinutes, "xa", xaMinutes)
+    }
+
     settingsWindow.SetContent(container.NewVBox(
         widget.NewLabel("User Settings"),
         changePresenceButton,
+        changePasswordButton,
         logoutButton,
         deleteAccountButton,
+        widget.NewSeparator(),
+        widget.NewLabel("Automatic Away"),
+        idleForm,
+        widget.NewSeparator(),
+        widget.NewLabel("Mood, Activity and Tune"),
+        userEventsAccordion(handler, settingsWindow),
     ))
 
     settingsWindow.Resize(fyne.NewSize(300, 200))
@@ -319,6 +1120,86 @@ func ShowUserSettingsWindow(app fyne.App, handler *xmpp.XMPPHandler) {
 
 
 
+func ShowChangePasswordWindow(app fyne.App, handler *xmpp.XMPPHandler) {
+    passwordWindow := app.NewWindow("Change Password")
+
+    currentEntry := widget.NewPasswordEntry()
+    currentEntry.SetPlaceHolder("Current password")
+
+    newEntry := widget.NewPasswordEntry()
+    newEntry.SetPlaceHolder("New password")
+
+    confirmEntry := widget.NewPasswordEntry()
+    confirmEntry.SetPlaceHolder("Confirm new password")
+
+    errorLabel := widget.NewLabel("")
+    errorLabel.Wrapping = fyne.TextWrapWord
+
+    formBox := container.NewVBox()
+
+    // Set when the server asks for a data form instead of the plain request.
+    var pendingForm *xmpp.DataForm
+    var applyForm func()
+
+    applyButton := widget.NewButton("Change Password", func() {
+        // The password of this session: the one logged in with, or the
+        // last one changed to. Saved login credentials are not updated.
+        if currentEntry.Text != handler.Password {
+            errorLabel.SetText("The current password is not correct")
+            return
+        }
+        if newEntry.Text == "" || newEntry.Text != confirmEntry.Text {
+            errorLabel.SetText("The new passwords do not match")
+            return
+        }
+
+        var err error
+        if pendingForm != nil {
+            applyForm()
+            err = xmppfunctions.SubmitPasswordForm(handler, pendingForm, newEntry.Text)
+        } else {
+            err = xmppfunctions.ChangePassword(handler, newEntry.Text)
+        }
+
+        var formErr *xmpp.FormRequiredError
+        if errors.As(err, &formErr) {
+            pendingForm = formErr.Form
+            var formWidget fyne.CanvasObject
+            formWidget, applyForm = newDataFormWidget(pendingForm, func(string) fyne.Resource { return nil })
+            formBox.Objects = []fyne.CanvasObject{formWidget}
+            formBox.Refresh()
+            errorLabel.SetText("The server needs more information, complete the form and try again")
+            return
+        }
+        if err != nil {
+            uiLog().Error("password change failed", "err", err)
+            errorLabel.SetText(fmt.Sprintf("Error: %v", err))
+            return
+        }
+
+        uiLog().Info("password changed")
+        app.SendNotification(&fyne.Notification{
+            Title:   "Change Password",
+            Content: "Your password was changed",
+        })
+        passwordWindow.Close()
+    })
+
+    passwordWindow.SetContent(container.NewVBox(
+        widget.NewLabel("Change Your Password"),
+        currentEntry,
+        newEntry,
+        confirmEntry,
+        formBox,
+        errorLabel,
+        applyButton,
+    ))
+
+    passwordWindow.Resize(fyne.NewSize(300, 250))
+    passwordWindow.Show()
+}
+
+
 func CloseAllWindows(app fyne.App) {
     for _, window := range app.Driver().AllWindows() {
         window.Close()
@@ -330,50 +1211,93 @@ func ShowCreateAccountDialog(app fyne.App, parent fyne.Window) {
     serverEntry := widget.NewEntry()
     serverEntry.SetPlaceHolder("Server (e.g., alumchat.lol:5222)")
 
-    usernameEntry := widget.NewEntry()
-    usernameEntry.SetPlaceHolder("Desired Username")
-
-    passwordEntry := widget.NewPasswordEntry()
-    passwordEntry.SetPlaceHolder("Desired Password")
-
     errorLabel := widget.NewLabel("")
+    errorLabel.Wrapping = fyne.TextWrapWord
+
+    formBox := container.NewVBox()
 
     dialogWindow := app.NewWindow("Create Account")
 
+    var conn *xmpp.XMPPConnection
+    var query *xmpp.RegisterQuery
+    var applyForm func()
+
     confirmButton := widget.NewButton("Create Account", func() {
-        server := serverEntry.Text
-        username := usernameEntry.Text
-        password := passwordEntry.Text
+        if conn == nil || query == nil {
+            return
+        }
+        applyForm()
 
-        hostPort := strings.Split(server, ":")
+        err := xmppfunctions.SubmitRegistration(conn, query)
+        conn = nil // the connection is closed after every submission
+        if err != nil {
+            uiLog().Error("account creation failed", "err", err)
+            var redirect *xmpp.RedirectError
+            if errors.As(err, &redirect) {
+                formBox.Objects = []fyne.CanvasObject{newRedirectLink(redirect.URL)}
+                formBox.Refresh()
+            }
+            errorLabel.SetText(fmt.Sprintf("Error: %v (fetch the form again to retry)", err))
+            return
+        }
+
+        errorLabel.SetText("Account created successfully!")
+        uiLog().Info("account created")
+        dialogWindow.Close() // Close the account creation window on success
+    })
+    confirmButton.Disable()
+
+    fetchButton := widget.NewButton("Get Registration Form", func() {
+        hostPort := strings.Split(serverEntry.Text, ":")
         if len(hostPort) != 2 {
             errorLabel.SetText("Invalid server format")
             return
         }
 
-        err := xmppfunctions.CreateUser(hostPort[0], hostPort[1], username, password)
+        if conn != nil {
+            conn.Close()
+        }
+
+        var err error
+        conn, query, err = xmppfunctions.FetchRegistrationForm(hostPort[0], hostPort[1])
         if err != nil {
-            log.Printf("Account creation failed: %v", err)
+            uiLog().Error("fetching registration form failed", "err", err)
             errorLabel.SetText(fmt.Sprintf("Error: %v", err))
+            confirmButton.Disable()
             return
         }
 
-        errorLabel.SetText("Account created successfully!")
-        log.Println("Account created successfully")
-        dialogWindow.Close() // Close the account creation window on success
+        var formWidget fyne.CanvasObject
+        formWidget, applyForm = newRegistrationFormWidget(query)
+        formBox.Objects = []fyne.CanvasObject{formWidget}
+        formBox.Refresh()
+        errorLabel.SetText("")
+
+        if query.IsRedirect() {
+            confirmButton.Disable()
+        } else {
+            confirmButton.Enable()
+        }
+        dialogWindow.Resize(dialogWindow.Content().MinSize())
+    })
+
+    dialogWindow.SetOnClosed(func() {
+        if conn != nil {
+            conn.Close()
+        }
     })
 
     content := container.NewVBox(
         widget.NewLabel("Create a New XMPP Account"),
         serverEntry,
-        usernameEntry,
-        passwordEntry,
+        fetchButton,
+        formBox,
         errorLabel,
         confirmButton,
     )
 
-    dialogWindow.SetContent(content)
-    dialogWindow.Resize(fyne.NewSize(300, 200))
+    dialogWindow.SetContent(container.NewVScroll(content))
+    dialogWindow.Resize(fyne.NewSize(350, 300))
     dialogWindow.Show()
 }
 
@@ -381,38 +1305,128 @@ func ShowCreateAccountDialog(app fyne.App, parent fyne.Window) {
 func ChangePresenceWindow(app fyne.App, handler *xmpp.XMPPHandler) {
     presenceWindow := app.NewWindow("Change Presence")
 
-    // Create a drop-down for the presence type
-    presenceTypes := []string{"chat", "away", "dnd", "xa"}
-    presenceTypeSelect := widget.NewSelect(presenceTypes, func(value string) {
-        log.Println("Selected presence type:", value)
+    // Start from the presence we have now.
+    current, ok := handler.OwnPresence()
+    if !ok || !current.IsAvailable() {
+        current = xmpp.NewPresence(jid.JID{}, "", xmpp.ShowAvailable, "", 0)
+    }
+
+    // Create a drop-down for the availability
+    shows := make([]string, len(xmpp.Shows))
+    for i, show := range xmpp.Shows {
+        shows[i] = show.String()
+    }
+    showSelect := widget.NewSelect(shows, func(value string) {
+        uiLog().Debug("selected presence show", "show", value)
     })
-    presenceTypeSelect.SetSelected("chat") // Default selection
+    showSelect.SetSelected(current.Show.String())
 
     // Create an entry for the custom status message
     statusEntry := widget.NewEntry()
     statusEntry.SetPlaceHolder("Enter your status message")
+    statusEntry.SetText(current.Status)
+
+    // The priority decides which of our clients gets the messages sent to
+    // our bare address.
+    priorityEntry := widget.NewEntry()
+    priorityEntry.SetText(strconv.Itoa(current.Priority))
+    priorityEntry.Validator = func(text string) error {
+        priority, err := strconv.Atoi(strings.TrimSpace(text))
+        if err != nil || priority < -128 || priority > 127 {
+            return errors.New("the priority must be a number between -128 and 127")
+        }
+        return nil
+    }
+
+    // The saved presets fill the window when chosen, and can be deleted.
+    presetList := container.NewVBox()
+    var refreshPresets func()
+    refreshPresets = func() {
+        presetList.RemoveAll()
+        for _, preset := range loadPresets(app) {
+            useButton := widget.NewButton(preset.Name, func() {
+                showSelect.SetSelected(preset.Show.String())
+                statusEntry.SetText(preset.Status)
+                priorityEntry.SetText(strconv.Itoa(preset.Priority))
+            })
+            deleteButton := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+                removePreset(app, preset.Name)
+                refreshPresets()
+            })
+            presetList.Add(container.NewBorder(nil, nil, nil, deleteButton, useButton))
+        }
+    }
+    refreshPresets()
+
+    // While invisible, only the contacts we send directed presence to see us.
+    invisibleCheck := widget.NewCheck("Invisible", nil)
+    invisibleCheck.SetChecked(handler.Visibility() != xmpp.Visible)
 
     // Create a button to apply the changes
     applyButton := widget.NewButton("Apply", func() {
-        selectedType := presenceTypeSelect.Selected
-        statusMessage := statusEntry.Text
+        show, err := xmpp.ParseShow(showSelect.Selected)
+        if err == nil {
+            err = priorityEntry.Validate()
+        }
+        if err != nil {
+            dialog.ShowError(err, presenceWindow)
+            return
+        }
+        priority, _ := strconv.Atoi(strings.TrimSpace(priorityEntry.Text))
 
-        // Send the presence update to the XMPP server
-        err := handler.SendPresence(selectedType, statusMessage)
+        // Switch visibility first, so that going invisible doesn't
+        // broadcast the new presence to every contact.
+        err = handler.SetInvisible(invisibleCheck.Checked)
+        if err == nil {
+            err = handler.SetAvailability(show, statusEntry.Text, priority)
+        }
         if err != nil {
-            log.Printf("Failed to change presence: %v", err)
+            uiLog().Error("failed to change presence", "err", err)
             dialog.ShowError(err, presenceWindow)
         } else {
-            log.Printf("Presence changed to: %s - %s", selectedType, statusMessage)
+            uiLog().Info("presence changed", "show", show, "priority", priority)
+            rememberStatus(app, show, statusEntry.Text, priority)
             presenceWindow.Close() // Close the window after applying the changes
         }
     })
 
+    // Save what the window holds as a preset for the status menu.
+    saveButton := widget.NewButton("Save as Preset", func() {
+        show, err := xmpp.ParseShow(showSelect.Selected)
+        if err == nil {
+            err = priorityEntry.Validate()
+        }
+        if err != nil {
+            dialog.ShowError(err, presenceWindow)
+            return
+        }
+        priority, _ := strconv.Atoi(strings.TrimSpace(priorityEntry.Text))
+
+        nameEntry := widget.NewEntry()
+        nameEntry.SetPlaceHolder("Preset name")
+        nameEntry.SetText(statusEntry.Text)
+        dialog.ShowCustomConfirm("Save as Preset", "Save", "Cancel", nameEntry, func(ok bool) {
+            name := strings.TrimSpace(nameEntry.Text)
+            if !ok || name == "" {
+                return
+            }
+            addPreset(app, statusPreset{Name: name, Show: show, Status: statusEntry.Text, Priority: priority})
+            refreshPresets()
+        }, presenceWindow)
+    })
+
     presenceWindow.SetContent(container.NewVBox(
         widget.NewLabel("Change Your Presence"),
-        presenceTypeSelect,
+        showSelect,
         statusEntry,
-        applyButton,
+        widget.NewForm(widget.NewFormItem("Priority", priorityEntry)),
+        invisibleCheck,
+        container.NewGridWithColumns(2, applyButton, saveButton),
+        widget.NewSeparator(),
+        widget.NewLabel("Presets"),
+        presetList,
+        widget.NewSeparator(),
+        directedPresenceList(handler, presenceWindow),
     ))
 
     presenceWindow.Resize(fyne.NewSize(300, 200))
@@ -420,26 +1434,219 @@ func ChangePresenceWindow(app fyne.App, handler *xmpp.XMPPHandler) {
 }
 
 
-func ShowContactDetailsWindow(app fyne.App, handler *xmpp.XMPPHandler, recipient xmppfunctions.Contact) {
-    detailsWindow := app.NewWindow("Contact Details - " + recipient.JID)
+// directedPresenceList lists the contacts that got a directed presence, each
+// with a button to end it.
+func directedPresenceList(handler *xmpp.XMPPHandler, parent fyne.Window) fyne.CanvasObject {
+    list := container.NewVBox()
+    var refresh func()
+    refresh = func() {
+        list.RemoveAll()
+        directed := handler.DirectedPresences()
+        if len(directed) == 0 {
+            list.Add(widget.NewLabel("No directed presence sent"))
+        }
+        for _, pres := range directed {
+            endButton := widget.NewButton("End", func() {
+                err := handler.SendPresence(xmpp.NewPresence(pres.To, "unavailable", xmpp.ShowAvailable, "", 0))
+                if err != nil {
+                    dialog.ShowError(err, parent)
+                }
+                refresh()
+            })
+            list.Add(container.NewBorder(nil, nil, nil, endButton,
+                widget.NewLabel(fmt.Sprintf("%s sees you as %s", pres.To, pres.Show))))
+        }
+    }
+    refresh()
+    return container.NewVBox(widget.NewLabel("Directed Presence"), list)
+}
 
 
+func ShowContactDetailsWindow(app fyne.App, handler *xmpp.XMPPHandler, recipient xmppfunctions.Contact) {
+    detailsWindow := app.NewWindow("Contact Details - " + recipient.JID.String())
+
+    editButton := widget.NewButton("Edit Contact", func() {
+        nameEntry := widget.NewEntry()
+        nameEntry.SetText(recipient.Name)
+        nameEntry.SetPlaceHolder("Name")
+        groupsEntry := widget.NewEntry()
+        groupsEntry.SetText(strings.Join(recipient.Groups, ", "))
+        groupsEntry.SetPlaceHolder("Groups, separated by commas")
+
+        dialog.ShowCustomConfirm("Edit Contact", "Save", "Cancel", container.NewVBox(
+            nameEntry,
+            groupsEntry,
+        ), func(ok bool) {
+            if !ok {
+                return
+            }
+            err := xmppfunctions.UpdateContact(handler, recipient.JID, nameEntry.Text, splitGroups(groupsEntry.Text))
+            if err != nil {
+                uiLog().Error("failed to update contact", "jid", recipient.JID, "err", err)
+                dialog.ShowError(err, detailsWindow)
+                return
+            }
+            detailsWindow.Close()
+        }, detailsWindow)
+    })
 
-    // if contact == nil {
-    //     detailsWindow.SetContent(widget.NewLabel("Contact details not found."))
-    // } else {
-        details := container.NewVBox(
-            widget.NewLabel("JID: " + recipient.JID),
-            widget.NewLabel("Name: " + recipient.Name),
-            widget.NewLabel("Subscription: " + recipient.Subscription),
-            widget.NewLabel("Status: " + recipient.Status),
-            widget.NewLabel("Presence: " + recipient.Presence),
-        )
+    removeButton := widget.NewButton("Remove Contact", func() {
+        dialog.ShowConfirm("Remove Contact", fmt.Sprintf("Remove %s from your contacts?", recipient.JID), func(ok bool) {
+            if !ok {
+                return
+            }
+            if err := xmppfunctions.RemoveContact(handler, recipient.JID); err != nil {
+                uiLog().Error("failed to remove contact", "jid", recipient.JID, "err", err)
+                dialog.ShowError(err, detailsWindow)
+                return
+            }
+            detailsWindow.Close()
+        }, detailsWindow)
+    })
 
-        detailsWindow.SetContent(details)
-    // }
+    details := container.NewVBox(
+        widget.NewLabel("JID: " + recipient.JID.String()),
+        widget.NewLabel("Name: " + recipient.Name),
+        widget.NewLabel("Groups: " + strings.Join(recipient.Groups, ", ")),
+        widget.NewLabel("Subscription: " + handler.SubscriptionState(recipient.JID).String()),
+        widget.NewLabel("Status: " + recipient.Status),
+        widget.NewLabel("Presence: " + recipient.Presence),
+        lastSeenLabel(handler, recipient),
+        widget.NewLabel("Mood: " + orNone(recipient.Mood)),
+        widget.NewLabel("Activity: " + orNone(recipient.Activity)),
+        widget.NewLabel("Listening to: " + orNone(recipient.Tune)),
+        resourceList(handler, recipient.JID),
+        presenceTimeline(handler, recipient.JID),
+        container.NewHBox(editButton, removeButton),
+        subscriptionButtons(handler, recipient.JID, detailsWindow),
+    )
 
+    detailsWindow.SetContent(details)
     detailsWindow.Resize(fyne.NewSize(300, 200))
     detailsWindow.Show()
 }
 
+// subscriptionButtons returns the actions that change the subscriptions with
+// a contact from their current state.
+func subscriptionButtons(handler *xmpp.XMPPHandler, contact jid.JID, parent fyne.Window) fyne.CanvasObject {
+    act := func(action func(jid.JID) error) func() {
+        return func() {
+            if err := action(contact); err != nil {
+                uiLog().Error("failed to change subscription", "jid", contact, "err", err)
+                dialog.ShowError(err, parent)
+                return
+            }
+            parent.Close()
+        }
+    }
+
+    state := handler.SubscriptionState(contact)
+    buttons := container.NewHBox()
+    switch {
+    case state.To || state.PendingOut:
+        buttons.Add(widget.NewButton("Stop Seeing Presence", act(handler.CancelSubscription)))
+    default:
+        buttons.Add(widget.NewButton("Request Presence", act(handler.RequestSubscription)))
+    }
+    switch {
+    case state.PendingIn:
+        buttons.Add(widget.NewButton("Answer Request", func() {
+            ShowSubscriptionInbox(fyne.CurrentApp(), handler)
+        }))
+    case state.From || state.PreApproved:
+        buttons.Add(widget.NewButton("Hide My Presence", act(handler.DenySubscription)))
+    default:
+        buttons.Add(widget.NewButton("Pre-approve", act(handler.AcceptSubscription)))
+    }
+    return buttons
+}
+
+// timelineLength is how many presence changes the details window shows.
+const timelineLength = 50
+
+// presenceTimeline lists the last presence changes of a contact, the newest
+// first.
+func presenceTimeline(handler *xmpp.XMPPHandler, contact jid.JID) fyne.CanvasObject {
+    records, err := handler.PresenceHistory(contact, timelineLength)
+    if err != nil {
+        uiLog().Warn("failed to read the presence history", "jid", contact, "err", err)
+    }
+    if len(records) == 0 {
+        return widget.NewLabel("Presence history: none recorded")
+    }
+
+    list := container.NewVBox()
+    for i := len(records) - 1; i >= 0; i-- {
+        record := records[i]
+        text := "offline"
+        if record.Available() {
+            text = record.Show.String()
+        }
+        if resource := record.From.Resourcepart(); resource != "" {
+            text = resource + ": " + text
+        }
+        if record.Status != "" {
+            text += fmt.Sprintf(" (%s)", record.Status)
+        }
+        list.Add(widget.NewLabel(record.Time.Local().Format("Jan 2 15:04") + "  " + text))
+    }
+    scroll := container.NewVScroll(list)
+    scroll.SetMinSize(fyne.NewSize(0, 150))
+    return container.NewBorder(widget.NewLabel("Presence history:"), nil, nil, nil, scroll)
+}
+
+// orNone returns text, or "none" if it is empty.
+func orNone(text string) string {
+    if text == "" {
+        return "none"
+    }
+    return text
+}
+
+// lastSeenLabel tells when an offline contact was last online.
+func lastSeenLabel(handler *xmpp.XMPPHandler, contact xmppfunctions.Contact) fyne.CanvasObject {
+    if contact.Available {
+        return widget.NewLabel("Last seen: online now")
+    }
+    if seen, ok := handler.LastSeen(contact.JID); ok {
+        return widget.NewLabel("Last seen: " + seen.Local().Format("Jan 2 2006 15:04"))
+    }
+    return widget.NewLabel("Last seen: unknown")
+}
+
+// formatLastSeen returns when an offline contact was last online, as
+// "last seen 3h ago".
+func formatLastSeen(seen time.Time) string {
+    ago := time.Since(seen)
+    switch {
+    case ago < time.Minute:
+        return "last seen just now"
+    case ago < time.Hour:
+        return fmt.Sprintf("last seen %dm ago", int(ago.Minutes()))
+    case ago < 24*time.Hour:
+        return fmt.Sprintf("last seen %dh ago", int(ago.Hours()))
+    }
+    return "last seen " + seen.Local().Format("Jan 2")
+}
+
+// resourceList lists the online resources of a contact, the one that
+// represents it first.
+func resourceList(handler *xmpp.XMPPHandler, contact jid.JID) fyne.CanvasObject {
+    resources := handler.Resources(contact)
+    if len(resources) == 0 {
+        return widget.NewLabel("Resources: none online")
+    }
+    list := container.NewVBox(widget.NewLabel("Resources:"))
+    for _, pres := range resources {
+        show := pres.Show
+        if show == "" {
+            show = "available"
+        }
+        text := fmt.Sprintf("  %s: %s, priority %d", pres.From.Resourcepart(), show, pres.Priority)
+        if pres.HasStatus() {
+            text += fmt.Sprintf(" (%s)", pres.Status)
+        }
+        list.Add(widget.NewLabel(text))
+    }
+    return list
+}
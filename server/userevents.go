@@ -0,0 +1,182 @@
+package main
+
+import (
+    "errors"
+    "sort"
+    "strconv"
+    "strings"
+
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+    xmpp "github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
+)
+
+// noneOption is the choice that clears a mood or activity.
+const noneOption = "(none)"
+
+// userEventsAccordion returns the forms that publish our mood, activity and
+// tune. They start from what we published last, as the server sends it
+// back to us.
+func userEventsAccordion(handler *xmpp.XMPPHandler, parent fyne.Window) *widget.Accordion {
+    return widget.NewAccordion(
+        widget.NewAccordionItem("Mood", moodForm(handler, parent)),
+        widget.NewAccordionItem("Activity", activityForm(handler, parent)),
+        widget.NewAccordionItem("Tune", tuneForm(handler, parent)),
+    )
+}
+
+// published reports the result of publishing something to the user.
+func published(what string, err error, parent fyne.Window) {
+    if err != nil {
+        uiLog().Error("failed to publish", "what", what, "err", err)
+        dialog.ShowError(err, parent)
+        return
+    }
+    uiLog().Info("published", "what", what)
+}
+
+func moodForm(handler *xmpp.XMPPHandler, parent fyne.Window) fyne.CanvasObject {
+    current, _ := handler.ContactMood(handler.JID)
+
+    moodSelect := widget.NewSelect(append([]string{noneOption}, xmpp.Moods...), nil)
+    moodSelect.SetSelected(noneOption)
+    if current.Value != "" {
+        moodSelect.SetSelected(current.Value)
+    }
+    textEntry := widget.NewEntry()
+    textEntry.SetPlaceHolder("Why? (optional)")
+    textEntry.SetText(current.Text)
+
+    form := widget.NewForm(
+        widget.NewFormItem("Mood", moodSelect),
+        widget.NewFormItem("Text", textEntry),
+    )
+    form.SubmitText = "Publish Mood"
+    form.OnSubmit = func() {
+        var mood xmpp.Mood
+        if moodSelect.Selected != noneOption {
+            mood = xmpp.Mood{Value: moodSelect.Selected, Text: strings.TrimSpace(textEntry.Text)}
+        }
+        published("mood", handler.PublishMood(mood), parent)
+    }
+    return form
+}
+
+func activityForm(handler *xmpp.XMPPHandler, parent fyne.Window) fyne.CanvasObject {
+    current, _ := handler.ContactActivity(handler.JID)
+
+    generals := make([]string, 0, len(xmpp.Activities))
+    for general := range xmpp.Activities {
+        generals = append(generals, general)
+    }
+    sort.Strings(generals)
+
+    // The specific activities depend on the general one.
+    specificSelect := widget.NewSelect(nil, nil)
+    generalSelect := widget.NewSelect(append([]string{noneOption}, generals...), func(general string) {
+        specificSelect.Options = append([]string{noneOption}, xmpp.Activities[general]...)
+        if general != noneOption {
+            specificSelect.Options = append(specificSelect.Options, "other")
+        }
+        specificSelect.SetSelected(noneOption)
+    })
+    generalSelect.SetSelected(noneOption)
+    if current.General != "" {
+        generalSelect.SetSelected(current.General)
+        if current.Specific != "" {
+            specificSelect.SetSelected(current.Specific)
+        }
+    }
+    textEntry := widget.NewEntry()
+    textEntry.SetPlaceHolder("Details (optional)")
+    textEntry.SetText(current.Text)
+
+    form := widget.NewForm(
+        widget.NewFormItem("Activity", generalSelect),
+        widget.NewFormItem("Specifically", specificSelect),
+        widget.NewFormItem("Text", textEntry),
+    )
+    form.SubmitText = "Publish Activity"
+    form.OnSubmit = func() {
+        var activity xmpp.Activity
+        if generalSelect.Selected != noneOption {
+            activity = xmpp.Activity{General: generalSelect.Selected, Text: strings.TrimSpace(textEntry.Text)}
+            if specificSelect.Selected != noneOption {
+                activity.Specific = specificSelect.Selected
+            }
+        }
+        published("activity", handler.PublishActivity(activity), parent)
+    }
+    return form
+}
+
+func tuneForm(handler *xmpp.XMPPHandler, parent fyne.Window) fyne.CanvasObject {
+    current, _ := handler.ContactTune(handler.JID)
+
+    artistEntry := widget.NewEntry()
+    artistEntry.SetText(current.Artist)
+    titleEntry := widget.NewEntry()
+    titleEntry.SetText(current.Title)
+    sourceEntry := widget.NewEntry()
+    sourceEntry.SetPlaceHolder("Album (optional)")
+    sourceEntry.SetText(current.Source)
+    lengthEntry := widget.NewEntry()
+    lengthEntry.SetPlaceHolder("Seconds (optional)")
+    if current.Length > 0 {
+        lengthEntry.SetText(strconv.Itoa(current.Length))
+    }
+    lengthEntry.Validator = func(text string) error {
+        if text = strings.TrimSpace(text); text == "" {
+            return nil
+        }
+        if n, err := strconv.Atoi(text); err != nil || n < 0 {
+            return errors.New("enter the length in seconds")
+        }
+        return nil
+    }
+
+    form := widget.NewForm(
+        widget.NewFormItem("Artist", artistEntry),
+        widget.NewFormItem("Title", titleEntry),
+        widget.NewFormItem("Album", sourceEntry),
+        widget.NewFormItem("Length", lengthEntry),
+    )
+    form.SubmitText = "Publish Tune"
+    form.OnSubmit = func() {
+        length, _ := strconv.Atoi(strings.TrimSpace(lengthEntry.Text))
+        published("tune", handler.PublishTune(xmpp.Tune{
+            Artist: strings.TrimSpace(artistEntry.Text),
+            Title:  strings.TrimSpace(titleEntry.Text),
+            Source: strings.TrimSpace(sourceEntry.Text),
+            Length: length,
+        }), parent)
+    }
+    form.CancelText = "Stop Listening"
+    form.OnCancel = func() {
+        artistEntry.SetText("")
+        titleEntry.SetText("")
+        sourceEntry.SetText("")
+        lengthEntry.SetText("")
+        published("tune", handler.PublishTune(xmpp.Tune{}), parent)
+    }
+    return form
+}
+
+// userEventsText returns the mood, activity and tune of a contact for the
+// contact list, as " [happy; working: coding; ♪ Artist - Title]".
+func userEventsText(mood, activity, tune string) string {
+    var parts []string
+    for _, part := range []string{mood, activity} {
+        if part != "" {
+            parts = append(parts, part)
+        }
+    }
+    if tune != "" {
+        parts = append(parts, "♪ "+tune)
+    }
+    if len(parts) == 0 {
+        return ""
+    }
+    return " [" + strings.Join(parts, "; ") + "]"
+}
@@ -4,38 +4,55 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"log"
+	"sort"
 	"strings"
-    // "time"
-	"sync"
+	"time"
 
 	"github.com/adrianfulla/Proyecto1-Redes/server/xmpp"
+	"github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
 )
 
 // CreateUser creates a new account on the XMPP server.
 func CreateUser(domain,port, username, password string) error {
-    handler := &xmpp.XMPPHandler{
-        Server:   domain +":"+port,
-        Username: username,
-        Password: password,
+    conn, query, err := FetchRegistrationForm(domain, port)
+    if err != nil {
+        return err
     }
 
+    query.SetValue("username", username)
+    query.SetValue("password", password)
+    return SubmitRegistration(conn, query)
+}
+
+// FetchRegistrationForm connects to the server and retrieves the registration form.
+// The returned connection stays open until the form is passed to SubmitRegistration.
+func FetchRegistrationForm(domain, port string) (*xmpp.XMPPConnection, *xmpp.RegisterQuery, error) {
     conn, err := xmpp.NewXMPPConnection(domain, port, false)
     if err != nil {
-        return err
+        return nil, nil, err
     }
-    handler.Conn = conn
 
-    if err := handler.Conn.StartStream(""); err != nil {
-        return err
+    if err := conn.StartStream(""); err != nil {
+        conn.Close()
+        return nil, nil, err
     }
 
-    // If the user does not exist, create it
-    if err := xmpp.CreateUser(handler.Conn, username, password); err != nil {
-        log.Println("User creation failed or user already exists, proceeding with login...")
-        return err
+    query, err := xmpp.FetchRegistrationForm(conn)
+    if err != nil {
+        conn.Close()
+        return nil, nil, err
     }
+    return conn, query, nil
+}
+
+// SubmitRegistration sends the completed registration form and closes the connection.
+func SubmitRegistration(conn *xmpp.XMPPConnection, query *xmpp.RegisterQuery) error {
+    defer conn.Close()
 
+    if err := xmpp.SubmitRegistration(conn, query); err != nil {
+        xmpp.Logger("register").Error("user creation failed", "err", err)
+        return err
+    }
     return nil
 }
 
@@ -45,6 +62,37 @@ func Login(domain,port, username, password string) (*xmpp.XMPPHandler, error) {
     if err != nil {
         return nil, err
     }
+
+    // Show the cached roster right away; Fetch then only downloads the changes.
+    store, err := xmpp.NewFileRosterStore(handler.JID)
+    if err == nil {
+        err = handler.Roster().UseStore(store)
+    }
+    if err != nil {
+        xmpp.Logger("roster").Warn("roster cache unavailable", "err", err)
+    }
+    // Subscription requests stay in the inbox until they are answered.
+    requests, err := xmpp.NewFileSubscriptionStore(handler.JID)
+    if err == nil {
+        err = handler.UseSubscriptionStore(requests)
+    }
+    if err != nil {
+        xmpp.Logger("presence").Warn("subscription requests unavailable", "err", err)
+    }
+    // Hear about the mood, activity and tune of the contacts.
+    for _, node := range []string{xmpp.NodeMood, xmpp.NodeActivity, xmpp.NodeTune} {
+        handler.Notify(node, true)
+    }
+    if history, err := xmpp.NewFileHistoryStore(handler.JID); err == nil {
+        handler.UseHistory(history)
+    } else {
+        xmpp.Logger("history").Warn("chat history unavailable, keeping it for this session", "err", err)
+    }
+    if history, err := xmpp.NewFilePresenceHistory(handler.JID); err == nil {
+        handler.UsePresenceHistory(history)
+    } else {
+        xmpp.Logger("presence").Warn("presence history unavailable", "err", err)
+    }
     // handler.SendPresence("presence", "Online")
     return handler, nil
 }
@@ -55,8 +103,11 @@ func Logout(handler *xmpp.XMPPHandler) error {
         return errors.New("invalid handler")
     }
     defer handler.Conn.Close()
-    // You may send unavailable presence before logging out
-    return handler.SendPresence("unavailable", "Logging out")
+    // End the directed presences before going offline for everyone.
+    if err := handler.EndDirectedPresences(); err != nil {
+        xmpp.Logger("presence").Warn("failed to end directed presences", "err", err)
+    }
+    return handler.SendPresence(xmpp.NewPresence(jid.JID{}, "unavailable", xmpp.ShowAvailable, "Logging out", 0))
 }
 
 // RemoveAccount removes a user account from the XMPP server.
@@ -65,126 +116,292 @@ func RemoveAccount(handler *xmpp.XMPPHandler) error {
         return errors.New("invalid handler")
     }
 
-    iqID := "remove1"
-    removeRequest := `<iq type="set" id="` + iqID + `"><query xmlns="jabber:iq:register"><remove/></query></iq>`
-    _, err := handler.Conn.Conn.Write([]byte(removeRequest))
-    if err != nil {
-        return fmt.Errorf("failed to send remove request: %v", err)
-    }
+    removeRequest := xmpp.NewIQ("set", "remove1")
+    removeRequest.SetQuery(&xmpp.RegisterQuery{Remove: &struct{}{}})
 
     // Wait for the response
-    buffer := make([]byte, 4096)
-    n, err := handler.Conn.Conn.Read(buffer)
+    response, err := handler.SendIQ(removeRequest)
     if err != nil {
-        return fmt.Errorf("error reading remove account response: %v", err)
+        return fmt.Errorf("failed to send remove request: %v", err)
     }
 
-    response := string(buffer[:n])
-    if strings.Contains(response, "<iq type=\"result\"") {
-        log.Println("Account removed successfully")
+    if response.Type == "result" {
+        xmpp.Logger("register").Info("account removed")
         return nil
     }
 
-    return fmt.Errorf("failed to remove account: %s", response)
+    if response.Error != nil {
+        return fmt.Errorf("failed to remove account: %w", response.Error)
+    }
+    return errors.New("failed to remove account: unexpected response")
 }
 
-// GetContacts retrieves the user's roster (contact list).
-func GetContacts(handler *xmpp.XMPPHandler) ([]Contact, error) {
-    iqID := "getRoster1"
-    rosterRequest := `<iq type="get" id="` + iqID + `"><query xmlns="jabber:iq:roster"/></iq>`
-
-    var iq IQ
-
-
-    _, err := handler.Conn.Conn.Write([]byte(rosterRequest))
-    if err != nil {
-        return nil, fmt.Errorf("failed to send roster request: %v", err)
+// ChangePassword changes the password of the logged in account.
+// If the server needs more information it returns an *xmpp.FormRequiredError
+// whose form must be completed and passed to SubmitPasswordForm.
+func ChangePassword(handler *xmpp.XMPPHandler, newPassword string) error {
+    if handler == nil || handler.Conn == nil {
+        return errors.New("invalid handler")
     }
+    return handler.ChangePassword(newPassword)
+}
 
-    buffer := make([]byte, 4096)
-    n, err := handler.Conn.Conn.Read(buffer)
-    if err != nil {
-        return nil, fmt.Errorf("error reading roster response: %v", err)
+// SubmitPasswordForm submits a completed password change form.
+func SubmitPasswordForm(handler *xmpp.XMPPHandler, form *xmpp.DataForm, newPassword string) error {
+    if handler == nil || handler.Conn == nil {
+        return errors.New("invalid handler")
     }
-    response := string(buffer[:n])
-    fmt.Printf("Obtained response: %s\n", response)
-    err = xml.Unmarshal([]byte(response), &iq)
+    return handler.SubmitPasswordForm(form, newPassword)
+}
 
+// GetContacts returns the contacts of the user's roster with their last known
+// presence. The roster is kept up to date by the handler, so this doesn't
+// query the server; it is empty until the roster has been loaded.
+func GetContacts(handler *xmpp.XMPPHandler) ([]Contact, error) {
+    if handler == nil {
+        return nil, errors.New("invalid handler")
+    }
     contacts := []Contact{}
-    var wg sync.WaitGroup
-
-    for _, item := range iq.Query.Items {
-        wg.Add(1)
+    for _, item := range handler.Roster().Items() {
         contact := Contact{
             JID:          item.JID,
             Name:         item.Name,
+            Groups:       item.Groups,
             Subscription: item.Subscription,
             Presence:     "unavailable", // Default to unavailable
             Status:       "Offline",
         }
-        log.Printf(contact.JID)
-        // Check if there is a presence for this contact in the PresenceStack
-        if presence, found := handler.PresenceStack[contact.JID]; found {
-            
-            contact.Presence = presence.Show
-            if (presence.HasStatus()){
-                contact.Status = presence.Status
-            }else if (presence.IsAvailable()) {
-                contact.Status = "Online"
-            } else{
-                contact.Status = "Offline"
-            }
-        }
-
-        contacts = append(contacts, contact)
+        contacts = append(contacts, withPresence(handler, contact))
     }
-
     return contacts, nil
 }
 
+// CheckContacts refreshes the presence of a list of contacts.
 func CheckContacts(handler *xmpp.XMPPHandler, contacts []Contact) ([]Contact){
     newContacts := []Contact{}
     for _,contact := range contacts{
-        if presence, found := handler.PresenceStack[contact.JID]; found {
-            contact.Presence = presence.Show
-            if (presence.HasStatus()){
-                contact.Status = presence.Status
-            }else if (presence.IsAvailable()) {
-                contact.Status = "Online"
-            } else{
-                contact.Status = "Offline"
-            }
-        }
-        newContacts = append(newContacts, contact)
+        newContacts = append(newContacts, withPresence(handler, contact))
     }
     return newContacts
 }
 
-// AddContact adds a new contact to the user's roster.
-func AddContact(handler *xmpp.XMPPHandler, jid string) error {
-    // Send a presence subscription request to the new contact
-    subscriptionRequest := fmt.Sprintf(
-        `<presence to='%s' type='subscribe'/>`,
-        jid,
-    )
+// withPresence fills the presence and status of a contact from the last
+// presence received from it, and what it published of its mood, activity
+// and tune.
+func withPresence(handler *xmpp.XMPPHandler, contact Contact) Contact {
+    contact.Mood, contact.Activity, contact.Tune = "", "", ""
+    if mood, ok := handler.ContactMood(contact.JID); ok {
+        contact.Mood = mood.String()
+    }
+    if activity, ok := handler.ContactActivity(contact.JID); ok {
+        contact.Activity = activity.String()
+    }
+    if tune, ok := handler.ContactTune(contact.JID); ok {
+        contact.Tune = tune.String()
+    }
+
+    if presence, found := handler.Presence(contact.JID); found {
+        contact.Presence = presence.Show.String()
+        contact.Available = presence.IsAvailable()
+        contact.IdleSince = time.Time{}
+        if since, idle := presence.IdleSince(); idle && contact.Available {
+            contact.IdleSince = since
+        }
+        if (presence.HasStatus()){
+            contact.Status = presence.Status
+        }else if (presence.IsAvailable()) {
+            contact.Status = "Online"
+        } else{
+            contact.Status = "Offline"
+        }
+    }
+    contact.LastSeen = time.Time{}
+    if !contact.Available {
+        if seen, ok := handler.LastSeen(contact.JID); ok {
+            contact.LastSeen = seen
+        }
+    }
+    return contact
+}
+
+// PresenceSettleTime is how long the presences of the contacts take to come
+// in once our initial presence is sent.
+const PresenceSettleTime = 5 * time.Second
+
+// QueryLastSeen asks the server when the contacts that share their presence
+// with us and are still offline were last online. It is meant to run once the
+// initial presences came in. The answer only replaces what the presence
+// history knows if it is more recent.
+func QueryLastSeen(handler *xmpp.XMPPHandler, contacts []Contact) {
+    for _, contact := range contacts {
+        if presence, ok := handler.Presence(contact.JID); ok && presence.IsAvailable() {
+            continue
+        }
+        if contact.Subscription != "to" && contact.Subscription != "both" {
+            continue
+        }
+        if _, _, err := handler.QueryLastActivity(contact.JID); err != nil {
+            xmpp.Logger("presence").Debug("no last activity", "contact", contact.JID, "err", err)
+        }
+    }
+}
+
+// AddContact adds a new contact to the user's roster, with an optional name
+// and groups, and asks to see its presence.
+func AddContact(handler *xmpp.XMPPHandler, address, name string, groups []string) error {
+    contactJID, err := jid.Parse(address)
+    if err != nil {
+        return fmt.Errorf("invalid contact address %q: %w", address, err)
+    }
+    if contactJID.Localpart() == "" {
+        return fmt.Errorf("invalid contact address %q: missing user name", address)
+    }
 
-    _, err := handler.Conn.Conn.Write([]byte(subscriptionRequest))
+    err = handler.Roster().Set(xmpp.RosterItem{JID: contactJID, Name: name, Groups: groups})
     if err != nil {
+        return err
+    }
+
+    // Ask the new contact to see its presence, unless we already do.
+    if state := handler.SubscriptionState(contactJID); state.To || state.PendingOut {
+        return nil
+    }
+    if err := handler.RequestSubscription(contactJID); err != nil {
         return fmt.Errorf("failed to send subscription request: %v", err)
     }
 
     return nil
 }
 
+// UpdateContact changes the name and groups of a contact of the roster.
+func UpdateContact(handler *xmpp.XMPPHandler, contactJID jid.JID, name string, groups []string) error {
+    if _, ok := handler.Roster().Item(contactJID); !ok {
+        return fmt.Errorf("%s is not in the roster", contactJID.Bare())
+    }
+    return handler.Roster().Set(xmpp.RosterItem{JID: contactJID, Name: name, Groups: groups})
+}
+
+// RemoveContact removes a contact from the roster, which also cancels the
+// presence subscriptions with it.
+func RemoveContact(handler *xmpp.XMPPHandler, contactJID jid.JID) error {
+    return handler.Roster().Remove(contactJID)
+}
+
+// Sections of the contact list that are not roster groups.
+const (
+    UngroupedSection = "Ungrouped"
+    OfflineSection   = "Offline"
+)
+
+// ContactGroup is a section of the contact list. Synthetic is set for the
+// Ungrouped and Offline sections, which a roster group may share a name with.
+type ContactGroup struct {
+    Name      string
+    Contacts  []Contact
+    Synthetic bool
+}
+
+// GroupContacts sorts contacts into their roster groups, in alphabetical
+// order, followed by the contacts that are in no group. A contact in several
+// groups appears in each of them. With separateOffline, the contacts that are
+// offline are taken out of their groups and listed in a last Offline section.
+// Sections without contacts are left out.
+func GroupContacts(contacts []Contact, separateOffline bool) []ContactGroup {
+    byName := make(map[string]*ContactGroup)
+    var names []string
+    var ungrouped, offline []Contact
+    for _, contact := range contacts {
+        if separateOffline && !contact.Available {
+            offline = append(offline, contact)
+            continue
+        }
+        if len(contact.Groups) == 0 {
+            ungrouped = append(ungrouped, contact)
+            continue
+        }
+        for _, name := range contact.Groups {
+            group, ok := byName[name]
+            if !ok {
+                group = &ContactGroup{Name: name}
+                byName[name] = group
+                names = append(names, name)
+            }
+            group.Contacts = append(group.Contacts, contact)
+        }
+    }
+
+    sort.Strings(names)
+    groups := make([]ContactGroup, 0, len(names)+2)
+    for _, name := range names {
+        groups = append(groups, *byName[name])
+    }
+    if len(ungrouped) > 0 {
+        groups = append(groups, ContactGroup{Name: UngroupedSection, Contacts: ungrouped, Synthetic: true})
+    }
+    if len(offline) > 0 {
+        groups = append(groups, ContactGroup{Name: OfflineSection, Contacts: offline, Synthetic: true})
+    }
+    return groups
+}
+
+// MoveContact moves a contact from one roster group to another. An empty
+// from or to stands for no group; moving to a group that doesn't exist yet
+// creates it.
+func MoveContact(handler *xmpp.XMPPHandler, contactJID jid.JID, from, to string) error {
+    item, ok := handler.Roster().Item(contactJID)
+    if !ok {
+        return fmt.Errorf("%s is not in the roster", contactJID.Bare())
+    }
+    groups := []string{}
+    for _, group := range item.Groups {
+        if group != from && group != to {
+            groups = append(groups, group)
+        }
+    }
+    if to != "" {
+        groups = append(groups, to)
+    }
+    return handler.Roster().Set(xmpp.RosterItem{JID: item.JID, Name: item.Name, Groups: groups})
+}
+
+// CreateGroup creates a roster group with some contacts in it. The contacts
+// stay in the groups they were already in.
+func CreateGroup(handler *xmpp.XMPPHandler, name string, contacts []jid.JID) error {
+    name = strings.TrimSpace(name)
+    if name == "" {
+        return errors.New("the group needs a name")
+    }
+    if name == UngroupedSection || name == OfflineSection {
+        return fmt.Errorf("%q is reserved", name)
+    }
+    if len(contacts) == 0 {
+        return errors.New("a group needs at least one contact")
+    }
+    for _, contactJID := range contacts {
+        item, ok := handler.Roster().Item(contactJID)
+        if !ok {
+            return fmt.Errorf("%s is not in the roster", contactJID.Bare())
+        }
+        if item.HasGroup(name) {
+            continue
+        }
+        err := handler.Roster().Set(xmpp.RosterItem{JID: item.JID, Name: item.Name, Groups: append(item.Groups, name)})
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
 
 // GetContactDetails retrieves details about a specific contact.
-func GetContactDetails(handler *xmpp.XMPPHandler, contactJID string) (ContactDetails, error) {
+func GetContactDetails(handler *xmpp.XMPPHandler, contactJID jid.JID) (ContactDetails, error) {
     iqID := "v1"
-    vCardRequest := fmt.Sprintf(`<iq from='%s' type='get' id='%s'><vCard xmlns='vcard-temp'/></iq>`, contactJID, iqID)
+    vCardRequest := xmpp.NewIQ("get", iqID)
+    vCardRequest.To = contactJID.Bare()
+    vCardRequest.SetQuery(&vCardQuery{})
 
     // Send the vCard request
-    fmt.Println(vCardRequest)
-    _, err := handler.Conn.Conn.Write([]byte(vCardRequest))
+    err := handler.SendStanza(vCardRequest)
     if err != nil {
         return ContactDetails{}, fmt.Errorf("failed to send vCard request: %v", err)
     }
@@ -224,32 +441,30 @@ func GetContactDetails(handler *xmpp.XMPPHandler, contactJID string) (ContactDet
 }
 
 // SendMessage sends a one-to-one message to a specific user.
-func SendMessage(handler *xmpp.XMPPHandler, to, message string) error {
+func SendMessage(handler *xmpp.XMPPHandler, to jid.JID, message string) error {
     return handler.SendMessage(to, message)
 }
 
 // JoinGroupChat allows the user to join a multi-user chat room.
-func JoinGroupChat(handler *xmpp.XMPPHandler, roomJID, nickname string) error {
-    presence := fmt.Sprintf(
-        `<presence to='%s/%s'><x xmlns='http://jabber.org/protocol/muc'/></presence>`,
-        roomJID, nickname,
-    )
-    _, err := handler.Conn.Conn.Write([]byte(presence))
-    return err
+func JoinGroupChat(handler *xmpp.XMPPHandler, roomJID jid.JID, nickname string) error {
+    occupant, err := roomJID.WithResource(nickname)
+    if err != nil {
+        return fmt.Errorf("invalid nickname %q: %w", nickname, err)
+    }
+    presence := xmpp.NewPresence(occupant, "", "", "", 0)
+    if err := presence.Extensions.Add(xmpp.MUCJoin{}); err != nil {
+        return err
+    }
+    return handler.SendStanza(presence)
 }
 
 // SendNotification sends a notification to a user or group.
-func SendNotification(handler *xmpp.XMPPHandler, to, notification string) error {
-    message := fmt.Sprintf(
-        `<message to='%s' type='headline'><body>%s</body></message>`,
-        to, notification,
-    )
-    _, err := handler.Conn.Conn.Write([]byte(message))
-    return err
+func SendNotification(handler *xmpp.XMPPHandler, to jid.JID, notification string) error {
+    return handler.SendStanza(xmpp.NewMessage(to, "headline", notification))
 }
 
 // SendFile sends a file to a specific contact.
-func SendFile(handler *xmpp.XMPPHandler, to, filePath string) error {
+func SendFile(handler *xmpp.XMPPHandler, to jid.JID, filePath string) error {
     // Implement file transfer using XMPP's file transfer protocols
     return nil
 }
@@ -268,41 +483,28 @@ func ReceiveMessages(handler *xmpp.XMPPHandler) (string, error) {
 
 
 type Contact struct {
-    JID    string
+    JID    jid.JID
     Name   string
+    Groups []string
     Subscription string
     Presence string
     Status string
+    Available bool
+    IdleSince time.Time // zero unless the contact said it is idle (XEP-0319)
+    LastSeen time.Time // when an offline contact was last online, if known
+    Mood string // published with PEP, empty if none
+    Activity string
+    Tune string
 }
 
 type ContactDetails struct {
-    JID       string
+    JID       jid.JID
     Name      string
     VCardInfo string
 }
 
-type RosterQuery struct {
-	XMLName xml.Name    `xml:"query"`
-	Items   []RosterItem `xml:"item"`
-}
-
-type RosterItem struct {
-	JID          string `xml:"jid,attr"`
-	Subscription string `xml:"subscription,attr"`
-	Name         string `xml:"name,attr,omitempty"`
-}
-
-type IQ struct {
-	XMLName xml.Name   `xml:"iq"`
-	Type    string     `xml:"type,attr"`
-	ID      string     `xml:"id,attr"`
-	To      string     `xml:"to,attr,omitempty"`
-	Query   RosterQuery `xml:"query"`
-}
-
-
 type vCardQuery struct {
-    XMLName xml.Name `xml:"vCard"`
+    XMLName xml.Name `xml:"vcard-temp vCard"`
     FullName string  `xml:"FN,omitempty"`
     Nickname string  `xml:"NICKNAME,omitempty"`
     Email    string  `xml:"EMAIL>USERID,omitempty"`
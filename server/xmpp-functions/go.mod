@@ -5,3 +5,8 @@ go 1.22.1
 replace github.com/adrianfulla/Proyecto1-Redes/server/xmpp => ../xmpp
 
 require github.com/adrianfulla/Proyecto1-Redes/server/xmpp v0.0.0-00010101000000-000000000000
+
+require (
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+)
@@ -5,12 +5,11 @@ import (
     "encoding/base64"
     "errors"
     "fmt"
-    "log"
     "strings"
 )
 
 type AuthRequest struct {
-    XMLName   xml.Name `xml:"auth"`
+    XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl auth"`
     Mechanism string   `xml:"mechanism,attr"`
     Text      string   `xml:",chardata"`
 }
@@ -23,62 +22,6 @@ func (a *AuthRequest) ToXML() (string, error) {
     return string(output), nil
 }
 
-// Authenticate performs SASL PLAIN authentication with the XMPP server.
-// func Authenticate(conn *XMPPConnection, username, password string) error {
-//     // Perform STARTTLS if available
-//     if err := StartTLS(conn); err != nil {
-//         return fmt.Errorf("STARTTLS failed: %v", err)
-//     }
-
-//     // Reinitiate stream
-//     if err := conn.StartStream(""); err != nil {
-//         return fmt.Errorf("failed to start stream after STARTTLS: %v", err)
-//     }
-
-//     // Read initial response and check for stream features
-//     buffer := make([]byte, 4096)
-//     n, err := conn.Conn.Read(buffer)
-//     if err != nil {
-//         return fmt.Errorf("error reading initial response after STARTTLS: %v", err)
-//     }
-
-//     initialResponse := string(buffer[:n])
-//     log.Printf("Received initial response after STARTTLS: %s\n", initialResponse)
-
-//     if !strings.Contains(initialResponse, "<stream:features>") {
-//         return errors.New("expected <stream:features> but did not receive it after STARTTLS")
-//     }
-
-//     // Perform SASL PLAIN authentication
-//     authText := "\x00" + username + "\x00" + password
-//     authBase64 := base64.StdEncoding.EncodeToString([]byte(authText))
-//     auth := AuthRequest{
-//         Mechanism: "PLAIN",
-//         Text:      authBase64,
-//     }
-
-//     if err := sendStanza(conn, &auth); err != nil {
-//         return fmt.Errorf("failed to send authentication request: %v", err)
-//     }
-
-//     // Wait for the response
-//     n, err = conn.Conn.Read(buffer)
-//     if err != nil {
-//         return fmt.Errorf("error reading authentication response: %v", err)
-//     }
-
-//     response := string(buffer[:n])
-//     log.Printf("Received authentication response: %s\n", response)
-
-//     if strings.Contains(response, "<success") {
-//         log.Println("Authentication successful")
-//         return nil
-//     }
-
-//     return errors.New("authentication failed or unexpected response")
-// }
-
-
 // Authenticate performs SASL PLAIN authentication with the XMPP server.
 func Authenticate(conn *XMPPConnection, username, password string) error {
     StartTLS_trys := 0
@@ -108,20 +51,22 @@ func Authenticate(conn *XMPPConnection, username, password string) error {
     }
 
     initialResponse := string(buffer[:n])
-    log.Printf("Received initial response after STARTTLS: %s\n", initialResponse)
+    Logger("auth").Debug("received stream features after STARTTLS", "xml", WireXML(initialResponse))
 
     if !strings.Contains(initialResponse, "<stream:features>") {
         return errors.New("expected <stream:features> but did not receive it after STARTTLS")
     }
+    conn.noteFeatures(buffer[:n])
 
  	authText := "\x00" + username + "\x00" + password
-	// log.Printf("AuthText before Base64: %s", authText)
     authBase64 := base64.StdEncoding.EncodeToString([]byte(authText))
-    authStanza := fmt.Sprintf(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">%s</auth>`, authBase64)
+    authStanza, err := (&AuthRequest{Mechanism: "PLAIN", Text: authBase64}).ToXML()
+    if err != nil {
+        return err
+    }
 
 
-	// Log the outgoing authentication stanza
-    log.Printf("Sending authentication stanza: %s", authStanza)
+    Logger("auth").Debug("sending authentication stanza", "xml", WireXML(authStanza))
 
     // Send the authentication stanza
     _, err = conn.Conn.Write([]byte(authStanza))
@@ -136,11 +81,12 @@ func Authenticate(conn *XMPPConnection, username, password string) error {
     }
 
     response := string(buffer[:n])
-    log.Printf("Received authentication response: %s\n", response)
+    Logger("auth").Debug("received authentication response", "xml", WireXML(response))
+    conn.noteFeatures(buffer[:n])
 
     // Check for successful authentication
     if strings.Contains(response, "<success") {
-        log.Println("Authentication successful")
+        Logger("auth").Info("authentication successful", "user", username)
         return nil
     }
 
@@ -3,12 +3,12 @@ package xmpp
 import (
 	"encoding/xml"
 	"fmt"
-	"log"
-	"strings"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"fyne.io/fyne/v2"
-    "fyne.io/fyne/v2/widget"
-    "fyne.io/fyne/v2/dialog"
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
 )
 
 type XMPPHandler struct {
@@ -16,26 +16,23 @@ type XMPPHandler struct {
     Server   string
     Username string
     Password string
-    ChatWindows map[string]*ChatWindow
-    MessageChan chan *Message
-    MessageQueue map[string][]*Message
-    PresenceStack map[string]*Presence
-    VCardStack map[string]*IQ
-}
-type ChatWindow struct {
-    Window       fyne.Window
-    ChatContent  *fyne.Container
-    Handler      *XMPPHandler
-    Recipient    string
-}
-
-func (cw *ChatWindow) AddMessage(msg *Message) {
-    // Create a new label for the incoming message and add it to the chat content
-    messageLabel := widget.NewLabel(fmt.Sprintf("%s: %s", strings.Split(msg.From,"/")[0], msg.Body))
-    cw.ChatContent.Add(messageLabel)
-    
-    // Refresh the window to display the new message
-    cw.Window.Content().Refresh()
+    JID      jid.JID // full JID bound to the session
+    Limits   Limits // what the stanza reader accepts; zero fields use DefaultLimits
+    state      sessionState
+    pendingIQs map[string]pendingIQ
+    pendingMu  sync.Mutex
+    lastID     uint64
+    subs       subscribers
+    chain      interceptors
+    roster     *Roster
+    rosterOnce sync.Once
+    inbox      subscriptionInbox
+    vis        visibility
+    history    presenceHistory
+    features   features
+    pep        pepState
+    chats      chatHistory
+    archive    archiveState
 }
 
 func NewXMPPHandler(domain, port, username, password string) (*XMPPHandler, error) {
@@ -43,11 +40,7 @@ func NewXMPPHandler(domain, port, username, password string) (*XMPPHandler, erro
         Server:   domain +":"+port,
         Username: username,
         Password: password,
-        ChatWindows: make(map[string]*ChatWindow),
-        MessageChan:  make(chan *Message, 100),
-        MessageQueue: make(map[string][]*Message),
-        PresenceStack: make(map[string]*Presence),
-        VCardStack: map[string]*IQ{},
+        pendingIQs: make(map[string]pendingIQ),
     }
 
     conn, err := NewXMPPConnection(domain, port, false)
@@ -66,209 +59,290 @@ func NewXMPPHandler(domain, port, username, password string) (*XMPPHandler, erro
     }
 
     // Bind Resource
-    if err := BindResource(handler.Conn); err != nil {
+    bound, err := BindResource(handler.Conn)
+    if err != nil {
         return nil, err
     }
+    handler.JID = bound
 
     return handler, nil
 }
 
 
-// SendPresence sends a presence stanza to update the user's availability status.
-func (h *XMPPHandler) SendPresence(presenceType, status string) error {
-    presence := fmt.Sprintf(
-        `<presence><show>%s</show><status>%s</status></presence>`,
-        presenceType, status,
-    )
-    _, err := h.Conn.Conn.Write([]byte(presence))
+// SendStanza marshals a stanza and writes it to the server. Every outbound
+// stanza goes through here, so text and attribute values are always escaped.
+// The outbound interceptors run first and may change or drop the stanza.
+func (h *XMPPHandler) SendStanza(stanza Stanza) error {
+    stanza, err := h.intercept(Outbound, stanza)
+    if err != nil {
+        return fmt.Errorf("outbound stanza dropped: %w", err)
+    }
+    if stanza == nil {
+        return nil
+    }
+    return sendStanza(h.Conn, stanza)
+}
+
+// SendPresence validates and sends a presence stanza. A presence without a
+// recipient is broadcast to the contacts and becomes our own presence; one
+// with a recipient is directed presence, remembered until it is ended.
+func (h *XMPPHandler) SendPresence(presence *Presence) error {
+    if err := presence.Validate(); err != nil {
+        return err
+    }
+    if presence.IsAvailable() {
+        // Every available presence tells our features, PEP interests included.
+        presence = presence.clone()
+        if err := presence.Extensions.Add(h.Caps()); err != nil {
+            return err
+        }
+    }
+    directed := !presence.To.IsZero() && (presence.IsAvailable() || presence.IsUnavailable())
+    if directed && presence.IsAvailable() {
+        if err := h.allowDirected(presence.To); err != nil {
+            return fmt.Errorf("failed to let the presence through: %w", err)
+        }
+    }
+    err := h.SendStanza(presence)
     if err != nil {
-        log.Printf("Failed to send presence: %v", err)
+        Logger("presence").Error("failed to send presence", "err", err)
         return err
     }
-    log.Println("Presence sent successfully")
+    switch {
+    case directed:
+        h.trackDirected(presence)
+    case presence.To.IsZero() && (presence.IsAvailable() || presence.IsUnavailable()):
+        h.state.mu.Lock()
+        h.state.own = presence.clone()
+        h.state.mu.Unlock()
+    }
+    Logger("presence").Debug("presence sent", "type", presence.Type, "show", presence.Show, "priority", presence.Priority, "status", presence.Status)
     return nil
 }
 
-// SendMessage sends a message stanza to the specified recipient.
-func (h *XMPPHandler) SendMessage(to, message string) error {
-    msg := fmt.Sprintf(
-        `<message to='%s' type='chat'><body>%s</body></message>`,
-        to, message,
-    )
-    _, err := h.Conn.Conn.Write([]byte(msg))
+// SetAvailability broadcasts an available presence with the given show,
+// status and priority, and optionally extension payloads such as caps.
+func (h *XMPPHandler) SetAvailability(show Show, status string, priority int, payloads ...interface{}) error {
+    presence := NewPresence(jid.JID{}, "", show, status, priority)
+    for _, payload := range payloads {
+        if err := presence.Extensions.Add(payload); err != nil {
+            return err
+        }
+    }
+    return h.SendPresence(presence)
+}
+
+// OwnPresence returns a copy of the last presence we broadcast.
+func (h *XMPPHandler) OwnPresence() (*Presence, bool) {
+    h.state.mu.RLock()
+    defer h.state.mu.RUnlock()
+    if h.state.own == nil {
+        return nil, false
+    }
+    return h.state.own.clone(), true
+}
+
+// SendMessage sends a chat message to the specified recipient, asking for
+// a delivery receipt (XEP-0184). The message is recorded in the history and
+// reported to the subscribers as a sent MessageEvent.
+func (h *XMPPHandler) SendMessage(to jid.JID, message string) error {
+    msg := NewMessage(to, "chat", message)
+    msg.ID = newMessageID()
+    if err := msg.Extensions.Add(ReceiptRequest{}); err != nil {
+        return err
+    }
+    err := h.SendStanza(msg)
     if err != nil {
-        log.Printf("Failed to send message: %v", err)
+        Logger("message").Error("failed to send message", "to", to, "err", err)
+        h.recordMessage(msg, Outbound, MessageFailed)
         return err
     }
-    log.Println("Message sent successfully")
+    Logger("message").Debug("message sent", "to", to, "body", Secret(message))
+    h.recordMessage(msg, Outbound, MessageSent)
+    h.emit(&MessageEvent{Message: msg, Sent: true})
     return nil
 }
 
+// HandleIncomingStanzas reads and dispatches stanzas until the stream ends.
+// Input that breaks h.Limits or isn't the restricted XML that XMPP allows is
+// answered with a <stream:error/> before closing the connection. A stream
+// error from the server is returned as a *StreamError.
 func (h *XMPPHandler) HandleIncomingStanzas() error {
-	decoder := xml.NewDecoder(h.Conn.Conn)
+	reader := newStanzaReader(h.Conn.Conn, h.Limits)
 
 	for {
-		tok, err := decoder.Token()
+		stanza, err := reader.Next()
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) {
+			Logger("session").Error("closing the stream", "condition", streamErr.Condition, "text", streamErr.Text)
+			h.closeStream(streamErr)
+			return err
+		}
 		if err != nil {
-			log.Printf("Failed to read stanza: %v", err)
+			Logger("session").Error("failed to read stanza", "err", err)
 			return err
 		}
-        
-		switch se := tok.(type) {
-		case xml.StartElement:
-			switch se.Name.Local {
-			case "message":
-				var msg Message
-                if err := decoder.DecodeElement(&msg, &se); err != nil {
-                    log.Printf("Failed to parse message: %v", err)
-                    continue
-                }
-                h.DispatchMessage(&msg)
-
-			case "presence":
-				var pres Presence
-				if err := decoder.DecodeElement(&pres, &se); err != nil {
-					log.Printf("Failed to parse presence: %v", err)
-					continue
-				}
-				h.handlePresence(&pres)
-
-			case "iq":
-				var iq IQ
-                log.Printf("Obtained IQ: %s", se)
-				if err := decoder.DecodeElement(&iq, &se); err != nil {
-					log.Printf("Failed to parse IQ: %v", err)
-					continue
-				}
-                h.handleIQ(&iq)
-                
-				
-
-			default:
-				log.Printf("Unhandled stanza type: %s", se.Name.Local)
+
+		if raw, ok := stanza.(*RawStanza); ok && raw.Name.Space == nsStream && raw.Name.Local == "error" {
+			streamErr = &StreamError{}
+			if err := xml.Unmarshal(raw.Data, streamErr); err != nil {
+				streamErr.Condition = "undefined-condition"
 			}
+			Logger("session").Error("the server closed the stream", "condition", streamErr.Condition, "text", streamErr.Text)
+			h.closeStream(nil)
+			return streamErr
 		}
+		h.Inject(stanza)
+	}
+}
+
+// closeStream sends streamErr, if any, closes our end of the stream and the
+// connection.
+func (h *XMPPHandler) closeStream(streamErr *StreamError) {
+	if streamErr != nil {
+		if data, err := streamErr.ToXML(); err == nil {
+			h.Conn.Conn.Write([]byte(data))
+		}
+	}
+	h.Conn.CloseStream()
+	h.Conn.Close()
+}
+
+// dispatchStanza hands a decoded stanza to the handler for its type.
+func (h *XMPPHandler) dispatchStanza(stanza Stanza) {
+	switch s := stanza.(type) {
+	case *Message:
+		h.handleMessage(s)
+	case *Presence:
+		h.handlePresence(s)
+	case *IQ:
+		Logger("iq").Debug("received IQ", "type", s.Type, "id", s.ID, "from", s.From)
+		h.handleIQ(s)
+	case *RawStanza:
+		Logger("session").Debug("unhandled stanza", "element", s.Name.Local)
 	}
 }
 
 func (h *XMPPHandler) handlePresence(pres *Presence) {
-	jid := strings.Split(pres.From, "/")[0]
-    log.Printf("Presence from %s: %s|%s|%s", jid, pres.Status, pres.Show, pres.Type)
+	from := pres.From.Bare()
+    Logger("presence").Debug("received presence", "from", from, "type", pres.Type, "show", pres.Show, "status", pres.Status)
 
     switch pres.Type{
-    case "subscribe":
-        fyne.CurrentApp().SendNotification(&fyne.Notification{
-            Title:   "Subscription Request",
-            Content: fmt.Sprintf("%s wants to subscribe to your presence", pres.From),
-        })
-        h.PromptSubscriptionRequest(pres.From)
-    
-    case "subscribed":
-        // Your subscription request was accepted
-        fyne.CurrentApp().SendNotification(&fyne.Notification{
-            Title:   "Subscription Accepted",
-            Content: fmt.Sprintf("%s accepted your subscription request", pres.From),
-        })
-    case "unsubscribe":
-        // Someone wants to unsubscribe from your presence
-        fyne.CurrentApp().SendNotification(&fyne.Notification{
-            Title:   "Unsubscription Request",
-            Content: fmt.Sprintf("%s wants to unsubscribe from your presence", pres.From),
-        })
-    case "unsubscribed":
-        // Your subscription request was rejected or someone unsubscribed
-        fyne.CurrentApp().SendNotification(&fyne.Notification{
-            Title:   "Subscription Rejected",
-            Content: fmt.Sprintf("%s has rejected your subscription or unsubscribed", pres.From),
-        })
+    case "subscribe", "subscribed", "unsubscribe", "unsubscribed":
+        if h.handleSubscription(pres) {
+            h.emit(&SubscriptionEvent{From: from, Type: pres.Type, Status: pres.Status})
+        }
     default:
         if pres.Type != "error"{
-            h.PresenceStack[jid] = pres
+            h.storePresence(pres)
+            h.recordPresence(pres)
+            h.emit(&PresenceEvent{Presence: pres})
         }
     }
 }
 
-func (h *XMPPHandler) PromptSubscriptionRequest(from string) {
-    confirmDialog := dialog.NewConfirm("Subscription Request", fmt.Sprintf("%s wants to subscribe to your presence. Do you accept?", from), func(confirm bool) {
-        if confirm {
-            // Send 'subscribed' presence to accept the subscription
-            presence := NewPresence(from, "subscribed", "", "", 0)
-            presenceXML, err := presence.ToXML()
-            if err != nil {
-                log.Printf("Failed to marshal subscription acceptance: %v", err)
-                return
-            }
-            _, err = h.Conn.Conn.Write([]byte(presenceXML))
-            if err != nil {
-                log.Printf("Failed to send subscription acceptance: %v", err)
-            } else {
-                log.Printf("Subscription accepted for %s", from)
-            }
-        } else {
-            // Send 'unsubscribed' presence to reject the subscription
-            presence := NewPresence(from, "unsubscribed", "", "", 0)
-            presenceXML, err := presence.ToXML()
-            if err != nil {
-                log.Printf("Failed to marshal subscription rejection: %v", err)
-                return
-            }
-            _, err = h.Conn.Conn.Write([]byte(presenceXML))
-            if err != nil {
-                log.Printf("Failed to send subscription rejection: %v", err)
-            } else {
-                log.Printf("Subscription rejected for %s", from)
-            }
-        }
-    }, fyne.CurrentApp().Driver().AllWindows()[0]) // Assuming you want to show the dialog on the main window
-
-    confirmDialog.SetDismissText("Ignore")
-    confirmDialog.Show()
-}
-
-
 func (h *XMPPHandler) handleIQ(iq *IQ) {
     // Check if the IQ has a known type but no specific query body
     if iq.Type == "get" || iq.Type == "set" {
-        // Handle specific IQ requests, like version or ping
-        if iq.Query == nil {
-            log.Printf("Received IQ request without specific query from %s", iq.From)
-
-            // Determine the response type based on common XMPP queries
-            switch iq.ID {
-            // Add cases for known IQ requests based on the ID or other attributes
-            default:
-                // If we don't recognize the specific IQ request, we can send a basic result
-                h.sendIQResult(iq)
-            }
-        } else {
-            // If there's a query body, handle it accordingly
-            switch query := iq.Query.(type) {
-            case struct{ XMLName xml.Name }:
-                switch query.XMLName.Space {
-                case "jabber:iq:version":
-                    h.handleVersionQuery(iq)
-                // case "jabber:iq:roster":
-                //     h.handleRosterQuery(iq)
-                default:
-                    log.Printf("Unhandled IQ namespace: %s", query.XMLName.Space)
-                }
-            default:
-                log.Printf("Unhandled type in IQ query: %T", iq.Query)
-            }
+        // Handle specific IQ requests, like version or roster pushes
+        switch space := iq.PayloadName().Space; {
+        case space == "jabber:iq:version" && iq.Type == "get":
+            h.handleVersionQuery(iq)
+        case space == nsRoster && iq.Type == "set":
+            h.handleRosterPush(iq)
+        case space == nsDiscoInfo && iq.Type == "get":
+            h.handleDiscoInfo(iq)
+        default:
+            Logger("iq").Debug("unhandled IQ request", "namespace", space, "from", iq.From)
+            // If we don't recognize the specific IQ request, we can send a basic result
+            h.sendIQResult(iq)
         }
+    } else if (iq.Type == "result" || iq.Type == "error") && h.resolvePendingIQ(iq) {
+        return
     } else if iq.Type == "result"{
-        log.Printf("Received result IQ from %s: %s|%s|%s", iq.From, iq.To, iq.Type, iq.Query)
+        Logger("iq").Debug("received IQ result", "from", iq.From, "id", iq.ID)
         switch iq.ID  {
         case "v1":
-            h.VCardStack[iq.From] = iq
+            h.storeVCard(iq)
         
         default: 
-        log.Printf("Unhandled type in IQ ID: %T", iq.ID)
+        Logger("iq").Debug("unhandled IQ result", "id", iq.ID)
         }
         
     }
 }
 
+// iqTimeout is how long SendIQ waits for the answer to a request.
+const iqTimeout = 15 * time.Second
+
+// NextID returns a fresh stanza ID for this session.
+func (h *XMPPHandler) NextID() string {
+    return fmt.Sprintf("iq%d", atomic.AddUint64(&h.lastID, 1))
+}
+
+// SendIQ sends a get or set IQ and waits for the matching result or error.
+// The stanza reader must be running for the answer to arrive, unless an
+// outbound interceptor answers it through Inject. An error response is
+// returned as the IQ itself, with its Error field set.
+func (h *XMPPHandler) SendIQ(iq *IQ) (*IQ, error) {
+    if iq.ID == "" {
+        iq.ID = h.NextID()
+    }
+    answer := make(chan *IQ, 1)
+
+    h.pendingMu.Lock()
+    if h.pendingIQs == nil {
+        h.pendingIQs = make(map[string]pendingIQ)
+    }
+    h.pendingIQs[iq.ID] = pendingIQ{to: iq.To, answer: answer}
+    h.pendingMu.Unlock()
+
+    defer func() {
+        h.pendingMu.Lock()
+        delete(h.pendingIQs, iq.ID)
+        h.pendingMu.Unlock()
+    }()
+
+    if err := h.SendStanza(iq); err != nil {
+        return nil, fmt.Errorf("failed to send IQ %s: %v", iq.ID, err)
+    }
+
+    select {
+    case response := <-answer:
+        return response, nil
+    case <-time.After(iqTimeout):
+        return nil, errors.New("timed out waiting for IQ response")
+    }
+}
+
+// pendingIQ is a request sent with SendIQ that waits for its answer.
+type pendingIQ struct {
+    to     jid.JID
+    answer chan *IQ
+}
+
+// resolvePendingIQ hands a result or error to the SendIQ call waiting for it.
+// An answer with the ID of a pending request but from another entity is
+// dropped, so that nobody else can answer our requests.
+func (h *XMPPHandler) resolvePendingIQ(iq *IQ) bool {
+    h.pendingMu.Lock()
+    pending, ok := h.pendingIQs[iq.ID]
+    h.pendingMu.Unlock()
+    if !ok {
+        return false
+    }
+    if !h.validResponse(pending.to, iq.From) {
+        Logger("iq").Warn("dropping IQ response from an unexpected sender", "id", iq.ID, "from", iq.From, "to", pending.to)
+        return true
+    }
+    select {
+    case pending.answer <- iq:
+    default:
+        // A duplicate answer for the same ID; the first one already won.
+    }
+    return true
+}
+
 func (h *XMPPHandler) sendIQResult(iq *IQ) {
     response := IQ{
         XMLName: xml.Name{Local: "iq"},
@@ -277,38 +351,54 @@ func (h *XMPPHandler) sendIQResult(iq *IQ) {
         To:      iq.From,
     }
 
-    // Convert to XML and send the response
-    xmlResponse, err := response.ToXML()
+    err := h.SendStanza(&response)
     if err != nil {
-        log.Printf("Failed to marshal IQ response: %v", err)
-        return
+        Logger("iq").Error("failed to send IQ response", "to", iq.From, "err", err)
+    } else {
+        Logger("iq").Debug("sent IQ response", "to", iq.From, "id", iq.ID)
     }
+}
 
-    _, err = h.Conn.Conn.Write([]byte(xmlResponse))
-    if err != nil {
-        log.Printf("Failed to send IQ response: %v", err)
-    } else {
-        log.Printf("Sent IQ response to %s", iq.From)
+// handleRosterPush acknowledges a roster change pushed by the server and
+// tells the subscribers about it.
+func (h *XMPPHandler) handleRosterPush(iq *IQ) {
+    if !h.validRosterPush(iq.From) {
+        Logger("roster").Warn("dropping roster push from an unexpected sender", "from", iq.From)
+        return
+    }
+    var push RosterQuery
+    if err := iq.DecodePayload(&push); err != nil {
+        Logger("roster").Warn("failed to parse roster push", "err", err)
+        return
     }
+    h.sendIQResult(iq)
+    items := h.Roster().apply(push)
+    for _, item := range items {
+        // Answered from another client, or the contact is gone.
+        switch item.Subscription {
+        case "from", "both", "remove":
+            h.answered(item.JID)
+        }
+    }
+    h.emit(&RosterEvent{Items: items})
 }
 
 func (h *XMPPHandler) handleVersionQuery(iq *IQ) {
-    log.Printf("Received version query from %s", iq.From)
-
-    response := fmt.Sprintf(
-        `<iq type='result' id='%s' to='%s'>
-            <query xmlns='jabber:iq:version'>
-                <name>XMPP Client</name>
-                <version>1.0</version>
-                <os>Go</os>
-            </query>
-        </iq>`, iq.ID, iq.From)
-
-    _, err := h.Conn.Conn.Write([]byte(response))
+    Logger("iq").Debug("received version query", "from", iq.From)
+
+    response := NewIQ("result", iq.ID)
+    response.To = iq.From
+    response.SetQuery(&VersionQuery{
+        Name:    "XMPP Client",
+        Version: "1.0",
+        OS:      "Go",
+    })
+
+    err := h.SendStanza(response)
     if err != nil {
-        log.Printf("Failed to send IQ response: %v", err)
+        Logger("iq").Error("failed to send IQ response", "to", iq.From, "err", err)
     } else {
-        log.Printf("Sent IQ response to %s", iq.From)
+        Logger("iq").Debug("sent IQ response", "to", iq.From, "id", iq.ID)
     }
 }
 
@@ -324,24 +414,19 @@ func (h *XMPPHandler) RequestOfflineMessages() error {
         },
     }
 
-    iqXML, err := xml.Marshal(iq)
-    if err != nil {
-        return fmt.Errorf("failed to marshal offline message request: %v", err)
-    }
-
-    _, err = h.Conn.Conn.Write(iqXML)
+    err := h.SendStanza(&iq)
     if err != nil {
         return fmt.Errorf("failed to send offline message request: %v", err)
     }
 
-    log.Println("Offline message request sent successfully")
+    Logger("message").Debug("offline message request sent")
     return nil
 }
 
 
 // WaitForShutdown keeps the connection alive until shutdown is requested.
 func (h *XMPPHandler) WaitForShutdown() {
-    log.Println("Waiting for shutdown signal...")
+    Logger("session").Info("waiting for shutdown signal")
     // Implementation could wait on a signal or just block until interrupted
     select {}
 }
@@ -349,7 +434,7 @@ func (h *XMPPHandler) WaitForShutdown() {
 
 func (h *XMPPHandler) LoginAndFetchMessages(status string) error {
     // Send presence to indicate the client is online
-    if err := h.SendPresence("presence",status); err != nil {
+    if err := h.SetAvailability(ShowAvailable, status, 0); err != nil {
         return err
     }
 
@@ -359,58 +444,76 @@ func (h *XMPPHandler) LoginAndFetchMessages(status string) error {
     }
 
     // Start listening for incoming messages
-    go func() {
-        if err := h.HandleIncomingStanzas(); err != nil {
-            log.Printf("Error handling incoming stanzas: %v", err)
-        }
-    }()
+    h.startReader()
 
-    return nil
+    return h.Roster().Fetch()
 }
 
 
+// ListenForIncomingStanzas starts the stanza reader, loads the roster and
+// then sends the initial presence, as RFC 6121 recommends. It blocks until the
+// roster arrives or the request times out.
 func (h *XMPPHandler) ListenForIncomingStanzas() {
-    h.SendPresence("presence", "Online")
+    h.startReader()
+    if err := h.Roster().Fetch(); err != nil {
+        Logger("roster").Error("failed to load the roster", "err", err)
+    }
+    if err := h.SetAvailability(ShowAvailable, "Online", 0); err != nil {
+        Logger("presence").Error("failed to send the initial presence", "err", err)
+        return
+    }
+    h.emit(&ConnectionStateEvent{State: StateOnline})
+}
+
+// startReader runs the stanza reader in the background. A ConnectionStateEvent
+// is emitted when it starts and when the stream is lost. Each time it starts,
+// the history catches up with the messages the server archived meanwhile.
+func (h *XMPPHandler) startReader() {
+    h.emit(&ConnectionStateEvent{State: StateConnected})
+    // The sync runs from before the first message is read, so that messages
+    // read before CatchUp asks the archive are checked against it.
+    synced := h.startSync()
+    go func() {
+        err := h.HandleIncomingStanzas()
+        Logger("session").Error("stanza reader stopped", "err", err)
+        h.emit(&ConnectionStateEvent{State: StateDisconnected, Err: err})
+    }()
     go func() {
-        for {
-            err := h.HandleIncomingStanzas()
-            if err != nil {
-                log.Printf("Error handling stanzas: %v", err)
-                continue
-            }
+        defer synced()
+        if err := h.CatchUp(); err != nil {
+            Logger("history").Info("not synced with the server archive", "err", err)
         }
     }()
 }
 
-func (h *XMPPHandler) DispatchMessage(msg *Message) {
-    recipient := strings.Split(msg.From, "/")[0]
-
-    if chatWindow, ok := h.ChatWindows[recipient]; ok && chatWindow != nil {
-        chatWindow.AddMessage(msg)
-        fyne.CurrentApp().SendNotification(&fyne.Notification{
-            Title:   "New Message",
-            Content: fmt.Sprintf("%s: %s", recipient, msg.Body),
-        })
+// handleMessage dispatches an incoming message. Carbons are unwrapped, but
+// only when they come from our bare JID; anybody else could use them to
+// forge messages.
+func (h *XMPPHandler) handleMessage(msg *Message) {
+    if h.handlePEPEvent(msg) || h.handleArchiveResult(msg) {
+        return
+    }
+    inner, sent, ok := carbonOf(msg)
+    if !ok {
+        h.DispatchMessage(msg)
+        return
+    }
+    if !h.validCarbon(msg.From) {
+        Logger("message").Warn("dropping forwarded message from an unexpected sender", "from", msg.From)
+        return
+    }
+    if sent {
+        h.recordMessage(inner, Outbound, MessageSent)
     } else {
-        if len(msg.Body) > 0 {
-            log.Printf("No chat window open for %s, queueing message", recipient)
-            h.MessageQueue[recipient] = append(h.MessageQueue[recipient], msg)
-            
-            // Send notification for each queued message
-            fyne.CurrentApp().SendNotification(&fyne.Notification{
-                Title:   "New Message",
-                Content: fmt.Sprintf("%s: %s", recipient, msg.Body),
-            })
-        }
+        h.recordMessage(inner, Inbound, MessageReceived)
     }
+    h.emit(&MessageEvent{Message: inner, Sent: sent})
 }
 
-
-
-
-
-
-
-
-
-
+// DispatchMessage records an incoming message in the history and hands it
+// to the subscribers.
+func (h *XMPPHandler) DispatchMessage(msg *Message) {
+    h.handleReceipts(msg)
+    h.recordMessage(msg, Inbound, MessageReceived)
+    h.emit(&MessageEvent{Message: msg})
+}
@@ -0,0 +1,127 @@
+package xmpp
+
+import (
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/xml"
+    "sort"
+    "strings"
+    "sync"
+)
+
+const (
+    nsDiscoInfo = "http://jabber.org/protocol/disco#info"
+    nsCaps      = "http://jabber.org/protocol/caps"
+
+    // capsNode identifies this client in the caps we send (XEP-0115).
+    capsNode = "https://github.com/adrianfulla/Proyecto1-Redes"
+)
+
+// DiscoInfo is the service discovery information payload of XEP-0030.
+type DiscoInfo struct {
+    XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+    Node       string          `xml:"node,attr,omitempty"`
+    Identities []DiscoIdentity `xml:"identity"`
+    Features   []DiscoFeature  `xml:"feature"`
+}
+
+// DiscoIdentity is an identity of an entity, such as client/pc.
+type DiscoIdentity struct {
+    Category string `xml:"category,attr"`
+    Type     string `xml:"type,attr"`
+    Name     string `xml:"name,attr,omitempty"`
+    Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+}
+
+// DiscoFeature is a protocol an entity supports.
+type DiscoFeature struct {
+    Var string `xml:"var,attr"`
+}
+
+// Caps advertises our features in presence (XEP-0115), so that contacts and
+// the server learn them without asking each time.
+type Caps struct {
+    XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+    Hash    string   `xml:"hash,attr"`
+    Node    string   `xml:"node,attr"`
+    Ver     string   `xml:"ver,attr"`
+}
+
+func init() {
+    RegisterExtension(nsCaps, "c", Caps{})
+}
+
+// clientIdentity is who we are in service discovery.
+var clientIdentity = DiscoIdentity{Category: "client", Type: "pc", Name: "XMPP Client"}
+
+// baseFeatures are the protocols the handler always answers.
+var baseFeatures = []string{nsDiscoInfo, nsCaps, "jabber:iq:version", nsReceipts, nsIdle}
+
+// features is what the session advertises on top of baseFeatures.
+type features struct {
+    mu     sync.Mutex
+    notify map[string]bool // PEP nodes we want notifications for
+}
+
+// Features returns the features the session advertises, sorted.
+func (h *XMPPHandler) Features() []string {
+    list := append([]string(nil), baseFeatures...)
+    h.features.mu.Lock()
+    for node := range h.features.notify {
+        list = append(list, node+"+notify")
+    }
+    h.features.mu.Unlock()
+    sort.Strings(list)
+    return list
+}
+
+// Caps returns the caps element for the features the session advertises.
+func (h *XMPPHandler) Caps() Caps {
+    return Caps{Hash: "sha-1", Node: capsNode, Ver: capsVer([]DiscoIdentity{clientIdentity}, h.Features())}
+}
+
+// capsVer computes the verification string of XEP-0115 §5.1.
+func capsVer(identities []DiscoIdentity, features []string) string {
+    names := make([]string, len(identities))
+    for i, id := range identities {
+        names[i] = id.Category + "/" + id.Type + "/" + id.Lang + "/" + id.Name
+    }
+    sort.Strings(names)
+    sorted := append([]string(nil), features...)
+    sort.Strings(sorted)
+
+    var s strings.Builder
+    for _, name := range names {
+        s.WriteString(name + "<")
+    }
+    for _, feature := range sorted {
+        s.WriteString(feature + "<")
+    }
+    sum := sha1.Sum([]byte(s.String()))
+    return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// handleDiscoInfo answers a disco#info request with our identity and
+// features, for the caps node as well as for no node.
+func (h *XMPPHandler) handleDiscoInfo(iq *IQ) {
+    var query DiscoInfo
+    iq.DecodePayload(&query)
+
+    caps := h.Caps()
+    response := NewIQ("result", iq.ID)
+    response.To = iq.From
+    if query.Node != "" && query.Node != caps.Node+"#"+caps.Ver {
+        response.Type = "error"
+        response.Error = &StanzaError{Type: "cancel", Condition: "item-not-found"}
+    } else {
+        info := &DiscoInfo{Node: query.Node, Identities: []DiscoIdentity{clientIdentity}}
+        for _, feature := range h.Features() {
+            info.Features = append(info.Features, DiscoFeature{Var: feature})
+        }
+        response.SetQuery(info)
+    }
+
+    if err := h.SendStanza(response); err != nil {
+        Logger("iq").Error("failed to send IQ response", "to", iq.From, "err", err)
+    }
+}
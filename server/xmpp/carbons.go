@@ -0,0 +1,50 @@
+package xmpp
+
+import (
+    "encoding/xml"
+)
+
+const (
+    nsCarbons = "urn:xmpp:carbons:2"
+    nsForward = "urn:xmpp:forward:0"
+)
+
+// Forwarded is the XEP-0297 <forwarded/> wrapper around a stanza, with when
+// it was first sent, if known.
+type Forwarded struct {
+    XMLName xml.Name `xml:"urn:xmpp:forward:0 forwarded"`
+    Delay   *Delay   `xml:"urn:xmpp:delay delay"`
+    Message *Message `xml:"message"`
+}
+
+// CarbonReceived is a XEP-0280 copy of a message another of our clients received.
+type CarbonReceived struct {
+    XMLName   xml.Name  `xml:"urn:xmpp:carbons:2 received"`
+    Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// CarbonSent is a XEP-0280 copy of a message another of our clients sent.
+type CarbonSent struct {
+    XMLName   xml.Name  `xml:"urn:xmpp:carbons:2 sent"`
+    Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+func init() {
+    RegisterExtension(nsForward, "forwarded", Forwarded{})
+    RegisterExtension(nsCarbons, "received", CarbonReceived{})
+    RegisterExtension(nsCarbons, "sent", CarbonSent{})
+}
+
+// carbonOf returns the message copied in a carbon, and whether we sent it.
+// ok is false if msg is not a carbon.
+func carbonOf(msg *Message) (inner *Message, sent bool, ok bool) {
+    var received CarbonReceived
+    if found, err := msg.Extensions.Get(&received); found && err == nil {
+        return received.Forwarded.Message, false, received.Forwarded.Message != nil
+    }
+    var copied CarbonSent
+    if found, err := msg.Extensions.Get(&copied); found && err == nil {
+        return copied.Forwarded.Message, true, copied.Forwarded.Message != nil
+    }
+    return nil, false, false
+}
@@ -1,11 +1,12 @@
 package xmpp
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/xml"
 	"net"
 	"time"
 	"fmt"
-	"log"
 	"errors"
 	"strings"
 )
@@ -13,6 +14,23 @@ import (
 type XMPPConnection struct {
     Conn net.Conn
 	Domain string
+    RosterVer bool // the server advertised roster versioning (RFC 6121 §2.6.1)
+    dec *xml.Decoder
+}
+
+// noteFeatures records the stream features we use from data read during
+// login. Data cut off in the middle of an element is read up to there.
+func (xc *XMPPConnection) noteFeatures(data []byte) {
+    decoder := xml.NewDecoder(bytes.NewReader(data))
+    for {
+        tok, err := decoder.Token()
+        if err != nil {
+            return
+        }
+        if se, ok := tok.(xml.StartElement); ok && se.Name.Space == nsRosterVer && se.Name.Local == "ver" {
+            xc.RosterVer = true
+        }
+    }
 }
 
 func NewXMPPConnection(domain string,port string, useTLS bool) (*XMPPConnection, error) {
@@ -51,6 +69,57 @@ func (xc *XMPPConnection) Close() error {
     return xc.Conn.Close()
 }
 
+// decoder returns the XML decoder reading the connection, creating it on first use.
+func (xc *XMPPConnection) decoder() *xml.Decoder {
+    if xc.dec == nil {
+        xc.dec = xml.NewDecoder(xc.Conn)
+    }
+    return xc.dec
+}
+
+// readIQ reads the stream until the IQ with the given ID arrives and decodes it into v.
+// Stream features and unrelated stanzas are skipped. It is meant for the
+// pre-login exchanges (such as registration) that run before the stanza reader starts.
+func (xc *XMPPConnection) readIQ(id string, v interface{}) error {
+    dec := xc.decoder()
+    for {
+        tok, err := dec.Token()
+        if err != nil {
+            return err
+        }
+        se, ok := tok.(xml.StartElement)
+        if !ok {
+            continue
+        }
+        switch {
+        case se.Name.Local == "stream":
+            // The stream header stays open for the whole session.
+            continue
+        case se.Name.Local == "iq" && attrValue(se, "id") == id:
+            return dec.DecodeElement(v, &se)
+        case se.Name.Local == "error" && se.Name.Space == nsStream:
+            var streamErr StreamError
+            if err := dec.DecodeElement(&streamErr, &se); err != nil {
+                return err
+            }
+            return &streamErr
+        }
+        if err := dec.Skip(); err != nil {
+            return err
+        }
+    }
+}
+
+// attrValue returns the value of the named attribute of an element, or "".
+func attrValue(se xml.StartElement, name string) string {
+    for _, attr := range se.Attr {
+        if attr.Name.Local == name {
+            return attr.Value
+        }
+    }
+    return ""
+}
+
 
 // StartTLS sends the STARTTLS command to the server and upgrades the connection to TLS.
 func StartTLS(conn *XMPPConnection) error {
@@ -66,10 +135,10 @@ func StartTLS(conn *XMPPConnection) error {
     }
 
     response := string(buffer[:n])
-    log.Printf("Received STARTTLS response: %s\n", response)
+    Logger("conn").Debug("received STARTTLS response", "xml", WireXML(response))
 
     if strings.Contains(response, "<proceed") {
-        log.Println("Proceeding with TLS handshake...")
+        Logger("conn").Debug("proceeding with TLS handshake")
         tlsConn := tls.Client(conn.Conn, &tls.Config{
             InsecureSkipVerify: true, // Disable verification for testing, not recommended for production
         })
@@ -77,7 +146,7 @@ func StartTLS(conn *XMPPConnection) error {
         if err := tlsConn.Handshake(); err != nil {
             return fmt.Errorf("TLS handshake failed: %v", err)
         }
-        log.Println("TLS handshake successful")
+        Logger("conn").Info("TLS handshake successful")
         return nil
     }
 
@@ -86,14 +155,13 @@ func StartTLS(conn *XMPPConnection) error {
 
 // sendStanza sends a stanza over the XMPP connection and logs it.
 func sendStanza(conn *XMPPConnection, stanza Stanza) error {
-    xml, err := stanza.ToXML()
+    data, err := stanza.ToXML()
     if err != nil {
         return fmt.Errorf("failed to marshal stanza to XML: %v", err)
     }
-    
-    // Log the outgoing XML
-    log.Printf("Sending XML: %s", xml)
 
-    _, err = conn.Conn.Write([]byte(xml))
+    Logger("conn").Debug("sending stanza", "xml", WireXML(data))
+
+    _, err = conn.Conn.Write([]byte(data))
     return err
 }
\ No newline at end of file
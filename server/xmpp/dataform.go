@@ -0,0 +1,124 @@
+package xmpp
+
+import (
+    "encoding/base64"
+    "encoding/xml"
+    "strings"
+)
+
+// DataForm represents an XEP-0004 data form (<x xmlns='jabber:x:data'/>).
+type DataForm struct {
+    XMLName      xml.Name    `xml:"jabber:x:data x"`
+    Type         string      `xml:"type,attr"` // "form", "submit", "cancel" or "result"
+    Title        string      `xml:"title,omitempty"`
+    Instructions []string    `xml:"instructions,omitempty"`
+    Fields       []FormField `xml:"field"`
+}
+
+// FormField is a single field of a data form.
+type FormField struct {
+    Var      string       `xml:"var,attr,omitempty"`
+    Type     string       `xml:"type,attr,omitempty"` // "text-single", "text-private", "boolean", "list-single", "fixed", "hidden", ...
+    Label    string       `xml:"label,attr,omitempty"`
+    Desc     string       `xml:"desc,omitempty"`
+    Required *struct{}    `xml:"required"`
+    Values   []string     `xml:"value"`
+    Options  []FormOption `xml:"option"`
+    Media    []FormMedia  `xml:"urn:xmpp:media-element media"`
+}
+
+// FormOption is one of the choices offered by a list field.
+type FormOption struct {
+    Label string `xml:"label,attr,omitempty"`
+    Value string `xml:"value"`
+}
+
+// FormMedia is an XEP-0221 media element, used for CAPTCHA images (XEP-0158).
+type FormMedia struct {
+    Height int        `xml:"height,attr,omitempty"`
+    Width  int        `xml:"width,attr,omitempty"`
+    URIs   []MediaURI `xml:"uri"`
+}
+
+// MediaURI points at the data of a media element, e.g. "cid:..." for Bits of Binary.
+type MediaURI struct {
+    Type  string `xml:"type,attr"`
+    Value string `xml:",chardata"`
+}
+
+// BoBData is an XEP-0231 Bits of Binary payload, referenced from forms by "cid:" URIs.
+type BoBData struct {
+    XMLName xml.Name `xml:"urn:xmpp:bob data"`
+    CID     string   `xml:"cid,attr"`
+    Type    string   `xml:"type,attr"`
+    MaxAge  int      `xml:"max-age,attr,omitempty"`
+    Data    string   `xml:",chardata"`
+}
+
+// Bytes decodes the base64 payload.
+func (b *BoBData) Bytes() ([]byte, error) {
+    return base64.StdEncoding.DecodeString(strings.TrimSpace(b.Data))
+}
+
+// IsRequired reports whether the form marks the field as required.
+func (f *FormField) IsRequired() bool {
+    return f.Required != nil
+}
+
+// Value returns the first value of the field, or "" if it has none.
+func (f *FormField) Value() string {
+    if len(f.Values) == 0 {
+        return ""
+    }
+    return f.Values[0]
+}
+
+// SetValue replaces the values of the field with a single value.
+func (f *FormField) SetValue(value string) {
+    f.Values = []string{value}
+}
+
+// Field returns the field with the given var, or nil if the form has none.
+func (df *DataForm) Field(name string) *FormField {
+    for i := range df.Fields {
+        if df.Fields[i].Var == name {
+            return &df.Fields[i]
+        }
+    }
+    return nil
+}
+
+// FormType returns the value of the hidden FORM_TYPE field.
+func (df *DataForm) FormType() string {
+    if f := df.Field("FORM_TYPE"); f != nil {
+        return f.Value()
+    }
+    return ""
+}
+
+// MissingFields returns the labels (or vars) of required fields that have no value.
+func (df *DataForm) MissingFields() []string {
+    var missing []string
+    for _, f := range df.Fields {
+        if f.IsRequired() && strings.TrimSpace(f.Value()) == "" {
+            name := f.Label
+            if name == "" {
+                name = f.Var
+            }
+            missing = append(missing, name)
+        }
+    }
+    return missing
+}
+
+// Submit builds the "submit" form to send back, carrying only vars and values.
+func (df *DataForm) Submit() *DataForm {
+    submit := &DataForm{Type: "submit"}
+    for _, f := range df.Fields {
+        if f.Var == "" || f.Type == "fixed" {
+            continue
+        }
+        submit.Fields = append(submit.Fields, FormField{Var: f.Var, Values: f.Values})
+    }
+    return submit
+}
@@ -0,0 +1,141 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "fmt"
+    "strings"
+)
+
+const nsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+// StanzaError represents the <error/> child of an error stanza (RFC 6120 §8.3).
+type StanzaError struct {
+    Type      string // "auth", "cancel", "continue", "modify" or "wait"
+    Condition string // defined condition, e.g. "conflict" or "not-authorized"
+    Text      string
+}
+
+// Error implements the error interface.
+func (e *StanzaError) Error() string {
+    if e.Text != "" {
+        return fmt.Sprintf("%s: %s", e.Condition, e.Text)
+    }
+    return e.Condition
+}
+
+// MarshalXML writes the error element with its defined condition and text,
+// as we send it in answer to a request we can't serve.
+func (e StanzaError) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+    start := xml.StartElement{
+        Name: xml.Name{Local: "error"},
+        Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: e.Type}},
+    }
+    condition := e.Condition
+    if condition == "" {
+        condition = "undefined-condition"
+    }
+    if err := enc.EncodeToken(start); err != nil {
+        return err
+    }
+    if err := enc.EncodeElement("", xml.StartElement{Name: xml.Name{Space: nsStanzas, Local: condition}}); err != nil {
+        return err
+    }
+    if e.Text != "" {
+        if err := enc.EncodeElement(e.Text, xml.StartElement{Name: xml.Name{Space: nsStanzas, Local: "text"}}); err != nil {
+            return err
+        }
+    }
+    return enc.EncodeToken(start.End())
+}
+
+// UnmarshalXML picks the defined condition and text out of the error element.
+func (e *StanzaError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var raw struct {
+        Type     string `xml:"type,attr"`
+        Children []struct {
+            XMLName xml.Name
+            Text    string `xml:",chardata"`
+        } `xml:",any"`
+    }
+    if err := d.DecodeElement(&raw, &start); err != nil {
+        return err
+    }
+    e.Type = raw.Type
+    for _, child := range raw.Children {
+        if child.XMLName.Space != nsStanzas {
+            continue
+        }
+        if child.XMLName.Local == "text" {
+            e.Text = child.Text
+        } else if e.Condition == "" {
+            e.Condition = child.XMLName.Local
+        }
+    }
+    if e.Condition == "" {
+        e.Condition = "undefined-condition"
+    }
+    return nil
+}
+
+const nsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+
+// StreamError is a <stream:error/> (RFC 6120 §4.9). It ends the stream, so it
+// is either received from the server right before it closes the connection,
+// or sent by us when the server's input can't be accepted.
+type StreamError struct {
+    Condition string // defined condition, e.g. "policy-violation" or "restricted-xml"
+    Text      string
+}
+
+// Error implements the error interface.
+func (e *StreamError) Error() string {
+    if e.Text != "" {
+        return fmt.Sprintf("stream error: %s: %s", e.Condition, e.Text)
+    }
+    return "stream error: " + e.Condition
+}
+
+// ToXML writes the <stream:error/> element. The stream prefix is declared on
+// the stream header, so the element is built by hand like the header itself.
+func (e *StreamError) ToXML() (string, error) {
+    var out strings.Builder
+    out.WriteString("<stream:error><")
+    out.WriteString(e.Condition)
+    out.WriteString(" xmlns='" + nsStreams + "'/>")
+    if e.Text != "" {
+        out.WriteString("<text xmlns='" + nsStreams + "'>")
+        if err := xml.EscapeText(&out, []byte(e.Text)); err != nil {
+            return "", err
+        }
+        out.WriteString("</text>")
+    }
+    out.WriteString("</stream:error>")
+    return out.String(), nil
+}
+
+// UnmarshalXML picks the defined condition and text out of the error element.
+func (e *StreamError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var raw struct {
+        Children []struct {
+            XMLName xml.Name
+            Text    string `xml:",chardata"`
+        } `xml:",any"`
+    }
+    if err := d.DecodeElement(&raw, &start); err != nil {
+        return err
+    }
+    for _, child := range raw.Children {
+        if child.XMLName.Space != nsStreams {
+            continue
+        }
+        if child.XMLName.Local == "text" {
+            e.Text = child.Text
+        } else if e.Condition == "" {
+            e.Condition = child.XMLName.Local
+        }
+    }
+    if e.Condition == "" {
+        e.Condition = "undefined-condition"
+    }
+    return nil
+}
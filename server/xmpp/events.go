@@ -0,0 +1,137 @@
+package xmpp
+
+import (
+    "sort"
+    "sync"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// Event is something that happened on the session. Subscribers switch on the
+// concrete type: *MessageEvent, *PresenceEvent, *SubscriptionEvent,
+// *RosterEvent, *PEPEvent, *DeliveryEvent, *ArchiveSyncEvent or
+// *ConnectionStateEvent.
+type Event interface {
+    isEvent()
+}
+
+// MessageEvent is emitted for every incoming message. Sent is set for the
+// messages we sent, from this client or, as XEP-0280 carbons, another one.
+type MessageEvent struct {
+    Message *Message
+    Sent    bool
+}
+
+// PresenceEvent is emitted when a contact's availability changes.
+type PresenceEvent struct {
+    Presence *Presence
+}
+
+// SubscriptionEvent is emitted for presence subscription stanzas.
+// Type is "subscribe", "subscribed", "unsubscribe" or "unsubscribed", and
+// Status the message that came with it. A subscribe event means a new entry
+// in PendingSubscriptions; repeated requests are not reported.
+type SubscriptionEvent struct {
+    From   jid.JID
+    Type   string
+    Status string
+}
+
+// RosterEvent is emitted when the roster changes. Items are the items that
+// changed, with subscription "remove" for deleted ones. Full is set when the
+// whole roster was loaded, Items then being all of it.
+type RosterEvent struct {
+    Items []RosterItem
+    Full  bool
+}
+
+// ConnectionState describes the state of the session.
+type ConnectionState int
+
+const (
+    StateDisconnected ConnectionState = iota
+    StateConnected
+    StateOnline // the initial presence was sent
+)
+
+func (s ConnectionState) String() string {
+    switch s {
+    case StateConnected:
+        return "connected"
+    case StateOnline:
+        return "online"
+    }
+    return "disconnected"
+}
+
+// ConnectionStateEvent is emitted when the stream starts, when the session
+// goes online and when the stream is lost. Err holds the reason of a disconnection, if any.
+type ConnectionStateEvent struct {
+    State ConnectionState
+    Err   error
+}
+
+func (*MessageEvent) isEvent()         {}
+func (*PresenceEvent) isEvent()        {}
+func (*SubscriptionEvent) isEvent()    {}
+func (*RosterEvent) isEvent()          {}
+func (*ConnectionStateEvent) isEvent() {}
+
+// Subscriber receives the events of a handler. HandleEvent is called from the
+// stanza reader goroutine, so it must not block for long.
+type Subscriber interface {
+    HandleEvent(ev Event)
+}
+
+// SubscriberFunc adapts a function to the Subscriber interface.
+type SubscriberFunc func(ev Event)
+
+// HandleEvent calls f(ev).
+func (f SubscriberFunc) HandleEvent(ev Event) {
+    f(ev)
+}
+
+// subscribers is the list of subscribers of a handler.
+type subscribers struct {
+    mu     sync.Mutex
+    nextID int
+    list   map[int]Subscriber
+}
+
+// Subscribe registers s to receive every event of the handler. The returned
+// function removes the subscription.
+func (h *XMPPHandler) Subscribe(s Subscriber) (unsubscribe func()) {
+    h.subs.mu.Lock()
+    defer h.subs.mu.Unlock()
+    if h.subs.list == nil {
+        h.subs.list = make(map[int]Subscriber)
+    }
+    id := h.subs.nextID
+    h.subs.nextID++
+    h.subs.list[id] = s
+
+    return func() {
+        h.subs.mu.Lock()
+        defer h.subs.mu.Unlock()
+        delete(h.subs.list, id)
+    }
+}
+
+// emit delivers ev to every subscriber, in the order they subscribed.
+func (h *XMPPHandler) emit(ev Event) {
+    h.subs.mu.Lock()
+    ids := make([]int, 0, len(h.subs.list))
+    for id := range h.subs.list {
+        ids = append(ids, id)
+    }
+    targets := make([]Subscriber, 0, len(ids))
+    sort.Ints(ids)
+    for _, id := range ids {
+        targets = append(targets, h.subs.list[id])
+    }
+    h.subs.mu.Unlock()
+
+    for _, s := range targets {
+        s.HandleEvent(ev)
+    }
+}
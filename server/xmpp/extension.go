@@ -0,0 +1,190 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "reflect"
+    "sync"
+)
+
+// Extension is a child element of a message or presence that the core structs
+// don't map, such as receipts, chat states, delays, OOB or MUC payloads.
+// It is kept verbatim so that it survives decoding and encoding again.
+type Extension struct {
+    XMLName xml.Name
+    Attr    []xml.Attr
+    Inner   []byte // raw XML between the start and end tags
+}
+
+// MarshalXML writes the extension element back out unchanged.
+func (e Extension) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+    start := xml.StartElement{Name: e.XMLName, Attr: e.Attr}
+    return enc.EncodeElement(struct {
+        Inner []byte `xml:",innerxml"`
+    }{e.Inner}, start)
+}
+
+// UnmarshalXML keeps the element name, its attributes and its raw content.
+func (e *Extension) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var content struct {
+        Inner []byte `xml:",innerxml"`
+    }
+    if err := d.DecodeElement(&content, &start); err != nil {
+        return err
+    }
+    e.XMLName = start.Name
+    e.Attr = nil
+    for _, attr := range start.Attr {
+        // Namespace declarations are written again from XMLName when encoding.
+        if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+            continue
+        }
+        e.Attr = append(e.Attr, attr)
+    }
+    e.Inner = content.Inner
+    return nil
+}
+
+// Decode unmarshals the extension into v, which must map the same element.
+func (e Extension) Decode(v interface{}) error {
+    data, err := xml.Marshal(e)
+    if err != nil {
+        return err
+    }
+    return xml.Unmarshal(data, v)
+}
+
+// NewExtension encodes a typed payload, such as a registered extension struct,
+// into an Extension that can be attached to a stanza.
+func NewExtension(payload interface{}) (Extension, error) {
+    data, err := xml.Marshal(payload)
+    if err != nil {
+        return Extension{}, fmt.Errorf("failed to marshal extension: %v", err)
+    }
+    var ext Extension
+    if err := xml.Unmarshal(data, &ext); err != nil {
+        return Extension{}, fmt.Errorf("failed to parse extension: %v", err)
+    }
+    return ext, nil
+}
+
+// Extensions is the list of extension elements carried by a stanza.
+type Extensions []Extension
+
+// Find returns the first extension with the given qualified name.
+func (x Extensions) Find(space, local string) (Extension, bool) {
+    for _, ext := range x {
+        if ext.XMLName.Space == space && ext.XMLName.Local == local {
+            return ext, true
+        }
+    }
+    return Extension{}, false
+}
+
+// Get looks up the extension registered for the type of v and decodes it into v.
+// It reports whether the stanza carried that extension.
+func (x Extensions) Get(v interface{}) (bool, error) {
+    name, ok := registeredName(reflect.TypeOf(v))
+    if !ok {
+        return false, fmt.Errorf("no extension registered for %T", v)
+    }
+    ext, found := x.Find(name.Space, name.Local)
+    if !found {
+        return false, nil
+    }
+    return true, ext.Decode(v)
+}
+
+// Add encodes payload and appends it, replacing an extension with the same name.
+func (x *Extensions) Add(payload interface{}) error {
+    ext, err := NewExtension(payload)
+    if err != nil {
+        return err
+    }
+    x.Remove(ext.XMLName.Space, ext.XMLName.Local)
+    *x = append(*x, ext)
+    return nil
+}
+
+// Remove drops every extension with the given qualified name.
+func (x *Extensions) Remove(space, local string) {
+    kept := (*x)[:0]
+    for _, ext := range *x {
+        if ext.XMLName.Space != space || ext.XMLName.Local != local {
+            kept = append(kept, ext)
+        }
+    }
+    *x = kept
+}
+
+// Payloads decodes every extension that has a registered type. Extensions
+// without one are skipped.
+func (x Extensions) Payloads() []interface{} {
+    var payloads []interface{}
+    for _, ext := range x {
+        typ, ok := registeredType(ext.XMLName)
+        if !ok {
+            continue
+        }
+        v := reflect.New(typ).Interface()
+        if err := ext.Decode(v); err != nil {
+            continue
+        }
+        payloads = append(payloads, v)
+    }
+    return payloads
+}
+
+var extensionRegistry = struct {
+    sync.RWMutex
+    types map[xml.Name]reflect.Type
+    names map[reflect.Type]xml.Name
+}{
+    types: make(map[xml.Name]reflect.Type),
+    names: make(map[reflect.Type]xml.Name),
+}
+
+// RegisterExtension associates a typed payload struct with its qualified
+// element name, so it can be read with Extensions.Get and Payloads. payload is
+// a value or pointer of the struct type, and name must match its XMLName tag.
+// Features usually call it from an init function.
+func RegisterExtension(space, local string, payload interface{}) error {
+    typ := reflect.TypeOf(payload)
+    if typ == nil {
+        return errors.New("nil extension payload")
+    }
+    if typ.Kind() == reflect.Ptr {
+        typ = typ.Elem()
+    }
+    if typ.Kind() != reflect.Struct {
+        return fmt.Errorf("extension payload %s is not a struct", typ)
+    }
+
+    name := xml.Name{Space: space, Local: local}
+    extensionRegistry.Lock()
+    defer extensionRegistry.Unlock()
+    extensionRegistry.types[name] = typ
+    extensionRegistry.names[typ] = name
+    return nil
+}
+
+func registeredType(name xml.Name) (reflect.Type, bool) {
+    extensionRegistry.RLock()
+    defer extensionRegistry.RUnlock()
+    typ, ok := extensionRegistry.types[name]
+    return typ, ok
+}
+
+func registeredName(typ reflect.Type) (xml.Name, bool) {
+    if typ == nil {
+        return xml.Name{}, false
+    }
+    if typ.Kind() == reflect.Ptr {
+        typ = typ.Elem()
+    }
+    extensionRegistry.RLock()
+    defer extensionRegistry.RUnlock()
+    name, ok := extensionRegistry.names[typ]
+    return name, ok
+}
@@ -1,3 +1,8 @@
 module github.com/adrianfulla/Proyecto1-Redes/server/xmpp
 
 go 1.22.1
+
+require (
+	golang.org/x/net v0.25.0
+	golang.org/x/text v0.16.0
+)
@@ -0,0 +1,512 @@
+package xmpp
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+const (
+    nsDelay    = "urn:xmpp:delay"
+    nsReceipts = "urn:xmpp:receipts"
+)
+
+// Delay tells when a stanza that was stored or forwarded was first sent
+// (XEP-0203).
+type Delay struct {
+    XMLName xml.Name  `xml:"urn:xmpp:delay delay"`
+    From    jid.JID   `xml:"from,attr,omitempty"`
+    Stamp   time.Time `xml:"stamp,attr"`
+}
+
+// ReceiptRequest asks the recipient of a message to confirm that it arrived
+// (XEP-0184).
+type ReceiptRequest struct {
+    XMLName xml.Name `xml:"urn:xmpp:receipts request"`
+}
+
+// ReceiptReceived confirms that the message with ID arrived.
+type ReceiptReceived struct {
+    XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+    ID      string   `xml:"id,attr"`
+}
+
+func init() {
+    RegisterExtension(nsDelay, "delay", Delay{})
+    RegisterExtension(nsReceipts, "request", ReceiptRequest{})
+    RegisterExtension(nsReceipts, "received", ReceiptReceived{})
+}
+
+// SentAt returns when the message was sent: its delay stamp, if it was
+// stored or forwarded, or else now.
+func (m *Message) SentAt() time.Time {
+    var delay Delay
+    if found, err := m.Extensions.Get(&delay); found && err == nil && !delay.Stamp.IsZero() {
+        return delay.Stamp.UTC()
+    }
+    return time.Now().UTC()
+}
+
+// DeliveryState is how far a message of the history got.
+type DeliveryState string
+
+const (
+    MessageSent      DeliveryState = "sent"      // written to the stream
+    MessageDelivered DeliveryState = "delivered" // the recipient confirmed it
+    MessageFailed    DeliveryState = "failed"    // not sent, or bounced with an error
+    MessageReceived  DeliveryState = "received"  // an incoming message
+)
+
+// HistoryRecord is a message of a conversation, as kept in the chat history.
+type HistoryRecord struct {
+    ID        string        `json:"id,omitempty"`       // stanza ID
+    ArchiveID string        `json:"archive,omitempty"`  // ID in the server archive, if known
+    Contact   jid.JID       `json:"contact"`            // bare JID of the other party
+    Direction Direction     `json:"dir"`
+    Body      string        `json:"body"`
+    Time      time.Time     `json:"time"`
+    State     DeliveryState `json:"state"`
+    Archived  bool          `json:"archived,omitempty"` // fetched from the archive, after newer messages
+}
+
+// HistoryStore keeps the conversations between sessions. The handler
+// records every chat message sent or received in it.
+type HistoryStore interface {
+    AppendMessage(record HistoryRecord) error
+    // SetState changes the delivery state of the message with a stanza ID.
+    SetState(contact jid.JID, id string, state DeliveryState) error
+    // History returns up to limit messages of a conversation, oldest first,
+    // leaving out the skip most recent ones. Paging back through a
+    // conversation is asking again with skip grown by what was returned.
+    History(contact jid.JID, skip, limit int) ([]HistoryRecord, error)
+    // Index returns the IDs of the messages of a conversation, so that
+    // messages fetched from the server archive are not added twice.
+    Index(contact jid.JID) (*HistoryIndex, error)
+    // ArchiveMark returns the archive ID of the last message synced from
+    // the server archive, or "" if none was.
+    ArchiveMark() (string, error)
+    SetArchiveMark(archiveID string) error
+}
+
+// page returns the records History returns for skip and limit. Messages
+// fetched from the archive are stored after newer ones, so they are merged
+// in by time; the others stay in the order they were recorded.
+func page(records []HistoryRecord, skip, limit int) []HistoryRecord {
+    end := len(records) - skip
+    if end <= 0 {
+        return nil
+    }
+    records = inTimeOrder(records)
+    start := 0
+    if limit > 0 && end > limit {
+        start = end - limit
+    }
+    return records[start:end]
+}
+
+// inTimeOrder returns a copy of records with the archived ones merged by time
+// among the others.
+func inTimeOrder(records []HistoryRecord) []HistoryRecord {
+    var live, archived []HistoryRecord
+    for _, r := range records {
+        if r.Archived {
+            archived = append(archived, r)
+        } else {
+            live = append(live, r)
+        }
+    }
+    sort.SliceStable(archived, func(i, j int) bool { return archived[i].Time.Before(archived[j].Time) })
+    merged := make([]HistoryRecord, 0, len(records))
+    for len(live) > 0 && len(archived) > 0 {
+        if archived[0].Time.Before(live[0].Time) {
+            merged, archived = append(merged, archived[0]), archived[1:]
+        } else {
+            merged, live = append(merged, live[0]), live[1:]
+        }
+    }
+    merged = append(merged, live...)
+    return append(merged, archived...)
+}
+
+// HistoryIndex holds the stanza IDs and archive IDs of the messages of a
+// conversation.
+type HistoryIndex struct {
+    ids        map[string]bool // stanza IDs
+    unarchived map[string]bool // stanza IDs of the messages with no archive ID
+    archived   map[string]bool // archive IDs
+}
+
+func newHistoryIndex(records []HistoryRecord) *HistoryIndex {
+    index := &HistoryIndex{ids: make(map[string]bool), unarchived: make(map[string]bool), archived: make(map[string]bool)}
+    for _, r := range records {
+        index.Add(r)
+    }
+    return index
+}
+
+// Add records the IDs of a message added to the conversation.
+func (x *HistoryIndex) Add(record HistoryRecord) {
+    if record.ArchiveID != "" {
+        x.archived[record.ArchiveID] = true
+    }
+    if record.ID != "" {
+        x.ids[record.ID] = true
+        if record.ArchiveID == "" {
+            x.unarchived[record.ID] = true
+        }
+    }
+}
+
+// Holds reports whether the conversation holds the message with a stanza ID
+// or archive ID. Stanza IDs are chosen by clients and may repeat, so they
+// only match when the archive IDs cannot tell the messages apart.
+func (x *HistoryIndex) Holds(id, archiveID string) bool {
+    if archiveID != "" && x.archived[archiveID] {
+        return true
+    }
+    if id == "" {
+        return false
+    }
+    if archiveID == "" {
+        return x.ids[id]
+    }
+    return x.unarchived[id]
+}
+
+// MemoryHistoryStore keeps the conversations for the session only. It is
+// what the handler uses until it is given another store.
+type MemoryHistoryStore struct {
+    mu      sync.Mutex
+    records map[jid.JID][]HistoryRecord
+    mark    string
+}
+
+func (s *MemoryHistoryStore) AppendMessage(record HistoryRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.records == nil {
+        s.records = make(map[jid.JID][]HistoryRecord)
+    }
+    s.records[record.Contact] = append(s.records[record.Contact], record)
+    return nil
+}
+
+func (s *MemoryHistoryStore) SetState(contact jid.JID, id string, state DeliveryState) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    records := s.records[contact]
+    for i := len(records) - 1; i >= 0; i-- {
+        if records[i].ID == id {
+            records[i].State = state
+            break
+        }
+    }
+    return nil
+}
+
+func (s *MemoryHistoryStore) History(contact jid.JID, skip, limit int) ([]HistoryRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return page(s.records[contact], skip, limit), nil
+}
+
+func (s *MemoryHistoryStore) Index(contact jid.JID) (*HistoryIndex, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return newHistoryIndex(s.records[contact]), nil
+}
+
+func (s *MemoryHistoryStore) ArchiveMark() (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.mark, nil
+}
+
+func (s *MemoryHistoryStore) SetArchiveMark(archiveID string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.mark = archiveID
+    return nil
+}
+
+// FileHistoryStore keeps the conversations of one account in append-only
+// files of JSON lines, one per contact. A delivery state change is a line
+// of its own, applied when the file is read. The archive mark is kept in a
+// file of its own.
+type FileHistoryStore struct {
+    Dir string
+    mu  sync.Mutex
+}
+
+// NewFileHistoryStore returns a store that keeps the conversations of
+// account in the user's configuration directory, which unlike the cache
+// is not cleared.
+func NewFileHistoryStore(account jid.JID) (*FileHistoryStore, error) {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return nil, fmt.Errorf("no data directory for the chat history: %v", err)
+    }
+    name := url.PathEscape(account.Bare().String())
+    return &FileHistoryStore{Dir: filepath.Join(dir, "xmpp-client", "history", name)}, nil
+}
+
+// historyLine is a line of a history file: a message, or a new state for
+// the message with ID.
+type historyLine struct {
+    Message *HistoryRecord `json:"msg,omitempty"`
+    ID      string         `json:"id,omitempty"`
+    State   DeliveryState  `json:"state,omitempty"`
+}
+
+func (s *FileHistoryStore) path(contact jid.JID) string {
+    return filepath.Join(s.Dir, url.PathEscape(contact.Bare().String())+".jsonl")
+}
+
+func (s *FileHistoryStore) append(contact jid.JID, line historyLine) error {
+    data, err := json.Marshal(line)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(s.path(contact), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// AppendMessage adds a message at the end of the contact's file.
+func (s *FileHistoryStore) AppendMessage(record HistoryRecord) error {
+    return s.append(record.Contact, historyLine{Message: &record})
+}
+
+// SetState appends the new state of a message.
+func (s *FileHistoryStore) SetState(contact jid.JID, id string, state DeliveryState) error {
+    return s.append(contact, historyLine{ID: id, State: state})
+}
+
+// History reads the contact's file.
+func (s *FileHistoryStore) History(contact jid.JID, skip, limit int) ([]HistoryRecord, error) {
+    records, err := s.records(contact)
+    return page(records, skip, limit), err
+}
+
+// records reads the messages of the contact's file in the order they were
+// recorded. A missing file is an empty conversation, and a line cut short
+// by a crash is skipped.
+func (s *FileHistoryStore) records(contact jid.JID) ([]HistoryRecord, error) {
+    s.mu.Lock()
+    data, err := os.ReadFile(s.path(contact))
+    s.mu.Unlock()
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var records []HistoryRecord
+    byID := make(map[string]int)
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    scanner.Buffer(nil, 1<<20)
+    for scanner.Scan() {
+        var line historyLine
+        if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+            Logger("history").Warn("skipping corrupt history line", "contact", contact, "err", err)
+            continue
+        }
+        switch {
+        case line.Message != nil:
+            if line.Message.ID != "" {
+                byID[line.Message.ID] = len(records)
+            }
+            records = append(records, *line.Message)
+        case line.ID != "":
+            if i, ok := byID[line.ID]; ok {
+                records[i].State = line.State
+            }
+        }
+    }
+    return records, scanner.Err()
+}
+
+// Index reads the contact's file for the IDs of its messages.
+func (s *FileHistoryStore) Index(contact jid.JID) (*HistoryIndex, error) {
+    records, err := s.records(contact)
+    if err != nil {
+        return nil, err
+    }
+    return newHistoryIndex(records), nil
+}
+
+func (s *FileHistoryStore) markPath() string {
+    return filepath.Join(s.Dir, "archive-mark")
+}
+
+// ArchiveMark reads the mark. A missing file means nothing was synced yet.
+func (s *FileHistoryStore) ArchiveMark() (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, err := os.ReadFile(s.markPath())
+    if errors.Is(err, fs.ErrNotExist) {
+        return "", nil
+    }
+    return string(bytes.TrimSpace(data)), err
+}
+
+func (s *FileHistoryStore) SetArchiveMark(archiveID string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+        return err
+    }
+    return os.WriteFile(s.markPath(), []byte(archiveID+"\n"), 0o600)
+}
+
+// DeliveryEvent is emitted when the delivery state of a message we sent
+// changes.
+type DeliveryEvent struct {
+    Contact jid.JID
+    ID      string
+    State   DeliveryState
+}
+
+func (*DeliveryEvent) isEvent() {}
+
+// chatHistory is the history store of a session.
+type chatHistory struct {
+    mu    sync.Mutex
+    store HistoryStore
+}
+
+// UseHistory records the conversations in store from now on.
+func (h *XMPPHandler) UseHistory(store HistoryStore) {
+    h.chats.mu.Lock()
+    defer h.chats.mu.Unlock()
+    h.chats.store = store
+}
+
+func (h *XMPPHandler) historyStore() HistoryStore {
+    h.chats.mu.Lock()
+    defer h.chats.mu.Unlock()
+    if h.chats.store == nil {
+        h.chats.store = &MemoryHistoryStore{}
+    }
+    return h.chats.store
+}
+
+// ChatHistory returns up to limit messages of the conversation with a
+// contact, oldest first, leaving out the skip most recent ones.
+func (h *XMPPHandler) ChatHistory(contact jid.JID, skip, limit int) ([]HistoryRecord, error) {
+    return h.historyStore().History(contact.Bare(), skip, limit)
+}
+
+// historyRecord returns the history record of a chat message. ok is false
+// for the messages that are not kept: those without a body, such as chat
+// states and receipts, and group chat and error messages.
+func historyRecord(msg *Message, dir Direction, state DeliveryState) (record HistoryRecord, ok bool) {
+    if msg.Body == "" || msg.Type == "groupchat" || msg.Type == "error" {
+        return HistoryRecord{}, false
+    }
+    contact := msg.From.Bare()
+    if dir == Outbound {
+        contact = msg.To.Bare()
+    }
+    if contact.IsZero() {
+        return HistoryRecord{}, false
+    }
+    return HistoryRecord{
+        ID:        msg.ID,
+        Contact:   contact,
+        Direction: dir,
+        Body:      msg.Body,
+        Time:      msg.SentAt(),
+        State:     state,
+    }, true
+}
+
+// recordMessage adds a chat message to the history. The archive ID the
+// server stamped on an incoming message is kept, so that syncing with the
+// archive doesn't add it again. It doesn't move the archive mark: the
+// messages archived before it may not have reached this client.
+func (h *XMPPHandler) recordMessage(msg *Message, dir Direction, state DeliveryState) {
+    record, ok := historyRecord(msg, dir, state)
+    if !ok {
+        return
+    }
+    if dir == Inbound {
+        record.ArchiveID = h.archiveID(msg)
+    }
+    if record.ArchiveID == "" || !h.archiveSyncing() {
+        if err := h.historyStore().AppendMessage(record); err != nil {
+            Logger("history").Warn("failed to record message", "contact", record.Contact, "err", err)
+        }
+        return
+    }
+    // The message may also be in an archive page being synced.
+    if _, err := h.addToHistory(record); err != nil {
+        Logger("history").Warn("failed to record message", "contact", record.Contact, "err", err)
+    }
+}
+
+// setDeliveryState records and reports a new state of a message we sent.
+func (h *XMPPHandler) setDeliveryState(contact jid.JID, id string, state DeliveryState) {
+    contact = contact.Bare()
+    if err := h.historyStore().SetState(contact, id, state); err != nil {
+        Logger("history").Warn("failed to record delivery state", "contact", contact, "err", err)
+    }
+    h.emit(&DeliveryEvent{Contact: contact, ID: id, State: state})
+}
+
+// handleReceipts answers a request for a receipt, and records the receipts
+// and bounces of the messages we sent.
+func (h *XMPPHandler) handleReceipts(msg *Message) {
+    if msg.Type == "error" {
+        if msg.ID != "" {
+            h.setDeliveryState(msg.From, msg.ID, MessageFailed)
+        }
+        return
+    }
+    var received ReceiptReceived
+    if found, err := msg.Extensions.Get(&received); found && err == nil && received.ID != "" {
+        h.setDeliveryState(msg.From, received.ID, MessageDelivered)
+    }
+    var request ReceiptRequest
+    if found, _ := msg.Extensions.Get(&request); found && msg.ID != "" && msg.Body != "" {
+        receipt := &Message{To: msg.From, ID: newMessageID()}
+        receipt.Extensions.Add(ReceiptReceived{ID: msg.ID})
+        if err := h.SendStanza(receipt); err != nil {
+            Logger("message").Warn("failed to send receipt", "to", msg.From, "err", err)
+        }
+    }
+}
+
+// newMessageID returns a random stanza ID for a message, unique across
+// sessions so that the history can tell messages apart.
+func newMessageID() string {
+    var b [8]byte
+    rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
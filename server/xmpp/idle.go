@@ -0,0 +1,128 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "sync"
+    "time"
+)
+
+const nsIdle = "urn:xmpp:idle:1"
+
+// Idle tells since when the user is idle (XEP-0319).
+type Idle struct {
+    XMLName xml.Name  `xml:"urn:xmpp:idle:1 idle"`
+    Since   time.Time `xml:"since,attr"`
+}
+
+func init() {
+    RegisterExtension(nsIdle, "idle", Idle{})
+}
+
+// IdleSince returns the time the sender became idle, if the presence says.
+func (p *Presence) IdleSince() (time.Time, bool) {
+    var idle Idle
+    found, err := p.Extensions.Get(&idle)
+    if !found || err != nil || idle.Since.IsZero() {
+        return time.Time{}, false
+    }
+    return idle.Since, true
+}
+
+// autoAwayInterval is how often AutoAway.Run checks for idleness.
+const autoAwayInterval = 10 * time.Second
+
+// AutoAway switches our presence to away after a time without user
+// activity, and to extended away after a longer one, telling since when the
+// user is idle. The presence from before is restored at the next activity.
+// Only an available or free-for-chat presence is changed: a presence the
+// user set to away or do not disturb is left alone.
+type AutoAway struct {
+    h *XMPPHandler
+
+    mu         sync.Mutex
+    away, xa   time.Duration // zero disables the step
+    lastActive time.Time
+    saved      *Presence // what to restore, while the presence is changed
+    show       Show      // the show set automatically
+}
+
+// NewAutoAway returns an AutoAway for the session with the given thresholds.
+func NewAutoAway(h *XMPPHandler, away, xa time.Duration) *AutoAway {
+    return &AutoAway{h: h, away: away, xa: xa, lastActive: time.Now()}
+}
+
+// SetThresholds changes the idle times after which the presence becomes
+// away and extended away. Zero disables a step.
+func (a *AutoAway) SetThresholds(away, xa time.Duration) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.away, a.xa = away, xa
+}
+
+// Activity records that the user did something, restoring the presence if
+// it was changed.
+func (a *AutoAway) Activity() {
+    a.mu.Lock()
+    a.lastActive = time.Now()
+    restore := a.saved
+    a.saved, a.show = nil, ShowAvailable
+    a.mu.Unlock()
+
+    if restore != nil {
+        Logger("presence").Debug("user is back, restoring presence", "show", restore.Show)
+        if err := a.h.SendPresence(restore); err != nil {
+            Logger("presence").Warn("failed to restore presence", "err", err)
+        }
+    }
+}
+
+// Check changes the presence if the user is idle at now for long enough.
+func (a *AutoAway) Check(now time.Time) error {
+    a.mu.Lock()
+    idle := now.Sub(a.lastActive)
+    var show Show
+    switch {
+    case a.xa > 0 && idle >= a.xa && a.show != ShowXA:
+        show = ShowXA
+    case a.away > 0 && idle >= a.away && a.show == ShowAvailable:
+        show = ShowAway
+    default:
+        a.mu.Unlock()
+        return nil
+    }
+    if a.saved == nil {
+        own, ok := a.h.OwnPresence()
+        if !ok || !own.IsAvailable() || (own.Show != ShowAvailable && own.Show != ShowChat) {
+            a.mu.Unlock()
+            return nil
+        }
+        a.saved = own
+    }
+    presence := a.saved.clone()
+    a.show = show
+    since := a.lastActive
+    a.mu.Unlock()
+
+    presence.Show = show
+    if err := presence.Extensions.Add(Idle{Since: since.UTC().Truncate(time.Second)}); err != nil {
+        return err
+    }
+    Logger("presence").Debug("user is idle, changing presence", "show", show, "idle", idle.Round(time.Second))
+    return a.h.SendPresence(presence)
+}
+
+// Run checks for idleness until stop is closed.
+func (a *AutoAway) Run(stop <-chan struct{}) {
+    ticker := time.NewTicker(autoAwayInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-stop:
+            return
+        case now := <-ticker.C:
+            if err := a.Check(now); err != nil {
+                Logger("presence").Warn("failed to change presence for idleness", "err", err)
+            }
+        }
+    }
+}
@@ -0,0 +1,109 @@
+package xmpp
+
+import (
+    "sort"
+    "sync"
+)
+
+// Direction tells an interceptor which way a stanza is travelling.
+type Direction int
+
+const (
+    Inbound Direction = iota // received from the server, not dispatched yet
+    Outbound                 // about to be written to the server
+)
+
+func (d Direction) String() string {
+    if d == Outbound {
+        return "outbound"
+    }
+    return "inbound"
+}
+
+// Interceptor sees stanzas before they are dispatched or written. It returns
+// the stanza to pass on, which may be the same one modified or a replacement,
+// or nil to drop it. An error also drops the stanza.
+//
+// To answer an inbound stanza, send the reply with SendStanza and return nil.
+// To answer an outbound one locally, hand the reply to Inject and return nil.
+type Interceptor interface {
+    Intercept(dir Direction, stanza Stanza) (Stanza, error)
+}
+
+// InterceptorFunc adapts a function to the Interceptor interface.
+type InterceptorFunc func(dir Direction, stanza Stanza) (Stanza, error)
+
+// Intercept calls f(dir, stanza).
+func (f InterceptorFunc) Intercept(dir Direction, stanza Stanza) (Stanza, error) {
+    return f(dir, stanza)
+}
+
+// interceptors is the interceptor chain of a handler.
+type interceptors struct {
+    mu     sync.Mutex
+    nextID int
+    list   map[int]Interceptor
+}
+
+// AddInterceptor appends i to the chain. Inbound stanzas go through the
+// chain in the order interceptors were added and outbound stanzas in the
+// reverse order, so the first interceptor is the one closest to the wire.
+// The returned function removes the interceptor.
+func (h *XMPPHandler) AddInterceptor(i Interceptor) (remove func()) {
+    h.chain.mu.Lock()
+    defer h.chain.mu.Unlock()
+    if h.chain.list == nil {
+        h.chain.list = make(map[int]Interceptor)
+    }
+    id := h.chain.nextID
+    h.chain.nextID++
+    h.chain.list[id] = i
+
+    return func() {
+        h.chain.mu.Lock()
+        defer h.chain.mu.Unlock()
+        delete(h.chain.list, id)
+    }
+}
+
+// intercept runs stanza through the chain in the order for dir. It returns
+// nil if an interceptor dropped the stanza.
+func (h *XMPPHandler) intercept(dir Direction, stanza Stanza) (Stanza, error) {
+    h.chain.mu.Lock()
+    ids := make([]int, 0, len(h.chain.list))
+    for id := range h.chain.list {
+        ids = append(ids, id)
+    }
+    if dir == Outbound {
+        sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+    } else {
+        sort.Ints(ids)
+    }
+    chain := make([]Interceptor, 0, len(ids))
+    for _, id := range ids {
+        chain = append(chain, h.chain.list[id])
+    }
+    h.chain.mu.Unlock()
+
+    for _, i := range chain {
+        var err error
+        stanza, err = i.Intercept(dir, stanza)
+        if err != nil || stanza == nil {
+            return nil, err
+        }
+    }
+    return stanza, nil
+}
+
+// Inject handles stanza as if it had been received from the server: it goes
+// through the inbound interceptors and is then dispatched.
+func (h *XMPPHandler) Inject(stanza Stanza) {
+    stanza, err := h.intercept(Inbound, stanza)
+    if err != nil {
+        Logger("session").Warn("inbound stanza dropped", "err", err)
+        return
+    }
+    if stanza != nil {
+        h.dispatchStanza(stanza)
+    }
+}
@@ -1,37 +1,42 @@
 package xmpp
 
 import (
+    "bytes"
     "encoding/xml"
     "errors"
     "fmt"
-    "log"
-    "strings"
-)
+    "io"
 
-type RegisterRequest struct {
-    XMLName  xml.Name `xml:"query"`
-    XMLNS    string   `xml:"xmlns,attr"`
-    Username string   `xml:"username"`
-    Password string   `xml:"password"`
-}
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
 
 type RawXML []byte
 
 type IQ struct {
     XMLName xml.Name `xml:"iq"`
-    From    string   `xml:"from,attr,omitempty"`
-    To      string   `xml:"to,attr,omitempty"`
+    From    jid.JID  `xml:"from,attr"`
+    To      jid.JID  `xml:"to,attr"`
     Type    string   `xml:"type,attr"`
     ID      string   `xml:"id,attr"`
     Query   interface{} `xml:",omitempty"`
+    Error   *StanzaError `xml:"error"`
+    Payload []byte   `xml:",innerxml"` // raw children of received IQs
 }
 
-type IQItem struct {
-    JID          string `xml:"jid,attr"`
-    Name         string `xml:"name,attr,omitempty"`
-    Subscription string `xml:"subscription,attr"`
+// VersionQuery is the XEP-0092 software version payload.
+type VersionQuery struct {
+    XMLName xml.Name `xml:"jabber:iq:version query"`
+    Name    string   `xml:"name,omitempty"`
+    Version string   `xml:"version,omitempty"`
+    OS      string   `xml:"os,omitempty"`
 }
 
+// BindRequest is the RFC 6120 resource binding payload.
+type BindRequest struct {
+    XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+    Resource string   `xml:"resource,omitempty"`
+    JID      string   `xml:"jid,omitempty"`
+}
 
 func NewIQ(iqType, iqID string) *IQ {
     return &IQ{
@@ -45,124 +50,137 @@ func (iq *IQ) SetQuery(query interface{}) {
     iq.Query = query
 }
 
-func (iq *IQ) ToXML() (string, error) {
-    output, err := xml.Marshal(iq)
-    if err != nil {
-        return "", err
+// DecodePayload decodes the first child element of a received IQ, other than
+// <error/>, into v.
+func (iq *IQ) DecodePayload(v interface{}) error {
+    decoder := xml.NewDecoder(bytes.NewReader(iq.Payload))
+    for {
+        tok, err := decoder.Token()
+        if err == io.EOF {
+            return errors.New("IQ has no payload")
+        }
+        if err != nil {
+            return err
+        }
+        if se, ok := tok.(xml.StartElement); ok {
+            if se.Name.Local == "error" {
+                decoder.Skip()
+                continue
+            }
+            return decoder.DecodeElement(v, &se)
+        }
     }
-    return string(output), nil
 }
 
-func CreateUser(conn *XMPPConnection, username, password string) error {
-    // Prepare the registration request
-    iqID := "register1"
-    register := RegisterRequest{
-        XMLNS:    "jabber:iq:register", // Set the correct namespace
-        Username: username,
-        Password: password,
-    }
-
-    iq := NewIQ("set", iqID)
-    iq.SetQuery(register)
-    
-    if err := sendStanza(conn, iq); err != nil {
-        return fmt.Errorf("failed to send registration request: %v", err)
-    }
-
-    // Wait for the response and handle it
-    buffer := make([]byte, 4096)
-    n, err := conn.Conn.Read(buffer)
-    if err != nil {
-        return fmt.Errorf("error reading registration response: %v", err)
-    }
-
-    response := string(buffer[:n])
-    log.Printf("Received registration response: %s\n", response)
-
-    // Handle <stream:features> response and check if it includes registration result
-    if strings.Contains(response, "<stream:features>") {
-        log.Println("Stream features received. Continuing to monitor for registration result...")
-        // Check if the response also contains an IQ result/error directly after <stream:features>
-        if strings.Contains(response, "<iq type=\"result\"") {
-            log.Println("User created successfully")
-            return nil
+// PayloadName returns the name of the first child element of a received IQ,
+// other than <error/>, or the zero name if there is none.
+func (iq *IQ) PayloadName() xml.Name {
+    decoder := xml.NewDecoder(bytes.NewReader(iq.Payload))
+    for {
+        tok, err := decoder.Token()
+        if err != nil {
+            return xml.Name{}
         }
-        if strings.Contains(response, "<iq type=\"error\"") {
-            if strings.Contains(response, "<conflict") {
-                return fmt.Errorf("user already exists")
+        if se, ok := tok.(xml.StartElement); ok {
+            if se.Name.Local == "error" {
+                decoder.Skip()
+                continue
             }
-            return fmt.Errorf("failed to create user: %s", extractErrorMessage(response))
+            return se.Name
         }
-        // If not, read again to get the IQ result/error
-        n, err = conn.Conn.Read(buffer)
-        if err != nil {
-            return fmt.Errorf("error reading final registration response: %v", err)
-        }
-        response = string(buffer[:n])
-        log.Printf("Received final registration response: %s\n", response)
     }
+}
 
-    // Handle successful user creation
-    if strings.Contains(response, "<iq type=\"result\"") {
-        log.Println("User created successfully")
-        return nil
+func (iq *IQ) ToXML() (string, error) {
+    out := *iq
+    if len(out.Payload) > 0 {
+        // A received IQ: its error element is already part of the raw payload.
+        out.Error = nil
     }
-
-    // Handle error during user creation
-    if strings.Contains(response, "<iq type=\"error\"") {
-        if strings.Contains(response, "<conflict") {
-            return fmt.Errorf("user already exists")
-        }
-        return fmt.Errorf("failed to create user: %s", extractErrorMessage(response))
+    output, err := xml.Marshal(&out)
+    if err != nil {
+        return "", err
     }
-
-    return errors.New("unexpected registration response")
+    return string(output), nil
 }
 
-// Helper function to extract error message from the server response
-func extractErrorMessage(response string) string {
-    start := strings.Index(response, "<error")
-    if start == -1 {
-        return "unknown error"
+// CreateUser registers username with password, filling them into whatever
+// registration form the server hands out. It fails if the server asks for
+// more than a username and password; use FetchRegistrationForm and
+// SubmitRegistration to complete such forms.
+func CreateUser(conn *XMPPConnection, username, password string) error {
+    query, err := FetchRegistrationForm(conn)
+    if err != nil {
+        return err
     }
-    end := strings.Index(response[start:], "</error>")
-    if end == -1 {
-        end = len(response)
-    } else {
-        end += start + len("</error>")
+    if query.IsRedirect() {
+        return &RedirectError{URL: query.OOB.URL}
     }
-    return response[start:end]
+
+    query.SetValue("username", username)
+    query.SetValue("password", password)
+    return SubmitRegistration(conn, query)
 }
 
 
-func BindResource(conn *XMPPConnection) error {
+// BindResource binds a resource to the session and returns the full JID the
+// server assigned to it.
+func BindResource(conn *XMPPConnection) (jid.JID, error) {
     // Resource binding request
-    iqStanza := `<iq type="set" id="bind_1">
-                    <bind xmlns="urn:ietf:params:xml:ns:xmpp-bind">
-                        <resource>mainbinding</resource>
-                    </bind>
-                 </iq>`
+    iq := NewIQ("set", "bind_1")
+    iq.SetQuery(&BindRequest{Resource: "mainbinding"})
 
     // Send the IQ stanza for resource binding
-    _, err := conn.Conn.Write([]byte(iqStanza))
+    err := sendStanza(conn, iq)
     if err != nil {
-        return fmt.Errorf("failed to send resource binding request: %v", err)
+        return jid.JID{}, fmt.Errorf("failed to send resource binding request: %v", err)
     }
 
     // Wait for the response
     buffer := make([]byte, 4096)
     n, err := conn.Conn.Read(buffer)
     if err != nil {
-        return fmt.Errorf("error reading resource binding response: %v", err)
+        return jid.JID{}, fmt.Errorf("error reading resource binding response: %v", err)
     }
 
     response := string(buffer[:n])
-    log.Printf("Received resource binding response: %s\n", response)
+    Logger("session").Debug("received resource binding response", "xml", WireXML(response))
+    // The features of the authenticated stream may come along.
+    conn.noteFeatures(buffer[:n])
 
-    if strings.Contains(response, "<iq type=\"result\"") {
-        log.Println("Resource binding successful")
-        return nil
+    bound, err := parseBindResult(buffer[:n], iq.ID)
+    if err != nil {
+        return jid.JID{}, fmt.Errorf("resource binding failed: %w", err)
     }
+    Logger("session").Info("resource binding successful", "jid", bound)
+    return bound, nil
+}
+
+// parseBindResult finds the answer to the bind request with the given ID and
+// returns the JID it carries.
+func parseBindResult(data []byte, id string) (jid.JID, error) {
+    decoder := xml.NewDecoder(bytes.NewReader(data))
+    for {
+        tok, err := decoder.Token()
+        if err != nil {
+            return jid.JID{}, errors.New("no answer to the bind request")
+        }
+        se, ok := tok.(xml.StartElement)
+        if !ok || se.Name.Local != "iq" || attrValue(se, "id") != id {
+            continue
+        }
 
-    return fmt.Errorf("resource binding failed or unexpected response")
-}
\ No newline at end of file
+        var response IQ
+        if err := decoder.DecodeElement(&response, &se); err != nil {
+            return jid.JID{}, err
+        }
+        if response.Type == "error" && response.Error != nil {
+            return jid.JID{}, response.Error
+        }
+        var bind BindRequest
+        if response.Type != "result" || response.DecodePayload(&bind) != nil {
+            return jid.JID{}, errors.New("unexpected response")
+        }
+        return jid.Parse(bind.JID)
+    }
+}
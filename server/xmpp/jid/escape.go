@@ -0,0 +1,78 @@
+package jid
+
+import (
+    "strings"
+)
+
+// escapes maps the characters XEP-0106 allows in escaped localparts to their escape sequences.
+var escapes = map[byte]string{
+    ' ':  `\20`,
+    '"':  `\22`,
+    '&':  `\26`,
+    '\'': `\27`,
+    '/':  `\2f`,
+    ':':  `\3a`,
+    '<':  `\3c`,
+    '>':  `\3e`,
+    '@':  `\40`,
+    '\\': `\5c`,
+}
+
+// Escape applies XEP-0106 JID escaping to a localpart typed by a user, so
+// that e.g. "d'artagnan" or "user@example.com" can be used as a localpart.
+// A backslash is only escaped when it starts something that would otherwise
+// be read as an escape sequence.
+func Escape(local string) string {
+    var b strings.Builder
+    for i := 0; i < len(local); i++ {
+        c := local[i]
+        if c == '\\' && !isEscapeSequence(local[i:]) {
+            b.WriteByte(c)
+            continue
+        }
+        if seq, ok := escapes[c]; ok {
+            b.WriteString(seq)
+            continue
+        }
+        b.WriteByte(c)
+    }
+    return b.String()
+}
+
+// Unescape reverses Escape, turning XEP-0106 escape sequences back into characters.
+func Unescape(local string) string {
+    var b strings.Builder
+    for i := 0; i < len(local); i++ {
+        if local[i] == '\\' && isEscapeSequence(local[i:]) {
+            b.WriteByte(unescapeSequence(local[i : i+3]))
+            i += 2
+            continue
+        }
+        b.WriteByte(local[i])
+    }
+    return b.String()
+}
+
+// isEscapeSequence reports whether s starts with one of the XEP-0106 escape sequences.
+func isEscapeSequence(s string) bool {
+    if len(s) < 3 {
+        return false
+    }
+    seq := strings.ToLower(s[:3])
+    for _, e := range escapes {
+        if e == seq {
+            return true
+        }
+    }
+    return false
+}
+
+func unescapeSequence(seq string) byte {
+    seq = strings.ToLower(seq)
+    for c, e := range escapes {
+        if e == seq {
+            return c
+        }
+    }
+    return seq[0]
+}
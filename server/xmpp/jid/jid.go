@@ -0,0 +1,256 @@
+// Package jid implements XMPP addresses (RFC 7622).
+//
+// A JID is made of an optional localpart, a domainpart and an optional
+// resourcepart: local@domain/resource. Parts are normalized when a JID is
+// created (PRECIS for the localpart and resourcepart, IDNA for the
+// domainpart), so two JIDs that differ only in case or Unicode form compare
+// equal with ==.
+package jid
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "unicode/utf8"
+
+    "golang.org/x/net/idna"
+    "golang.org/x/text/secure/precis"
+)
+
+// maxPartLength is the maximum length in bytes of each part of a JID.
+const maxPartLength = 1023
+
+var (
+    ErrEmptyDomain      = errors.New("jid: domainpart is empty")
+    ErrEmptyLocal       = errors.New("jid: localpart is empty")
+    ErrEmptyResource    = errors.New("jid: resourcepart is empty")
+    ErrPartTooLong      = errors.New("jid: part is longer than 1023 bytes")
+    ErrInvalidUTF8      = errors.New("jid: not valid UTF-8")
+    ErrForbiddenInLocal = errors.New(`jid: localpart contains one of "&'/:<>@`)
+)
+
+// JID is a parsed and normalized XMPP address. The zero value is the empty JID.
+type JID struct {
+    local    string
+    domain   string
+    resource string
+}
+
+// Parse splits s into its parts and normalizes them.
+func Parse(s string) (JID, error) {
+    var local, domain, resource string
+
+    rest := s
+    if i := strings.Index(rest, "/"); i != -1 {
+        resource = rest[i+1:]
+        rest = rest[:i]
+        if resource == "" {
+            return JID{}, ErrEmptyResource
+        }
+    }
+    if i := strings.Index(rest, "@"); i != -1 {
+        local = rest[:i]
+        domain = rest[i+1:]
+        if local == "" {
+            return JID{}, ErrEmptyLocal
+        }
+    } else {
+        domain = rest
+    }
+
+    return New(local, domain, resource)
+}
+
+// MustParse is like Parse but panics if s is not a valid JID.
+// It is meant for constants in code and tests.
+func MustParse(s string) JID {
+    j, err := Parse(s)
+    if err != nil {
+        panic(fmt.Sprintf("jid: MustParse(%q): %v", s, err))
+    }
+    return j
+}
+
+// New builds a JID from its parts, normalizing and validating each of them.
+// The localpart is taken as is; use Escape first for user input that may
+// contain spaces or characters such as '@'.
+func New(local, domain, resource string) (JID, error) {
+    var err error
+    if local, err = normalizeLocal(local); err != nil {
+        return JID{}, err
+    }
+    if domain, err = normalizeDomain(domain); err != nil {
+        return JID{}, err
+    }
+    if resource, err = normalizeResource(resource); err != nil {
+        return JID{}, err
+    }
+    return JID{local: local, domain: domain, resource: resource}, nil
+}
+
+func normalizeLocal(local string) (string, error) {
+    if local == "" {
+        return "", nil
+    }
+    if !utf8.ValidString(local) {
+        return "", ErrInvalidUTF8
+    }
+    if strings.ContainsAny(local, "\"&'/:<>@") {
+        return "", ErrForbiddenInLocal
+    }
+    normalized, err := precis.UsernameCaseMapped.String(local)
+    if err != nil {
+        return "", fmt.Errorf("jid: invalid localpart: %w", err)
+    }
+    if len(normalized) > maxPartLength {
+        return "", ErrPartTooLong
+    }
+    return normalized, nil
+}
+
+func normalizeDomain(domain string) (string, error) {
+    if !utf8.ValidString(domain) {
+        return "", ErrInvalidUTF8
+    }
+    // A fully qualified domain name may end in a dot, which is not part of the JID.
+    domain = strings.TrimSuffix(domain, ".")
+    if domain == "" {
+        return "", ErrEmptyDomain
+    }
+
+    // IP literals are kept as they are, IPv6 ones inside brackets.
+    if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+        if ip := net.ParseIP(domain[1 : len(domain)-1]); ip == nil || ip.To4() != nil {
+            return "", fmt.Errorf("jid: invalid IPv6 domainpart %q", domain)
+        }
+        return domain, nil
+    }
+    if net.ParseIP(domain) != nil {
+        return domain, nil
+    }
+
+    normalized, err := idna.Lookup.ToUnicode(domain)
+    if err != nil {
+        return "", fmt.Errorf("jid: invalid domainpart: %w", err)
+    }
+    if len(normalized) > maxPartLength {
+        return "", ErrPartTooLong
+    }
+    return normalized, nil
+}
+
+func normalizeResource(resource string) (string, error) {
+    if resource == "" {
+        return "", nil
+    }
+    if !utf8.ValidString(resource) {
+        return "", ErrInvalidUTF8
+    }
+    normalized, err := precis.OpaqueString.String(resource)
+    if err != nil {
+        return "", fmt.Errorf("jid: invalid resourcepart: %w", err)
+    }
+    if len(normalized) > maxPartLength {
+        return "", ErrPartTooLong
+    }
+    return normalized, nil
+}
+
+// Localpart returns the part before the '@', or "" if there is none.
+func (j JID) Localpart() string {
+    return j.local
+}
+
+// Domainpart returns the domain of the JID.
+func (j JID) Domainpart() string {
+    return j.domain
+}
+
+// Resourcepart returns the part after the '/', or "" if there is none.
+func (j JID) Resourcepart() string {
+    return j.resource
+}
+
+// Bare returns the JID without its resourcepart.
+func (j JID) Bare() JID {
+    return JID{local: j.local, domain: j.domain}
+}
+
+// Full returns the string form of the JID, including the resource if any.
+func (j JID) Full() string {
+    var b strings.Builder
+    if j.local != "" {
+        b.WriteString(j.local)
+        b.WriteByte('@')
+    }
+    b.WriteString(j.domain)
+    if j.resource != "" {
+        b.WriteByte('/')
+        b.WriteString(j.resource)
+    }
+    return b.String()
+}
+
+// String implements fmt.Stringer and returns the same as Full.
+func (j JID) String() string {
+    return j.Full()
+}
+
+// WithResource returns a copy of the JID with the resourcepart replaced.
+func (j JID) WithResource(resource string) (JID, error) {
+    resource, err := normalizeResource(resource)
+    if err != nil {
+        return JID{}, err
+    }
+    j.resource = resource
+    return j, nil
+}
+
+// IsZero reports whether the JID is empty.
+func (j JID) IsZero() bool {
+    return j == JID{}
+}
+
+// IsBare reports whether the JID has no resourcepart.
+func (j JID) IsBare() bool {
+    return j.resource == ""
+}
+
+// Equal reports whether both JIDs are the same address.
+func (j JID) Equal(other JID) bool {
+    return j == other
+}
+
+// MarshalXMLAttr implements xml.MarshalerAttr. Empty JIDs produce no attribute.
+func (j JID) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+    if j.IsZero() {
+        return xml.Attr{}, nil
+    }
+    return xml.Attr{Name: name, Value: j.Full()}, nil
+}
+
+// UnmarshalXMLAttr implements xml.UnmarshalerAttr.
+func (j *JID) UnmarshalXMLAttr(attr xml.Attr) error {
+    return j.UnmarshalText([]byte(attr.Value))
+}
+
+// MarshalText implements encoding.TextMarshaler, so JIDs work as JSON keys.
+func (j JID) MarshalText() ([]byte, error) {
+    return []byte(j.Full()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Empty text gives the empty JID.
+func (j *JID) UnmarshalText(text []byte) error {
+    if len(text) == 0 {
+        *j = JID{}
+        return nil
+    }
+    parsed, err := Parse(string(text))
+    if err != nil {
+        return err
+    }
+    *j = parsed
+    return nil
+}
@@ -0,0 +1,114 @@
+package jid
+
+import (
+    "encoding/xml"
+    "testing"
+)
+
+func TestParse(t *testing.T) {
+    tests := []struct {
+        in       string
+        local    string
+        domain   string
+        resource string
+    }{
+        {"alumchat.lol", "", "alumchat.lol", ""},
+        {"user@alumchat.lol", "user", "alumchat.lol", ""},
+        {"user@alumchat.lol/phone", "user", "alumchat.lol", "phone"},
+        {"User@AlumChat.LOL/Phone", "user", "alumchat.lol", "Phone"},
+        {"user@alumchat.lol./res/with/slashes", "user", "alumchat.lol", "res/with/slashes"},
+        {"ÅSA@Example.com", "åsa", "example.com", ""},
+        {"user@[::1]/x", "user", "[::1]", "x"},
+        {"user@127.0.0.1", "user", "127.0.0.1", ""},
+    }
+    for _, tt := range tests {
+        j, err := Parse(tt.in)
+        if err != nil {
+            t.Errorf("Parse(%q): unexpected error %v", tt.in, err)
+            continue
+        }
+        if j.Localpart() != tt.local || j.Domainpart() != tt.domain || j.Resourcepart() != tt.resource {
+            t.Errorf("Parse(%q) = %q %q %q, want %q %q %q", tt.in,
+                j.Localpart(), j.Domainpart(), j.Resourcepart(), tt.local, tt.domain, tt.resource)
+        }
+    }
+}
+
+func TestParseInvalid(t *testing.T) {
+    for _, in := range []string{
+        "",
+        "@alumchat.lol",
+        "user@",
+        "user@alumchat.lol/",
+        "us<er@alumchat.lol",
+        "user name@alumchat.lol",
+        "user@exa mple.com",
+        "user@[1.2.3.4]",
+        "\xff@alumchat.lol",
+    } {
+        if _, err := Parse(in); err == nil {
+            t.Errorf("Parse(%q): expected an error", in)
+        }
+    }
+}
+
+func TestEqualAndBare(t *testing.T) {
+    a := MustParse("User@AlumChat.lol/laptop")
+    b := MustParse("user@alumchat.lol/phone")
+    if a == b {
+        t.Fatalf("%s and %s should differ", a, b)
+    }
+    if a.Bare() != b.Bare() {
+        t.Fatalf("bare JIDs %s and %s should be equal", a.Bare(), b.Bare())
+    }
+    if got := a.Bare().Full(); got != "user@alumchat.lol" {
+        t.Fatalf("Bare().Full() = %q", got)
+    }
+}
+
+func TestEscape(t *testing.T) {
+    tests := []struct {
+        raw     string
+        escaped string
+    }{
+        {"space cadet", `space\20cadet`},
+        {"d'artagnan", `d\27artagnan`},
+        {"user@example.com", `user\40example.com`},
+        {`c:\net`, `c\3a\net`},
+        {`c:\5commas`, `c\3a\5c5commas`},
+    }
+    for _, tt := range tests {
+        if got := Escape(tt.raw); got != tt.escaped {
+            t.Errorf("Escape(%q) = %q, want %q", tt.raw, got, tt.escaped)
+        }
+        if got := Unescape(tt.escaped); got != tt.raw {
+            t.Errorf("Unescape(%q) = %q, want %q", tt.escaped, got, tt.raw)
+        }
+        if _, err := New(Escape(tt.raw), "alumchat.lol", ""); err != nil {
+            t.Errorf("escaped %q is not a valid localpart: %v", tt.raw, err)
+        }
+    }
+}
+
+func TestXMLAttr(t *testing.T) {
+    type stanza struct {
+        XMLName xml.Name `xml:"message"`
+        To      JID      `xml:"to,attr"`
+        From    JID      `xml:"from,attr"`
+    }
+    out, err := xml.Marshal(stanza{To: MustParse("a@b.c/d")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(out) != `<message to="a@b.c/d"></message>` {
+        t.Fatalf("unexpected XML %s", out)
+    }
+
+    var in stanza
+    if err := xml.Unmarshal([]byte(`<message from="A@B.C/d"/>`), &in); err != nil {
+        t.Fatal(err)
+    }
+    if in.From != MustParse("a@b.c/d") || !in.To.IsZero() {
+        t.Fatalf("unexpected JIDs %v %v", in.From, in.To)
+    }
+}
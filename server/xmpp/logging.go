@@ -0,0 +1,141 @@
+package xmpp
+
+import (
+    "bytes"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "log/slog"
+    "strings"
+    "sync/atomic"
+)
+
+var (
+    packageLogger atomic.Pointer[slog.Logger]
+    debugMode     atomic.Bool
+)
+
+// SetLogger sets the logger used by the package. Until it is called, records
+// go to slog.Default(). Passing nil restores that default.
+func SetLogger(l *slog.Logger) {
+    packageLogger.Store(l)
+}
+
+// SetDebug turns debug mode on or off. Passwords, SASL payloads and message
+// bodies are only written to the logs in debug mode.
+func SetDebug(on bool) {
+    debugMode.Store(on)
+}
+
+// DebugEnabled reports whether debug mode is on.
+func DebugEnabled() bool {
+    return debugMode.Load()
+}
+
+// Logger returns the package logger tagged with a subsystem attribute, such
+// as "conn", "auth" or "roster".
+func Logger(subsystem string) *slog.Logger {
+    l := packageLogger.Load()
+    if l == nil {
+        l = slog.Default()
+    }
+    return l.With("subsystem", subsystem)
+}
+
+const redacted = "[redacted]"
+
+// Secret is a log value that must not appear in the logs, such as a password
+// or a message body. It is written as "[redacted]" unless debug mode is on.
+type Secret string
+
+// LogValue implements slog.LogValuer.
+func (s Secret) LogValue() slog.Value {
+    if DebugEnabled() {
+        return slog.StringValue(string(s))
+    }
+    return slog.StringValue(redacted)
+}
+
+// WireXML is XML read from or written to the stream. Unless debug mode is on,
+// it is logged with the text of SASL elements, passwords, private form fields
+// and message bodies redacted.
+type WireXML string
+
+// LogValue implements slog.LogValuer.
+func (x WireXML) LogValue() slog.Value {
+    if DebugEnabled() {
+        return slog.StringValue(string(x))
+    }
+    return slog.StringValue(redactXML(string(x)))
+}
+
+// secretElements are the elements whose text is never logged outside debug mode.
+var secretElements = map[string]bool{
+    "auth":         true, // SASL
+    "response":     true,
+    "challenge":    true,
+    "success":      true,
+    "password":     true, // jabber:iq:register
+    "old_password": true,
+    "body":         true,
+}
+
+// secretFields are the data form fields whose values are never logged.
+var secretFields = map[string]bool{
+    "password":     true,
+    "old_password": true,
+}
+
+// redactXML replaces the text inside secret elements. The data doesn't have
+// to be a complete document, since it is usually whatever a single read
+// returned; anything that can't be tokenized is left out.
+func redactXML(data string) string {
+    type frame struct {
+        secret       bool // the text of this element is secret
+        secretValues bool // a form field whose <value/> children are secret
+    }
+    var (
+        out   strings.Builder
+        stack []frame
+        last  int64
+    )
+    d := xml.NewDecoder(strings.NewReader(data))
+    for {
+        tok, err := d.RawToken()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            if rest := int64(len(data)) - last; rest > 0 {
+                fmt.Fprintf(&out, "[%d bytes not shown]", rest)
+            }
+            break
+        }
+        raw := data[last:d.InputOffset()]
+        last = d.InputOffset()
+
+        var parent frame
+        if len(stack) > 0 {
+            parent = stack[len(stack)-1]
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            f := frame{secret: parent.secret || secretElements[t.Name.Local] ||
+                (parent.secretValues && t.Name.Local == "value")}
+            if t.Name.Local == "field" {
+                f.secretValues = secretFields[attrValue(t, "var")] || attrValue(t, "type") == "text-private"
+            }
+            stack = append(stack, f)
+        case xml.EndElement:
+            if len(stack) > 0 {
+                stack = stack[:len(stack)-1]
+            }
+        case xml.CharData:
+            if parent.secret && len(bytes.TrimSpace(t)) > 0 {
+                raw = redacted
+            }
+        }
+        out.WriteString(raw)
+    }
+    return out.String()
+}
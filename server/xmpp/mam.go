@@ -0,0 +1,379 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+const (
+    nsMAM = "urn:xmpp:mam:2"
+    nsSID = "urn:xmpp:sid:0"
+)
+
+// archivePageSize is how many messages are asked of the archive at a time.
+const archivePageSize = 50
+
+// RSMSet is a result set page (XEP-0059): the request of one in a query, or
+// the description of the one returned. An empty Before asks for the last
+// page.
+type RSMSet struct {
+    XMLName xml.Name `xml:"http://jabber.org/protocol/rsm set"`
+    Max     int      `xml:"max,omitempty"`
+    After   *string  `xml:"after"`
+    Before  *string  `xml:"before"`
+    First   string   `xml:"first,omitempty"`
+    Last    string   `xml:"last,omitempty"`
+    Count   int      `xml:"count,omitempty"`
+}
+
+// MAMQuery asks the server for the messages of our archive (XEP-0313). The
+// results arrive as messages tagged with QueryID, before the answer to the
+// query.
+type MAMQuery struct {
+    XMLName xml.Name  `xml:"urn:xmpp:mam:2 query"`
+    QueryID string    `xml:"queryid,attr,omitempty"`
+    Form    *DataForm `xml:"jabber:x:data x"`
+    Set     *RSMSet   `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+// MAMResult is an archived message, as the server sends it for a query.
+type MAMResult struct {
+    XMLName   xml.Name  `xml:"urn:xmpp:mam:2 result"`
+    QueryID   string    `xml:"queryid,attr,omitempty"`
+    ID        string    `xml:"id,attr"`
+    Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// MAMFin ends the results of a query, telling which page was returned.
+type MAMFin struct {
+    XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+    Complete bool     `xml:"complete,attr,omitempty"`
+    Set      RSMSet   `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+// StanzaID is the ID an entity gave a message it archived (XEP-0359).
+type StanzaID struct {
+    XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+    By      jid.JID  `xml:"by,attr"`
+    ID      string   `xml:"id,attr"`
+}
+
+func init() {
+    RegisterExtension(nsMAM, "result", MAMResult{})
+    RegisterExtension(nsSID, "stanza-id", StanzaID{})
+}
+
+// ArchiveQuery selects messages of the archive. The zero ArchiveQuery asks
+// for the oldest page of all the conversations.
+type ArchiveQuery struct {
+    With   jid.JID   // only the conversation with this contact
+    Start  time.Time // only the messages sent since
+    After  string    // the page after the message with this archive ID
+    Before string    // the page before the message with this archive ID
+    Latest bool      // the last page, when Before is empty
+    Max    int       // messages per page; zero is archivePageSize
+}
+
+// ArchivedMessage is a message of the archive.
+type ArchivedMessage struct {
+    ArchiveID string
+    Message   *Message
+    Time      time.Time // when it was archived
+}
+
+// ArchivePage is a page of archived messages, oldest first. First and Last
+// are the archive IDs to page from; Complete is set when there are no more
+// pages in the direction asked.
+type ArchivePage struct {
+    Messages []ArchivedMessage
+    First    string
+    Last     string
+    Complete bool
+}
+
+// ArchiveSyncEvent is emitted when catching up with the archive added
+// messages to the history.
+type ArchiveSyncEvent struct {
+    Contacts []jid.JID // bare JIDs of the conversations that changed
+    Added    int
+}
+
+func (*ArchiveSyncEvent) isEvent() {}
+
+// archiveState holds the queries waiting for their results.
+type archiveState struct {
+    mu      sync.Mutex
+    queries map[string][]ArchivedMessage // results by query ID
+    syncs   int                          // syncs running
+    write   sync.Mutex                   // makes checking and adding to the history one step
+}
+
+// QueryArchive returns a page of the messages the server archived for us.
+func (h *XMPPHandler) QueryArchive(q ArchiveQuery) (*ArchivePage, error) {
+    form := &DataForm{Type: "submit", Fields: []FormField{{Var: "FORM_TYPE", Type: "hidden", Values: []string{nsMAM}}}}
+    if !q.With.IsZero() {
+        form.Fields = append(form.Fields, FormField{Var: "with", Values: []string{q.With.Bare().String()}})
+    }
+    if !q.Start.IsZero() {
+        form.Fields = append(form.Fields, FormField{Var: "start", Values: []string{q.Start.UTC().Format(time.RFC3339)}})
+    }
+    set := &RSMSet{Max: q.Max}
+    if set.Max <= 0 {
+        set.Max = archivePageSize
+    }
+    if q.After != "" {
+        set.After = &q.After
+    }
+    if q.Before != "" || q.Latest {
+        set.Before = &q.Before
+    }
+
+    queryID := newMessageID()
+    h.archive.mu.Lock()
+    if h.archive.queries == nil {
+        h.archive.queries = make(map[string][]ArchivedMessage)
+    }
+    h.archive.queries[queryID] = nil
+    h.archive.mu.Unlock()
+    defer func() {
+        h.archive.mu.Lock()
+        delete(h.archive.queries, queryID)
+        h.archive.mu.Unlock()
+    }()
+
+    request := NewIQ("set", "")
+    request.SetQuery(&MAMQuery{QueryID: queryID, Form: form, Set: set})
+    response, err := h.SendIQ(request)
+    if err != nil {
+        return nil, fmt.Errorf("failed to query the archive: %w", err)
+    }
+    if response.Type == "error" {
+        if response.Error != nil {
+            return nil, fmt.Errorf("failed to query the archive: %w", response.Error)
+        }
+        return nil, errors.New("failed to query the archive: request refused")
+    }
+    var fin MAMFin
+    if err := response.DecodePayload(&fin); err != nil {
+        return nil, fmt.Errorf("invalid archive response: %v", err)
+    }
+
+    // The results came before the answer, on the same stream.
+    h.archive.mu.Lock()
+    page := &ArchivePage{
+        Messages: h.archive.queries[queryID],
+        First:    fin.Set.First,
+        Last:     fin.Set.Last,
+        Complete: fin.Complete,
+    }
+    h.archive.mu.Unlock()
+    Logger("history").Debug("archive page", "with", q.With, "messages", len(page.Messages), "complete", page.Complete)
+    return page, nil
+}
+
+// handleArchiveResult collects an archived message for the query waiting for
+// it. It reports whether msg was one. Results can only come from our own
+// account; anybody else could use them to forge messages.
+func (h *XMPPHandler) handleArchiveResult(msg *Message) bool {
+    var result MAMResult
+    if found, err := msg.Extensions.Get(&result); !found || err != nil {
+        return false
+    }
+    if !h.isOwnAccount(msg.From) {
+        Logger("message").Warn("dropping archived message from an unexpected sender", "from", msg.From)
+        return true
+    }
+    inner := result.Forwarded.Message
+    if inner == nil {
+        return true
+    }
+    archived := ArchivedMessage{ArchiveID: result.ID, Message: inner, Time: inner.SentAt()}
+    if delay := result.Forwarded.Delay; delay != nil && !delay.Stamp.IsZero() {
+        archived.Time = delay.Stamp.UTC()
+    }
+
+    h.archive.mu.Lock()
+    defer h.archive.mu.Unlock()
+    results, ok := h.archive.queries[result.QueryID]
+    if !ok {
+        Logger("history").Debug("dropping archived message of an unknown query", "queryid", result.QueryID)
+        return true
+    }
+    h.archive.queries[result.QueryID] = append(results, archived)
+    return true
+}
+
+// archiveID returns the ID our server gave an incoming message in the
+// archive, if it stamped one.
+func (h *XMPPHandler) archiveID(msg *Message) string {
+    for _, ext := range msg.Extensions {
+        if ext.XMLName.Space != nsSID || ext.XMLName.Local != "stanza-id" {
+            continue
+        }
+        var sid StanzaID
+        if ext.Decode(&sid) == nil && sid.ID != "" && sid.By == h.JID.Bare() {
+            return sid.ID
+        }
+    }
+    return ""
+}
+
+// archiveSyncing reports whether messages are being synced from the archive.
+func (h *XMPPHandler) archiveSyncing() bool {
+    h.archive.mu.Lock()
+    defer h.archive.mu.Unlock()
+    return h.archive.syncs > 0
+}
+
+// startSync marks a sync as running until the returned function is called.
+func (h *XMPPHandler) startSync() (done func()) {
+    h.archive.mu.Lock()
+    h.archive.syncs++
+    h.archive.mu.Unlock()
+    return func() {
+        h.archive.mu.Lock()
+        h.archive.syncs--
+        h.archive.mu.Unlock()
+    }
+}
+
+// markArchive remembers the last message synced with the archive.
+func (h *XMPPHandler) markArchive(archiveID string) {
+    if err := h.historyStore().SetArchiveMark(archiveID); err != nil {
+        Logger("history").Warn("failed to record the archive mark", "err", err)
+    }
+}
+
+// addToHistory records a message unless the history holds it already, and
+// reports whether it was added.
+func (h *XMPPHandler) addToHistory(record HistoryRecord) (bool, error) {
+    h.archive.write.Lock()
+    defer h.archive.write.Unlock()
+    store := h.historyStore()
+    index, err := store.Index(record.Contact)
+    if err != nil || index.Holds(record.ID, record.ArchiveID) {
+        return false, err
+    }
+    return true, store.AppendMessage(record)
+}
+
+// addArchived adds a page of archived messages to the history, leaving out
+// those it holds already. Each conversation is indexed once for the page.
+// It returns the conversations that changed and how many messages were
+// added.
+func (h *XMPPHandler) addArchived(messages []ArchivedMessage) (changed []jid.JID, added int, err error) {
+    h.archive.write.Lock()
+    defer h.archive.write.Unlock()
+    store := h.historyStore()
+    indexes := make(map[jid.JID]*HistoryIndex)
+    seen := make(map[jid.JID]bool)
+    for _, archived := range messages {
+        dir, state := Inbound, MessageReceived
+        if h.isOwnAccount(archived.Message.From) {
+            dir, state = Outbound, MessageSent
+        }
+        record, ok := historyRecord(archived.Message, dir, state)
+        if !ok {
+            continue
+        }
+        record.ArchiveID = archived.ArchiveID
+        record.Time = archived.Time
+        record.Archived = true
+
+        index, ok := indexes[record.Contact]
+        if !ok {
+            if index, err = store.Index(record.Contact); err != nil {
+                return changed, added, err
+            }
+            indexes[record.Contact] = index
+        }
+        if index.Holds(record.ID, record.ArchiveID) {
+            continue
+        }
+        if err := store.AppendMessage(record); err != nil {
+            return changed, added, err
+        }
+        index.Add(record)
+        added++
+        if !seen[record.Contact] {
+            seen[record.Contact] = true
+            changed = append(changed, record.Contact)
+        }
+    }
+    return changed, added, nil
+}
+
+// BackfillConversation fetches the page of the conversation with a contact
+// that ends before the message with the archive ID before, or the last page
+// if before is empty, and adds to the history the messages it misses. The
+// First of the page returned is where to back-fill from next.
+func (h *XMPPHandler) BackfillConversation(contact jid.JID, before string) (page *ArchivePage, added int, err error) {
+    defer h.startSync()()
+    page, err = h.QueryArchive(ArchiveQuery{With: contact.Bare(), Before: before, Latest: true})
+    if err != nil {
+        return nil, 0, err
+    }
+    if _, added, err = h.addArchived(page.Messages); err != nil {
+        return page, added, err
+    }
+    Logger("history").Info("back-filled conversation", "with", contact.Bare(), "added", added)
+    return page, added, nil
+}
+
+// CatchUp adds to the history the messages archived since the last one
+// synced, a page at a time, and emits an ArchiveSyncEvent if there were any.
+// The first time, only the last page is fetched. A mark the server no longer
+// knows starts over from the last page.
+func (h *XMPPHandler) CatchUp() error {
+    defer h.startSync()()
+    mark, err := h.historyStore().ArchiveMark()
+    if err != nil {
+        return err
+    }
+
+    changed := make(map[jid.JID]bool)
+    event := &ArchiveSyncEvent{}
+    q := ArchiveQuery{After: mark, Latest: mark == ""}
+    for {
+        page, err := h.QueryArchive(q)
+        var stanzaErr *StanzaError
+        if q.After != "" && errors.As(err, &stanzaErr) && stanzaErr.Condition == "item-not-found" {
+            Logger("history").Info("archive mark expired, fetching the last page", "mark", q.After)
+            q = ArchiveQuery{Latest: true}
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        contacts, added, err := h.addArchived(page.Messages)
+        if err != nil {
+            return err
+        }
+        event.Added += added
+        for _, contact := range contacts {
+            if !changed[contact] {
+                changed[contact] = true
+                event.Contacts = append(event.Contacts, contact)
+            }
+        }
+        if page.Last != "" {
+            h.markArchive(page.Last)
+        }
+        // The last page is as far as there is to go.
+        if q.Latest || page.Complete || page.Last == "" || page.Last == q.After {
+            break
+        }
+        q = ArchiveQuery{After: page.Last}
+    }
+
+    Logger("history").Info("caught up with the archive", "added", event.Added)
+    if event.Added > 0 {
+        h.emit(event)
+    }
+    return nil
+}
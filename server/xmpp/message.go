@@ -2,21 +2,25 @@ package xmpp
 
 import (
     "encoding/xml"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
 )
 
 // Message represents an XMPP message stanza.
 type Message struct {
     XMLName xml.Name `xml:"message"`
-    To      string   `xml:"to,attr,omitempty"`
-    From    string   `xml:"from,attr,omitempty"`
+    To      jid.JID  `xml:"to,attr"`
+    From    jid.JID  `xml:"from,attr"`
+    ID      string   `xml:"id,attr,omitempty"`
     Type    string   `xml:"type,attr,omitempty"`
     Body    string   `xml:"body,omitempty"`
     Subject string   `xml:"subject,omitempty"`
     Thread  string   `xml:"thread,omitempty"`
+    Extensions Extensions `xml:",any"` // receipts, chat states, delays, ...
 }
 
 // NewMessage creates a new message with the specified type, recipient, and body.
-func NewMessage(to, msgType, body string) *Message {
+func NewMessage(to jid.JID, msgType, body string) *Message {
     return &Message{
         To:   to,
         Type: msgType,
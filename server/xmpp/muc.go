@@ -0,0 +1,16 @@
+package xmpp
+
+import (
+    "encoding/xml"
+)
+
+// MUCJoin is the XEP-0045 <x xmlns='http://jabber.org/protocol/muc'/> element
+// sent in the presence that joins a room.
+type MUCJoin struct {
+    XMLName  xml.Name `xml:"http://jabber.org/protocol/muc x"`
+    Password string   `xml:"password,omitempty"`
+}
+
+func init() {
+    RegisterExtension("http://jabber.org/protocol/muc", "x", MUCJoin{})
+}
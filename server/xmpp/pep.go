@@ -0,0 +1,191 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "fmt"
+    "sync"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+const (
+    nsPubSub      = "http://jabber.org/protocol/pubsub"
+    nsPubSubEvent = "http://jabber.org/protocol/pubsub#event"
+)
+
+// PubSub is the publish request of XEP-0060, which PEP (XEP-0163) uses to
+// publish to the nodes of our own account.
+type PubSub struct {
+    XMLName xml.Name       `xml:"http://jabber.org/protocol/pubsub pubsub"`
+    Publish *PubSubPublish `xml:"publish"`
+}
+
+type PubSubPublish struct {
+    Node  string       `xml:"node,attr"`
+    Items []PubSubItem `xml:"item"`
+}
+
+// PubSubItem is an item of a node. Payload holds its single child element.
+type PubSubItem struct {
+    ID      string     `xml:"id,attr,omitempty"`
+    Payload Extensions `xml:",any"`
+}
+
+// PubSubEvent is the notification the server sends in a message when an
+// item of a node we are interested in is published or retracted.
+type PubSubEvent struct {
+    XMLName xml.Name         `xml:"http://jabber.org/protocol/pubsub#event event"`
+    Items   PubSubEventItems `xml:"items"`
+}
+
+type PubSubEventItems struct {
+    Node     string          `xml:"node,attr"`
+    Items    []PubSubItem    `xml:"item"`
+    Retracts []PubSubRetract `xml:"retract"`
+}
+
+type PubSubRetract struct {
+    ID string `xml:"id,attr"`
+}
+
+func init() {
+    RegisterExtension(nsPubSubEvent, "event", PubSubEvent{})
+}
+
+// PEPEvent is emitted when a contact, or another client of ours, publishes
+// an item to a PEP node we asked to be notified about. Payload is the zero
+// Extension when the item was retracted.
+type PEPEvent struct {
+    From    jid.JID // bare JID of the publisher
+    Node    string
+    ItemID  string
+    Payload Extension
+}
+
+func (*PEPEvent) isEvent() {}
+
+// pepState holds the last item of each node of each contact.
+type pepState struct {
+    mu    sync.Mutex
+    items map[jid.JID]map[string]PubSubItem // keyed by bare JID, then node
+}
+
+// Notify asks for the items contacts publish to a PEP node, or stops asking.
+// The interest is advertised as a "+notify" feature in our caps, so our
+// presence is sent again to let the server know.
+func (h *XMPPHandler) Notify(node string, on bool) error {
+    h.features.mu.Lock()
+    if h.features.notify == nil {
+        h.features.notify = make(map[string]bool)
+    }
+    changed := h.features.notify[node] != on
+    if on {
+        h.features.notify[node] = true
+    } else {
+        delete(h.features.notify, node)
+    }
+    h.features.mu.Unlock()
+
+    if !changed {
+        return nil
+    }
+    if own, ok := h.OwnPresence(); ok && own.IsAvailable() {
+        return h.SendPresence(own)
+    }
+    return nil
+}
+
+// notifying reports whether we asked for the items of a node.
+func (h *XMPPHandler) notifying(node string) bool {
+    h.features.mu.Lock()
+    defer h.features.mu.Unlock()
+    return h.features.notify[node]
+}
+
+// Publish publishes payload as the item itemID of one of our PEP nodes,
+// which the server creates if needed. Contacts that share our presence and
+// asked to be notified receive it.
+func (h *XMPPHandler) Publish(node, itemID string, payload interface{}) error {
+    ext, err := NewExtension(payload)
+    if err != nil {
+        return err
+    }
+    request := NewIQ("set", "")
+    request.SetQuery(&PubSub{Publish: &PubSubPublish{
+        Node:  node,
+        Items: []PubSubItem{{ID: itemID, Payload: Extensions{ext}}},
+    }})
+    response, err := h.SendIQ(request)
+    if err != nil {
+        return fmt.Errorf("failed to publish to %s: %w", node, err)
+    }
+    if response.Type == "error" {
+        if response.Error != nil {
+            return fmt.Errorf("failed to publish to %s: %w", node, response.Error)
+        }
+        return fmt.Errorf("failed to publish to %s: request refused", node)
+    }
+    Logger("pep").Debug("published", "node", node, "id", itemID)
+    return nil
+}
+
+// PEPItem returns the last item a contact published to a node, if we were
+// notified of it.
+func (h *XMPPHandler) PEPItem(contact jid.JID, node string) (Extension, bool) {
+    h.pep.mu.Lock()
+    defer h.pep.mu.Unlock()
+    item, ok := h.pep.items[contact.Bare()][node]
+    if !ok || len(item.Payload) == 0 {
+        return Extension{}, false
+    }
+    return item.Payload[0], true
+}
+
+// handlePEPEvent stores and reports the items of a pubsub event message. It
+// reports whether msg was one.
+func (h *XMPPHandler) handlePEPEvent(msg *Message) bool {
+    var event PubSubEvent
+    if found, err := msg.Extensions.Get(&event); !found || err != nil {
+        return false
+    }
+    from := msg.From.Bare()
+    if from.IsZero() {
+        // Events about our own nodes may come without a sender.
+        from = h.JID.Bare()
+    }
+    node := event.Items.Node
+    if !h.notifying(node) {
+        Logger("pep").Debug("ignoring event for a node we didn't ask for", "node", node, "from", from)
+        return true
+    }
+
+    var events []*PEPEvent
+    h.pep.mu.Lock()
+    if h.pep.items == nil {
+        h.pep.items = make(map[jid.JID]map[string]PubSubItem)
+    }
+    if h.pep.items[from] == nil {
+        h.pep.items[from] = make(map[string]PubSubItem)
+    }
+    for _, retract := range event.Items.Retracts {
+        if h.pep.items[from][node].ID == retract.ID {
+            delete(h.pep.items[from], node)
+        }
+        events = append(events, &PEPEvent{From: from, Node: node, ItemID: retract.ID})
+    }
+    for _, item := range event.Items.Items {
+        h.pep.items[from][node] = item
+        ev := &PEPEvent{From: from, Node: node, ItemID: item.ID}
+        if len(item.Payload) > 0 {
+            ev.Payload = item.Payload[0]
+        }
+        events = append(events, ev)
+    }
+    h.pep.mu.Unlock()
+
+    for _, ev := range events {
+        Logger("pep").Debug("received event", "from", ev.From, "node", ev.Node, "id", ev.ItemID)
+        h.emit(ev)
+    }
+    return true
+}
@@ -2,21 +2,94 @@ package xmpp
 
 import (
     "encoding/xml"
+    "errors"
+    "fmt"
+    "strings"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// Show is the availability of an available presence (RFC 6121 §4.7.2.1).
+type Show string
+
+const (
+    ShowAvailable Show = ""     // available, without <show/>
+    ShowChat      Show = "chat" // free for chat
+    ShowAway      Show = "away"
+    ShowXA        Show = "xa"  // extended away
+    ShowDND       Show = "dnd" // do not disturb
 )
 
+// Shows lists the values of Show, from the most to the least available.
+var Shows = []Show{ShowChat, ShowAvailable, ShowAway, ShowXA, ShowDND}
+
+// Valid reports whether s is one of the values RFC 6121 defines.
+func (s Show) Valid() bool {
+    switch s {
+    case ShowAvailable, ShowChat, ShowAway, ShowXA, ShowDND:
+        return true
+    }
+    return false
+}
+
+// String returns the value of <show/>, or "available" for ShowAvailable.
+func (s Show) String() string {
+    if s == ShowAvailable {
+        return "available"
+    }
+    return string(s)
+}
+
+// ParseShow parses a value of <show/>. It also accepts "available" and
+// "online" for ShowAvailable.
+func ParseShow(text string) (Show, error) {
+    switch text = strings.ToLower(strings.TrimSpace(text)); text {
+    case "available", "online":
+        return ShowAvailable, nil
+    }
+    if show := Show(text); show.Valid() {
+        return show, nil
+    }
+    return "", fmt.Errorf("invalid presence show %q", text)
+}
+
+// LangText is a text together with the language it is written in (xml:lang).
+type LangText struct {
+    Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+    Text string `xml:",chardata"`
+}
+
 // Presence represents an XMPP presence stanza.
+//
+// Status is the status message in the default language of the stream.
+// Statuses holds translations of it, each with its xml:lang; SetStatus and
+// StatusIn keep both consistent.
 type Presence struct {
-    XMLName  xml.Name `xml:"presence"`
-    From     string   `xml:"from,attr,omitempty"`
-    To       string   `xml:"to,attr,omitempty"`
-    Type     string   `xml:"type,attr,omitempty"` // "available", "unavailable", "subscribe", etc.
-    Show     string   `xml:"show,omitempty"`      // "chat", "away", "dnd", "xa" (extended away)
-    Status   string   `xml:"status,omitempty"`    // User-defined status message
-    Priority int      `xml:"priority,omitempty"`  // Priority level (-128 to +127)
+    XMLName    xml.Name   `xml:"presence"`
+    From       jid.JID    `xml:"from,attr"`
+    To         jid.JID    `xml:"to,attr"`
+    Type       string     `xml:"type,attr,omitempty"` // "", "unavailable", "subscribe", etc.
+    Show       Show       `xml:"show,omitempty"`
+    Status     string     `xml:"-"`
+    Statuses   []LangText `xml:"-"`
+    Priority   int        `xml:"priority,omitempty"` // -128 to +127
+    Extensions Extensions `xml:",any"`               // caps, vCard updates, MUC, ...
+}
+
+// presenceTypes are the values of the type attribute (RFC 6121 §4.7.1).
+var presenceTypes = map[string]bool{
+    "":             true,
+    "unavailable":  true,
+    "subscribe":    true,
+    "subscribed":   true,
+    "unsubscribe":  true,
+    "unsubscribed": true,
+    "probe":        true,
+    "error":        true,
 }
 
 // NewPresence creates a new presence stanza with the specified parameters.
-func NewPresence(to, presenceType, show, status string, priority int) *Presence {
+func NewPresence(to jid.JID, presenceType string, show Show, status string, priority int) *Presence {
     return &Presence{
         To:       to,
         Type:     presenceType,
@@ -26,6 +99,137 @@ func NewPresence(to, presenceType, show, status string, priority int) *Presence
     }
 }
 
+// Validate checks the presence against RFC 6121 before it is sent.
+func (p *Presence) Validate() error {
+    if !presenceTypes[p.Type] {
+        return fmt.Errorf("invalid presence type %q", p.Type)
+    }
+    if !p.Show.Valid() {
+        return fmt.Errorf("invalid presence show %q", string(p.Show))
+    }
+    if p.Show != ShowAvailable && p.Type != "" {
+        return fmt.Errorf("<show/> is only allowed in available presence, not %q", p.Type)
+    }
+    if p.Priority < -128 || p.Priority > 127 {
+        return fmt.Errorf("presence priority %d is not between -128 and 127", p.Priority)
+    }
+    langs := make(map[string]bool)
+    for _, status := range p.Statuses {
+        if status.Lang == "" {
+            return errors.New("translated status without xml:lang")
+        }
+        if langs[status.Lang] {
+            return fmt.Errorf("more than one status in %q", status.Lang)
+        }
+        langs[status.Lang] = true
+    }
+    return nil
+}
+
+// SetStatus sets the status message in a language, or the default one if
+// lang is empty. An empty text removes it.
+func (p *Presence) SetStatus(lang, text string) {
+    if lang == "" {
+        p.Status = text
+        return
+    }
+    statuses := p.Statuses[:0:0]
+    for _, status := range p.Statuses {
+        if status.Lang != lang {
+            statuses = append(statuses, status)
+        }
+    }
+    if text != "" {
+        statuses = append(statuses, LangText{Lang: lang, Text: text})
+    }
+    p.Statuses = statuses
+}
+
+// StatusIn returns the status message for a language: the exact match, one
+// for the same primary language ("en" for "en-US"), or else the default.
+func (p *Presence) StatusIn(lang string) string {
+    primary, _, _ := strings.Cut(lang, "-")
+    fallback, matched := p.Status, false
+    for _, status := range p.Statuses {
+        if strings.EqualFold(status.Lang, lang) {
+            return status.Text
+        }
+        if statusPrimary, _, _ := strings.Cut(status.Lang, "-"); !matched && strings.EqualFold(statusPrimary, primary) {
+            fallback, matched = status.Text, true
+        }
+    }
+    return fallback
+}
+
+// presenceWire is how a Presence is written: every <status/> is one element.
+type presenceWire struct {
+    XMLName    xml.Name   `xml:"presence"`
+    From       jid.JID    `xml:"from,attr"`
+    To         jid.JID    `xml:"to,attr"`
+    Type       string     `xml:"type,attr,omitempty"`
+    Show       Show       `xml:"show,omitempty"`
+    Statuses   []LangText `xml:"status"`
+    Priority   int        `xml:"priority,omitempty"`
+    Extensions Extensions `xml:",any"`
+}
+
+// MarshalXML writes the default status and its translations as <status/>
+// elements. The default is written even if a translation has the same text,
+// for the receivers whose language none of them matches.
+func (p Presence) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+    wire := presenceWire{
+        XMLName:    p.XMLName,
+        From:       p.From,
+        To:         p.To,
+        Type:       p.Type,
+        Show:       p.Show,
+        Priority:   p.Priority,
+        Extensions: p.Extensions,
+    }
+    if wire.XMLName.Local == "" {
+        wire.XMLName.Local = "presence"
+    }
+    if p.Status != "" {
+        wire.Statuses = append(wire.Statuses, LangText{Text: p.Status})
+    }
+    for _, status := range p.Statuses {
+        if status.Lang != "" {
+            wire.Statuses = append(wire.Statuses, status)
+        }
+    }
+    return enc.Encode(wire)
+}
+
+// UnmarshalXML reads the <status/> elements into Status and Statuses. The
+// one without xml:lang is the default status; if all of them have one, the
+// first is.
+func (p *Presence) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var wire presenceWire
+    if err := d.DecodeElement(&wire, &start); err != nil {
+        return err
+    }
+    *p = Presence{
+        XMLName:    wire.XMLName,
+        From:       wire.From,
+        To:         wire.To,
+        Type:       wire.Type,
+        Show:       wire.Show,
+        Priority:   wire.Priority,
+        Extensions: wire.Extensions,
+    }
+    for _, status := range wire.Statuses {
+        if status.Lang == "" {
+            p.Status = status.Text
+        } else {
+            p.Statuses = append(p.Statuses, status)
+        }
+    }
+    if p.Status == "" && len(p.Statuses) > 0 {
+        p.Status = p.Statuses[0].Text
+    }
+    return nil
+}
+
 // ToXML converts the Presence struct to an XML string.
 func (p *Presence) ToXML() (string, error) {
     output, err := xml.Marshal(p)
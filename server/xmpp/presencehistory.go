@@ -0,0 +1,257 @@
+package xmpp
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// PresenceRecord is a presence change of a contact, as kept in the presence
+// history.
+type PresenceRecord struct {
+    Time     time.Time `json:"time"`
+    From     jid.JID   `json:"from"` // full JID of the resource, or the bare JID
+    Type     string    `json:"type,omitempty"` // "" or "unavailable"
+    Show     Show      `json:"show,omitempty"`
+    Status   string    `json:"status,omitempty"`
+    Priority int       `json:"priority,omitempty"`
+}
+
+// Available reports whether the record is an available presence.
+func (r PresenceRecord) Available() bool {
+    return r.Type == ""
+}
+
+// PresenceHistoryStore keeps the presence changes of the contacts between
+// sessions.
+type PresenceHistoryStore interface {
+    AppendPresence(contact jid.JID, record PresenceRecord) error
+    // PresenceHistory returns the last limit records of a contact, oldest
+    // first, or all of them if limit is zero.
+    PresenceHistory(contact jid.JID, limit int) ([]PresenceRecord, error)
+}
+
+// FilePresenceHistory stores the presence history of one account, one file
+// of JSON lines per contact.
+type FilePresenceHistory struct {
+    Dir string
+    mu  sync.Mutex
+}
+
+// NewFilePresenceHistory returns a store that keeps the presence history of
+// account in the user's cache directory.
+func NewFilePresenceHistory(account jid.JID) (*FilePresenceHistory, error) {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return nil, fmt.Errorf("no cache directory for the presence history: %v", err)
+    }
+    name := url.PathEscape(account.Bare().String())
+    return &FilePresenceHistory{Dir: filepath.Join(dir, "xmpp-client", "presence", name)}, nil
+}
+
+func (s *FilePresenceHistory) path(contact jid.JID) string {
+    return filepath.Join(s.Dir, url.PathEscape(contact.Bare().String())+".jsonl")
+}
+
+// AppendPresence adds a record at the end of the contact's file.
+func (s *FilePresenceHistory) AppendPresence(contact jid.JID, record PresenceRecord) error {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(s.path(contact), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// PresenceHistory reads the contact's file. A missing file is an empty
+// history, and a line cut short by a crash is skipped.
+func (s *FilePresenceHistory) PresenceHistory(contact jid.JID, limit int) ([]PresenceRecord, error) {
+    s.mu.Lock()
+    data, err := os.ReadFile(s.path(contact))
+    s.mu.Unlock()
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var records []PresenceRecord
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        var record PresenceRecord
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            Logger("presence").Warn("skipping corrupt presence record", "contact", contact, "err", err)
+            continue
+        }
+        records = append(records, record)
+    }
+    if limit > 0 && len(records) > limit {
+        records = records[len(records)-limit:]
+    }
+    return records, scanner.Err()
+}
+
+// presenceHistory records the presence changes of the contacts and when each
+// one was last seen online.
+type presenceHistory struct {
+    mu       sync.Mutex
+    store    PresenceHistoryStore
+    last     map[jid.JID]PresenceRecord // last record of each resource, to skip repeats
+    lastSeen map[jid.JID]time.Time      // keyed by bare JID
+}
+
+// UsePresenceHistory records the presence changes of the contacts in store.
+// Without a store, only the last seen times of the session are kept.
+func (h *XMPPHandler) UsePresenceHistory(store PresenceHistoryStore) {
+    h.history.mu.Lock()
+    defer h.history.mu.Unlock()
+    h.history.store = store
+}
+
+// recordPresence adds an available or unavailable presence to the history.
+// A presence that repeats the last one of its resource, as clients send
+// when only their capabilities change, is not recorded.
+func (h *XMPPHandler) recordPresence(pres *Presence) {
+    record := PresenceRecord{
+        Time:     time.Now().UTC(),
+        From:     pres.From,
+        Show:     pres.Show,
+        Status:   pres.Status,
+        Priority: pres.Priority,
+    }
+    if pres.IsUnavailable() {
+        record.Type = "unavailable"
+    }
+    contact := pres.From.Bare()
+
+    h.history.mu.Lock()
+    if h.history.last == nil {
+        h.history.last = make(map[jid.JID]PresenceRecord)
+    }
+    if h.history.lastSeen == nil {
+        h.history.lastSeen = make(map[jid.JID]time.Time)
+    }
+    previous, known := h.history.last[pres.From]
+    h.history.last[pres.From] = record
+    h.history.lastSeen[contact] = record.Time
+    store := h.history.store
+    h.history.mu.Unlock()
+
+    previous.Time = record.Time
+    if known && previous == record {
+        return
+    }
+    if store != nil {
+        if err := store.AppendPresence(contact, record); err != nil {
+            Logger("presence").Warn("failed to record presence", "from", pres.From, "err", err)
+        }
+    }
+}
+
+// PresenceHistory returns the last limit presence changes of a contact,
+// oldest first, or all of them if limit is zero.
+func (h *XMPPHandler) PresenceHistory(contact jid.JID, limit int) ([]PresenceRecord, error) {
+    h.history.mu.Lock()
+    store := h.history.store
+    h.history.mu.Unlock()
+    if store == nil {
+        return nil, nil
+    }
+    return store.PresenceHistory(contact.Bare(), limit)
+}
+
+// LastSeen returns the last time a contact was known to be online: the last
+// presence received from it, in this session or the history, or what a
+// last activity query answered.
+func (h *XMPPHandler) LastSeen(contact jid.JID) (time.Time, bool) {
+    contact = contact.Bare()
+    h.history.mu.Lock()
+    seen, ok := h.history.lastSeen[contact]
+    h.history.mu.Unlock()
+    if ok {
+        return seen, !seen.IsZero()
+    }
+
+    // Look in the history once; a zero time remembers that it has nothing.
+    records, err := h.PresenceHistory(contact, 1)
+    if err == nil && len(records) > 0 {
+        seen = records[0].Time
+    }
+    h.setLastSeen(contact, seen)
+    return seen, !seen.IsZero()
+}
+
+// setLastSeen records that a contact was online at seen, unless it is known
+// to have been online later.
+func (h *XMPPHandler) setLastSeen(contact jid.JID, seen time.Time) {
+    h.history.mu.Lock()
+    defer h.history.mu.Unlock()
+    if h.history.lastSeen == nil {
+        h.history.lastSeen = make(map[jid.JID]time.Time)
+    }
+    if previous, ok := h.history.lastSeen[contact]; !ok || seen.After(previous) {
+        h.history.lastSeen[contact] = seen
+    }
+}
+
+// LastActivity is the jabber:iq:last payload of XEP-0012. Asked to a bare
+// JID, Seconds is the time since the contact went offline and Status the
+// status it left with.
+type LastActivity struct {
+    XMLName xml.Name `xml:"jabber:iq:last query"`
+    Seconds int      `xml:"seconds,attr,omitempty"`
+    Status  string   `xml:",chardata"`
+}
+
+// QueryLastActivity asks the server when an offline contact was last online
+// (XEP-0012) and keeps the answer for LastSeen. The server only answers for
+// contacts that share their presence with us.
+func (h *XMPPHandler) QueryLastActivity(contact jid.JID) (time.Time, string, error) {
+    contact = contact.Bare()
+    request := NewIQ("get", "")
+    request.To = contact
+    request.SetQuery(&LastActivity{})
+    response, err := h.SendIQ(request)
+    if err != nil {
+        return time.Time{}, "", fmt.Errorf("failed to query last activity: %w", err)
+    }
+    if response.Type == "error" {
+        if response.Error != nil {
+            return time.Time{}, "", fmt.Errorf("failed to query last activity: %w", response.Error)
+        }
+        return time.Time{}, "", errors.New("failed to query last activity: request refused")
+    }
+
+    var last LastActivity
+    if err := response.DecodePayload(&last); err != nil {
+        return time.Time{}, "", fmt.Errorf("failed to parse last activity: %v", err)
+    }
+    seen := time.Now().Add(-time.Duration(last.Seconds) * time.Second).UTC().Truncate(time.Second)
+    h.setLastSeen(contact, seen)
+    Logger("presence").Debug("last activity received", "contact", contact, "seconds", last.Seconds)
+    return seen, last.Status, nil
+}
@@ -0,0 +1,230 @@
+package xmpp
+
+import (
+    "bytes"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Limits bounds what the stanza reader accepts from the server. A stanza that
+// breaks one of them ends the stream with a policy-violation stream error.
+// Zero fields take the value from DefaultLimits.
+type Limits struct {
+    MaxStanzaSize int // bytes of a top-level element, including its children
+    MaxDepth      int // nesting depth of elements, the stanza itself being 1
+    MaxAttrs      int // attributes of a single element
+    MaxTextLength int // bytes of a single attribute value or run of text
+}
+
+// DefaultLimits are generous enough for vCards with photos and large rosters.
+var DefaultLimits = Limits{
+    MaxStanzaSize: 1 << 20,
+    MaxDepth:      32,
+    MaxAttrs:      64,
+    MaxTextLength: 512 << 10,
+}
+
+func (l Limits) withDefaults() Limits {
+    if l.MaxStanzaSize <= 0 {
+        l.MaxStanzaSize = DefaultLimits.MaxStanzaSize
+    }
+    if l.MaxDepth <= 0 {
+        l.MaxDepth = DefaultLimits.MaxDepth
+    }
+    if l.MaxAttrs <= 0 {
+        l.MaxAttrs = DefaultLimits.MaxAttrs
+    }
+    if l.MaxTextLength <= 0 {
+        l.MaxTextLength = DefaultLimits.MaxTextLength
+    }
+    return l
+}
+
+// errStreamClosed is returned by the reader when the server closes the stream.
+var errStreamClosed = errors.New("the server closed the stream")
+
+// errTooLarge is returned by the capped reader when a stanza outgrows
+// MaxStanzaSize before the decoder finished a token.
+var errTooLarge = errors.New("stanza too large")
+
+// streamHeader opens the stream for the decoder. By the time the reader
+// starts, the server's own header has been consumed by the login exchanges,
+// so this one gives the stanzas their namespaces and matches the closing
+// </stream:stream>.
+const streamHeader = "<stream:stream xmlns='jabber:client' xmlns:stream='" + nsStream + "'>"
+
+// stanzaReader reads stanzas from the stream while enforcing Limits.
+type stanzaReader struct {
+    dec    *xml.Decoder
+    in     *cappedReader
+    limits Limits
+}
+
+func newStanzaReader(r io.Reader, limits Limits) *stanzaReader {
+    in := &cappedReader{r: io.MultiReader(strings.NewReader(streamHeader), r)}
+    return &stanzaReader{dec: xml.NewDecoder(in), in: in, limits: limits.withDefaults()}
+}
+
+// Next returns the next stanza. Stanzas that can't be decoded are returned
+// as a *RawStanza; a violation of the limits or of the restricted XML that
+// XMPP allows (RFC 6120 §11) is returned as a *StreamError to send back.
+func (sr *stanzaReader) Next() (Stanza, error) {
+    for {
+        begin := sr.dec.InputOffset()
+        sr.in.release(begin)
+        sr.in.limit = begin + int64(sr.limits.MaxStanzaSize)
+
+        tok, err := sr.token()
+        if err != nil {
+            return nil, err
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            if t.Name.Space == nsStream && t.Name.Local == "stream" {
+                // The header of a restarted stream.
+                continue
+            }
+            return sr.stanza(t, begin)
+        case xml.EndElement:
+            return nil, errStreamClosed
+        case xml.CharData:
+            if len(bytes.TrimSpace(t)) > 0 {
+                return nil, &StreamError{Condition: "bad-format", Text: "text outside of a stanza"}
+            }
+        }
+    }
+}
+
+// stanza reads the rest of the element started by start, checking every
+// token, and parses it from the bytes it was read from.
+func (sr *stanzaReader) stanza(start xml.StartElement, begin int64) (Stanza, error) {
+    if err := sr.checkElement(start, 1); err != nil {
+        return nil, err
+    }
+    for depth := 1; depth > 0; {
+        tok, err := sr.token()
+        if err != nil {
+            return nil, err
+        }
+        switch t := tok.(type) {
+        case xml.StartElement:
+            depth++
+            if err := sr.checkElement(t, depth); err != nil {
+                return nil, err
+            }
+        case xml.EndElement:
+            depth--
+        case xml.CharData:
+            if len(t) > sr.limits.MaxTextLength {
+                return nil, policyViolation("text longer than %d bytes", sr.limits.MaxTextLength)
+            }
+        case xml.ProcInst:
+            return nil, &StreamError{Condition: "restricted-xml", Text: "processing instructions are not allowed"}
+        }
+    }
+
+    data := sr.in.bytes(begin, sr.dec.InputOffset())
+    stanza, err := ParseStanza(data)
+    if err != nil {
+        Logger("session").Warn("failed to parse stanza", "element", start.Name.Local, "err", err)
+        return &RawStanza{Name: start.Name, Attr: start.Attr, Data: data}, nil
+    }
+    if raw, ok := stanza.(*RawStanza); ok {
+        // Outside the stream, prefixes such as stream: are not resolved.
+        raw.Name = start.Name
+    }
+    return stanza, nil
+}
+
+// token returns the next token, turning decoder failures and the XML that
+// XMPP forbids into stream errors.
+func (sr *stanzaReader) token() (xml.Token, error) {
+    tok, err := sr.dec.Token()
+    if errors.Is(err, errTooLarge) {
+        return nil, policyViolation("stanza larger than %d bytes", sr.limits.MaxStanzaSize)
+    }
+    var syntaxErr *xml.SyntaxError
+    if errors.As(err, &syntaxErr) {
+        if errors.Is(sr.in.err, io.EOF) {
+            return nil, io.ErrUnexpectedEOF
+        }
+        return nil, &StreamError{Condition: "not-well-formed", Text: syntaxErr.Msg}
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    switch t := tok.(type) {
+    case xml.Comment:
+        return nil, &StreamError{Condition: "restricted-xml", Text: "comments are not allowed"}
+    case xml.Directive:
+        return nil, &StreamError{Condition: "restricted-xml", Text: "DTDs are not allowed"}
+    case xml.ProcInst:
+        // Only the XML declaration of a restarted stream is allowed.
+        if t.Target != "xml" {
+            return nil, &StreamError{Condition: "restricted-xml", Text: "processing instructions are not allowed"}
+        }
+    }
+    return tok, nil
+}
+
+func (sr *stanzaReader) checkElement(se xml.StartElement, depth int) error {
+    if depth > sr.limits.MaxDepth {
+        return policyViolation("elements nested deeper than %d", sr.limits.MaxDepth)
+    }
+    if len(se.Attr) > sr.limits.MaxAttrs {
+        return policyViolation("more than %d attributes on <%s/>", sr.limits.MaxAttrs, se.Name.Local)
+    }
+    for _, attr := range se.Attr {
+        if len(attr.Value) > sr.limits.MaxTextLength {
+            return policyViolation("attribute longer than %d bytes", sr.limits.MaxTextLength)
+        }
+    }
+    return nil
+}
+
+func policyViolation(format string, args ...interface{}) *StreamError {
+    return &StreamError{Condition: "policy-violation", Text: fmt.Sprintf(format, args...)}
+}
+
+// cappedReader keeps the bytes the decoder reads until they are released, so
+// that a stanza can be parsed from its original bytes, and refuses to read
+// past limit, so that a single huge token can't exhaust memory.
+type cappedReader struct {
+    r     io.Reader
+    buf   []byte // bytes read and not released yet
+    base  int64  // stream offset of buf[0]
+    limit int64  // stream offset reads stop at
+    err   error  // last error of r
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+    end := c.base + int64(len(c.buf))
+    if end >= c.limit {
+        return 0, errTooLarge
+    }
+    if room := c.limit - end; int64(len(p)) > room {
+        p = p[:room]
+    }
+    n, err := c.r.Read(p)
+    c.buf = append(c.buf, p[:n]...)
+    c.err = err
+    return n, err
+}
+
+// bytes returns a copy of the stream between two offsets that were not released.
+func (c *cappedReader) bytes(from, to int64) []byte {
+    return append([]byte(nil), c.buf[from-c.base:to-c.base]...)
+}
+
+// release drops the bytes before offset.
+func (c *cappedReader) release(offset int64) {
+    if offset <= c.base {
+        return
+    }
+    c.buf = append(c.buf[:0], c.buf[offset-c.base:]...)
+    c.base = offset
+}
@@ -0,0 +1,304 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "strings"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+const nsRegister = "jabber:iq:register"
+
+// RegisterQuery is the XEP-0077 <query xmlns='jabber:iq:register'/> payload.
+// Servers either list the plain fields they want (username, password, email, ...)
+// or send a data form, which may carry a CAPTCHA (XEP-0158). A server that only
+// allows web registration answers with an out-of-band URL instead.
+type RegisterQuery struct {
+    XMLName      xml.Name        `xml:"jabber:iq:register query"`
+    Instructions string          `xml:"instructions,omitempty"`
+    Registered   *struct{}       `xml:"registered"`
+    Remove       *struct{}       `xml:"remove"`
+    Form         *DataForm       `xml:"jabber:x:data x"`
+    OOB          *OOBData        `xml:"jabber:x:oob x"`
+    Data         []BoBData       `xml:"urn:xmpp:bob data"`
+    Fields       []RegisterField `xml:",any"`
+}
+
+// RegisterField is one of the plain XEP-0077 fields, such as <username/> or <email/>.
+type RegisterField struct {
+    XMLName xml.Name
+    Value   string `xml:",chardata"`
+}
+
+// OOBData is an XEP-0066 out-of-band URL, used to redirect to web registration.
+type OOBData struct {
+    URL  string `xml:"url"`
+    Desc string `xml:"desc,omitempty"`
+}
+
+// registerIQ is the IQ envelope of registration responses.
+type registerIQ struct {
+    XMLName xml.Name       `xml:"iq"`
+    Type    string         `xml:"type,attr"`
+    ID      string         `xml:"id,attr"`
+    Query   *RegisterQuery `xml:"jabber:iq:register query"`
+    Data    []BoBData      `xml:"urn:xmpp:bob data"`
+    Error   *StanzaError   `xml:"error"`
+}
+
+// ErrUserExists is returned when the requested username is already taken.
+var ErrUserExists = errors.New("user already exists")
+
+// RedirectError is returned when the server only accepts registration on a web page.
+type RedirectError struct {
+    URL string
+}
+
+func (e *RedirectError) Error() string {
+    return fmt.Sprintf("registration must be completed at %s", e.URL)
+}
+
+// IsRedirect reports whether the server wants registration done out of band.
+func (q *RegisterQuery) IsRedirect() bool {
+    return q.OOB != nil && q.OOB.URL != "" && q.Form == nil && len(q.Fields) == 0
+}
+
+// Field returns the plain field with the given name, or nil if the server did not ask for it.
+func (q *RegisterQuery) Field(name string) *RegisterField {
+    for i := range q.Fields {
+        if q.Fields[i].XMLName.Local == name {
+            return &q.Fields[i]
+        }
+    }
+    return nil
+}
+
+// SetValue fills a value into the form field or plain field called name.
+// It reports whether the server asked for that field at all.
+func (q *RegisterQuery) SetValue(name, value string) bool {
+    if q.Form != nil {
+        if f := q.Form.Field(name); f != nil {
+            f.SetValue(value)
+            return true
+        }
+        return false
+    }
+    if f := q.Field(name); f != nil {
+        f.Value = value
+        return true
+    }
+    return false
+}
+
+// BoB returns the Bits of Binary payload referenced by a "cid:" URI.
+func (q *RegisterQuery) BoB(uri string) (*BoBData, bool) {
+    cid := strings.TrimPrefix(uri, "cid:")
+    for i := range q.Data {
+        if q.Data[i].CID == cid {
+            return &q.Data[i], true
+        }
+    }
+    return nil, false
+}
+
+// submission builds the query to send back: the submitted form if the server
+// sent one, otherwise the plain fields with their values.
+func (q *RegisterQuery) submission() *RegisterQuery {
+    if q.Form != nil {
+        return &RegisterQuery{Form: q.Form.Submit()}
+    }
+    submit := &RegisterQuery{}
+    for _, f := range q.Fields {
+        // The fields are in the query's namespace; an empty one would take them out.
+        submit.Fields = append(submit.Fields, RegisterField{XMLName: xml.Name{Space: nsRegister, Local: f.XMLName.Local}, Value: f.Value})
+    }
+    return submit
+}
+
+// missingFields lists the fields that still need a value before submitting.
+func (q *RegisterQuery) missingFields() []string {
+    if q.Form != nil {
+        return q.Form.MissingFields()
+    }
+    var missing []string
+    for _, f := range q.Fields {
+        // XEP-0077 treats every listed plain field as required.
+        if strings.TrimSpace(f.Value) == "" {
+            missing = append(missing, f.XMLName.Local)
+        }
+    }
+    return missing
+}
+
+// FetchRegistrationForm asks the server which fields it needs to register an account.
+// The stream must already be open on conn.
+func FetchRegistrationForm(conn *XMPPConnection) (*RegisterQuery, error) {
+    iqID := "reg_form1"
+    iq := NewIQ("get", iqID)
+    iq.SetQuery(&RegisterQuery{})
+
+    if err := sendStanza(conn, iq); err != nil {
+        return nil, fmt.Errorf("failed to send registration form request: %v", err)
+    }
+
+    var response registerIQ
+    if err := conn.readIQ(iqID, &response); err != nil {
+        return nil, fmt.Errorf("error reading registration form: %v", err)
+    }
+    if response.Type == "error" {
+        if response.Error != nil {
+            return nil, fmt.Errorf("registration not available: %w", response.Error)
+        }
+        return nil, errors.New("registration not available")
+    }
+    if response.Query == nil {
+        return nil, errors.New("unexpected registration form response")
+    }
+
+    query := response.Query
+    // CAPTCHA images may be attached next to the query instead of inside it.
+    query.Data = append(query.Data, response.Data...)
+    Logger("register").Debug("received registration form", "fields", len(query.Fields))
+    return query, nil
+}
+
+// SubmitRegistration sends the completed registration form back to the server.
+func SubmitRegistration(conn *XMPPConnection, query *RegisterQuery) error {
+    if query.IsRedirect() {
+        return &RedirectError{URL: query.OOB.URL}
+    }
+    if missing := query.missingFields(); len(missing) > 0 {
+        return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+    }
+
+    iqID := "register1"
+    iq := NewIQ("set", iqID)
+    iq.SetQuery(query.submission())
+
+    if err := sendStanza(conn, iq); err != nil {
+        return fmt.Errorf("failed to send registration request: %v", err)
+    }
+
+    var response registerIQ
+    if err := conn.readIQ(iqID, &response); err != nil {
+        return fmt.Errorf("error reading registration response: %v", err)
+    }
+
+    switch response.Type {
+    case "result":
+        Logger("register").Info("user created")
+        return nil
+    case "error":
+        if response.Error == nil {
+            return errors.New("failed to create user: unknown error")
+        }
+        if response.Error.Condition == "conflict" {
+            return ErrUserExists
+        }
+        // Some servers answer with an out-of-band redirect only at submit time.
+        if response.Query != nil && response.Query.OOB != nil && response.Query.OOB.URL != "" {
+            return &RedirectError{URL: response.Query.OOB.URL}
+        }
+        return fmt.Errorf("failed to create user: %w", response.Error)
+    }
+
+    return errors.New("unexpected registration response")
+}
+
+// FormRequiredError is returned when the server wants a data form filled in
+// before it changes the password, and some of its fields could not be filled
+// automatically. Complete Form and pass it to SubmitPasswordForm.
+type FormRequiredError struct {
+    Form *DataForm
+}
+
+func (e *FormRequiredError) Error() string {
+    return "the server requires additional information to change the password"
+}
+
+// ChangePassword changes the password of the logged in account (XEP-0077 §3.3).
+// On success h.Password is updated for the rest of the session; login
+// credentials saved elsewhere are not, and must be updated by the caller.
+func (h *XMPPHandler) ChangePassword(newPassword string) error {
+    if newPassword == "" {
+        return errors.New("the new password must not be empty")
+    }
+
+    query := &RegisterQuery{
+        Fields: []RegisterField{
+            {XMLName: xml.Name{Space: nsRegister, Local: "username"}, Value: h.Username},
+            {XMLName: xml.Name{Space: nsRegister, Local: "password"}, Value: newPassword},
+        },
+    }
+    return h.sendPasswordChange(query, newPassword)
+}
+
+// SubmitPasswordForm submits a password change form returned in a FormRequiredError.
+func (h *XMPPHandler) SubmitPasswordForm(form *DataForm, newPassword string) error {
+    if missing := form.MissingFields(); len(missing) > 0 {
+        return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+    }
+    return h.sendPasswordChange(&RegisterQuery{Form: form.Submit()}, newPassword)
+}
+
+func (h *XMPPHandler) sendPasswordChange(query *RegisterQuery, newPassword string) error {
+    server, err := jid.New("", h.Conn.Domain, "")
+    if err != nil {
+        return fmt.Errorf("failed to change password: %w", err)
+    }
+    iq := NewIQ("set", h.NextID())
+    iq.To = server
+    iq.SetQuery(query)
+
+    response, err := h.SendIQ(iq)
+    if err != nil {
+        return fmt.Errorf("failed to change password: %w", err)
+    }
+
+    if response.Type == "result" {
+        h.Password = newPassword
+        Logger("register").Info("password changed")
+        return nil
+    }
+
+    // The server may answer with a form it wants filled in first.
+    var answer RegisterQuery
+    if err := response.DecodePayload(&answer); err == nil && answer.Form != nil && query.Form == nil {
+        form := answer.Form
+        for name, value := range map[string]string{
+            "username":     h.Username,
+            "old_password": h.Password,
+            "password":     newPassword,
+        } {
+            if f := form.Field(name); f != nil {
+                f.SetValue(value)
+            }
+        }
+        if len(form.MissingFields()) > 0 {
+            return &FormRequiredError{Form: form}
+        }
+        return h.SubmitPasswordForm(form, newPassword)
+    }
+
+    return passwordChangeError(response.Error)
+}
+
+// passwordChangeError turns the error of a password change into a readable message.
+func passwordChangeError(stanzaErr *StanzaError) error {
+    if stanzaErr == nil {
+        return errors.New("failed to change password: unexpected response")
+    }
+    switch stanzaErr.Condition {
+    case "not-authorized":
+        // The plain request carries no proof of the current password, so
+        // this is about the session, not about what the user typed.
+        return fmt.Errorf("this session is not allowed to change the password (%w)", stanzaErr)
+    case "not-acceptable":
+        return fmt.Errorf("the server rejected the new password, it may be too weak or contain invalid characters (%w)", stanzaErr)
+    case "not-allowed":
+        return fmt.Errorf("this server does not allow changing the password (%w)", stanzaErr)
+    }
+    return fmt.Errorf("failed to change password: %w", stanzaErr)
+}
@@ -0,0 +1,351 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+const (
+    nsRoster    = "jabber:iq:roster"
+    nsRosterVer = "urn:xmpp:features:rosterver"
+)
+
+// RosterItem is a contact of the roster (RFC 6121 §2.1.2).
+type RosterItem struct {
+    JID          jid.JID  `xml:"jid,attr"`
+    Name         string   `xml:"name,attr,omitempty"`
+    Subscription string   `xml:"subscription,attr,omitempty"` // "none", "to", "from", "both" or "remove"
+    Ask          string   `xml:"ask,attr,omitempty"`          // "subscribe" while our request is pending
+    Approved     bool     `xml:"approved,attr,omitempty"`     // the contact is pre-approved (RFC 6121 §3.4)
+    Groups       []string `xml:"group"`
+}
+
+// RosterQuery is the jabber:iq:roster payload of roster gets, results and pushes.
+// Ver is the roster version of XEP-0237.
+type RosterQuery struct {
+    XMLName xml.Name     `xml:"jabber:iq:roster query"`
+    Ver     string       `xml:"ver,attr,omitempty"`
+    Items   []RosterItem `xml:"item"`
+}
+
+// rosterGet is the request for the roster. Ver is left out when the server
+// doesn't support roster versioning, and sent even when empty when it does,
+// which asks for a version to start with (RFC 6121 §2.6.2).
+type rosterGet struct {
+    XMLName xml.Name `xml:"jabber:iq:roster query"`
+    Ver     *string  `xml:"ver,attr"`
+}
+
+// rosterItemXML is a roster item as it is read, with the JID left unparsed.
+type rosterItemXML struct {
+    JID          string   `xml:"jid,attr"`
+    Name         string   `xml:"name,attr"`
+    Subscription string   `xml:"subscription,attr"`
+    Ask          string   `xml:"ask,attr"`
+    Approved     bool     `xml:"approved,attr"`
+    Groups       []string `xml:"group"`
+}
+
+// UnmarshalXML reads the items of a roster one by one. An item whose JID is
+// not valid, as legacy and transport rosters may hold, is logged and left
+// out instead of making the whole roster fail.
+func (q *RosterQuery) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var raw struct {
+        Ver   string          `xml:"ver,attr"`
+        Items []rosterItemXML `xml:"item"`
+    }
+    if err := d.DecodeElement(&raw, &start); err != nil {
+        return err
+    }
+    *q = RosterQuery{XMLName: start.Name, Ver: raw.Ver}
+    for _, item := range raw.Items {
+        addr, err := jid.Parse(item.JID)
+        if err != nil {
+            Logger("roster").Warn("skipping roster item with an invalid JID", "jid", item.JID, "err", err)
+            continue
+        }
+        q.Items = append(q.Items, RosterItem{
+            JID:          addr,
+            Name:         item.Name,
+            Subscription: item.Subscription,
+            Ask:          item.Ask,
+            Approved:     item.Approved,
+            Groups:       item.Groups,
+        })
+    }
+    return nil
+}
+
+// Roster is the contact list of the account. It is loaded with Fetch and then
+// kept in sync with the roster pushes of the server. Every change is
+// announced with a RosterEvent.
+//
+// With a RosterStore, the roster is also cached between sessions: it is
+// available before Fetch, and Fetch only downloads what changed since the
+// cached version.
+type Roster struct {
+    h      *XMPPHandler
+    mu     sync.RWMutex
+    items  map[jid.JID]RosterItem // keyed by bare JID
+    ver    string
+    loaded bool
+    store  RosterStore
+}
+
+// UseStore loads the roster cached in store and keeps it up to date there.
+// It is meant to be called once, before Fetch.
+func (r *Roster) UseStore(store RosterStore) error {
+    ver, items, err := store.LoadRoster()
+
+    r.mu.Lock()
+    r.store = store
+    if err == nil && !r.loaded {
+        r.ver = ver
+        r.items = make(map[jid.JID]RosterItem, len(items))
+        for _, item := range items {
+            r.items[item.JID.Bare()] = item
+        }
+    }
+    r.mu.Unlock()
+
+    if err != nil {
+        return fmt.Errorf("failed to load the cached roster: %w", err)
+    }
+    Logger("roster").Debug("roster loaded from cache", "items", len(items), "ver", ver)
+    r.h.emit(&RosterEvent{Items: r.Items(), Full: true})
+    return nil
+}
+
+// Version returns the version of the roster, or "" if the server doesn't
+// support roster versioning.
+func (r *Roster) Version() string {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.ver
+}
+
+// Roster returns the roster of the account.
+func (h *XMPPHandler) Roster() *Roster {
+    h.rosterOnce.Do(func() {
+        h.roster = &Roster{h: h, items: make(map[jid.JID]RosterItem)}
+    })
+    return h.roster
+}
+
+// Fetch loads the roster from the server, replacing the local copy. If a
+// cached version is known, the server may answer that it is still current and
+// push the changes since then instead. The stanza reader must be running.
+func (r *Roster) Fetch() error {
+    get := &rosterGet{}
+    if r.h.Conn != nil && r.h.Conn.RosterVer {
+        ver := r.Version()
+        get.Ver = &ver
+    }
+    request := NewIQ("get", "")
+    request.SetQuery(get)
+    response, err := r.h.SendIQ(request)
+    if err != nil {
+        return fmt.Errorf("failed to fetch the roster: %w", err)
+    }
+    if response.Type == "error" {
+        if response.Error != nil {
+            return fmt.Errorf("failed to fetch the roster: %w", response.Error)
+        }
+        return errors.New("failed to fetch the roster: request refused")
+    }
+
+    if response.PayloadName().Local == "" {
+        // An empty result: the cached roster is current, changes come as pushes.
+        r.mu.Lock()
+        r.loaded = true
+        r.mu.Unlock()
+        Logger("roster").Debug("cached roster is up to date", "ver", r.Version())
+        r.h.emit(&RosterEvent{Items: r.Items(), Full: true})
+        return nil
+    }
+
+    var query RosterQuery
+    if err := response.DecodePayload(&query); err != nil {
+        return fmt.Errorf("failed to parse the roster: %v", err)
+    }
+
+    r.mu.Lock()
+    r.items = make(map[jid.JID]RosterItem, len(query.Items))
+    for _, item := range query.Items {
+        item.JID = item.JID.Bare()
+        r.items[item.JID] = item
+    }
+    r.ver = query.Ver
+    r.loaded = true
+    r.mu.Unlock()
+
+    Logger("roster").Debug("roster loaded", "items", len(query.Items), "ver", query.Ver)
+    r.save()
+    r.h.emit(&RosterEvent{Items: r.Items(), Full: true})
+    return nil
+}
+
+// save writes the roster to the store, if there is one.
+func (r *Roster) save() {
+    r.mu.RLock()
+    store, ver := r.store, r.ver
+    r.mu.RUnlock()
+    if store == nil {
+        return
+    }
+    if err := store.SaveRoster(ver, r.Items()); err != nil {
+        Logger("roster").Warn("failed to cache the roster", "err", err)
+    }
+}
+
+// Loaded reports whether the roster was fetched from the server.
+func (r *Roster) Loaded() bool {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.loaded
+}
+
+// Items returns a copy of the roster, sorted by JID.
+func (r *Roster) Items() []RosterItem {
+    r.mu.RLock()
+    items := make([]RosterItem, 0, len(r.items))
+    for _, item := range r.items {
+        items = append(items, item.clone())
+    }
+    r.mu.RUnlock()
+
+    sort.Slice(items, func(i, j int) bool {
+        return items[i].JID.String() < items[j].JID.String()
+    })
+    return items
+}
+
+// Groups returns the names of the groups that have contacts, sorted. A roster
+// group only exists while some contact is in it.
+func (r *Roster) Groups() []string {
+    r.mu.RLock()
+    seen := make(map[string]bool)
+    var groups []string
+    for _, item := range r.items {
+        for _, group := range item.Groups {
+            if !seen[group] {
+                seen[group] = true
+                groups = append(groups, group)
+            }
+        }
+    }
+    r.mu.RUnlock()
+
+    sort.Strings(groups)
+    return groups
+}
+
+// Item returns a copy of the roster item of a contact.
+func (r *Roster) Item(contact jid.JID) (RosterItem, bool) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    item, ok := r.items[contact.Bare()]
+    return item.clone(), ok
+}
+
+// Set adds a contact to the roster, or updates its name and groups. The
+// local copy changes when the server pushes the new item back.
+func (r *Roster) Set(item RosterItem) error {
+    item.JID = item.JID.Bare()
+    if item.JID.IsZero() {
+        return errors.New("roster item without a JID")
+    }
+    groups, err := cleanGroups(item.Groups)
+    if err != nil {
+        return err
+    }
+    // The subscription is managed with presence stanzas, never set directly.
+    return r.set(RosterItem{JID: item.JID, Name: strings.TrimSpace(item.Name), Groups: groups})
+}
+
+// Remove deletes a contact from the roster. The server also cancels the
+// presence subscriptions in both directions.
+func (r *Roster) Remove(contact jid.JID) error {
+    if contact.IsZero() {
+        return errors.New("roster item without a JID")
+    }
+    return r.set(RosterItem{JID: contact.Bare(), Subscription: "remove"})
+}
+
+func (r *Roster) set(item RosterItem) error {
+    request := NewIQ("set", "")
+    request.SetQuery(&RosterQuery{Items: []RosterItem{item}})
+    response, err := r.h.SendIQ(request)
+    if err != nil {
+        return fmt.Errorf("failed to update the roster: %w", err)
+    }
+    if response.Type == "error" {
+        if response.Error != nil {
+            return fmt.Errorf("failed to update the roster: %w", response.Error)
+        }
+        return errors.New("failed to update the roster")
+    }
+    return nil
+}
+
+// apply stores the items of a roster push, with the version it brings, and
+// returns them as stored.
+func (r *Roster) apply(push RosterQuery) []RosterItem {
+    r.mu.Lock()
+    changed := make([]RosterItem, 0, len(push.Items))
+    for _, item := range push.Items {
+        item.JID = item.JID.Bare()
+        if item.Subscription == "remove" {
+            delete(r.items, item.JID)
+        } else {
+            r.items[item.JID] = item
+        }
+        changed = append(changed, item.clone())
+    }
+    if push.Ver != "" {
+        r.ver = push.Ver
+    }
+    r.mu.Unlock()
+
+    r.save()
+    return changed
+}
+
+// HasGroup reports whether the contact is in the named group.
+func (item RosterItem) HasGroup(name string) bool {
+    for _, group := range item.Groups {
+        if group == name {
+            return true
+        }
+    }
+    return false
+}
+
+func (item RosterItem) clone() RosterItem {
+    item.Groups = append([]string(nil), item.Groups...)
+    return item
+}
+
+// cleanGroups trims the group names and drops empty and repeated ones.
+func cleanGroups(groups []string) ([]string, error) {
+    var clean []string
+    seen := make(map[string]bool)
+    for _, group := range groups {
+        group = strings.TrimSpace(group)
+        if group == "" || seen[group] {
+            continue
+        }
+        if len(group) > 1023 {
+            return nil, fmt.Errorf("group name %.20q... is too long", group)
+        }
+        seen[group] = true
+        clean = append(clean, group)
+    }
+    return clean, nil
+}
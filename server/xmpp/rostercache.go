@@ -0,0 +1,88 @@
+package xmpp
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// RosterStore keeps a copy of the roster between sessions, together with the
+// version the server gave it (XEP-0237), so that the next login only has to
+// download the changes.
+type RosterStore interface {
+    // LoadRoster returns the stored roster. An empty store returns no error.
+    LoadRoster() (ver string, items []RosterItem, err error)
+    SaveRoster(ver string, items []RosterItem) error
+}
+
+// FileRosterStore stores the roster of one account in a JSON file.
+type FileRosterStore struct {
+    Path string
+    mu   sync.Mutex
+}
+
+// NewFileRosterStore returns a store that keeps the roster of account in the
+// user's cache directory.
+func NewFileRosterStore(account jid.JID) (*FileRosterStore, error) {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return nil, fmt.Errorf("no cache directory for the roster: %v", err)
+    }
+    name := url.PathEscape(account.Bare().String()) + ".json"
+    return &FileRosterStore{Path: filepath.Join(dir, "xmpp-client", "roster", name)}, nil
+}
+
+type rosterFile struct {
+    Ver   string       `json:"ver"`
+    Items []RosterItem `json:"items"`
+}
+
+// LoadRoster reads the roster file. A missing file is an empty roster.
+func (s *FileRosterStore) LoadRoster() (string, []RosterItem, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, err := os.ReadFile(s.Path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return "", nil, nil
+    }
+    if err != nil {
+        return "", nil, err
+    }
+    var stored rosterFile
+    if err := json.Unmarshal(data, &stored); err != nil {
+        return "", nil, fmt.Errorf("corrupt roster cache %s: %v", s.Path, err)
+    }
+    return stored.Ver, stored.Items, nil
+}
+
+// SaveRoster replaces the roster file.
+func (s *FileRosterStore) SaveRoster(ver string, items []RosterItem) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, err := json.Marshal(rosterFile{Ver: ver, Items: items})
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(s.Path, data)
+}
+
+// writeFileAtomic replaces the file at path with data, creating its
+// directory if needed. The data goes to a temporary file first, so that a
+// crash never leaves half a file behind.
+func writeFileAtomic(path string, data []byte) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+        return err
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0o600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
@@ -1,17 +1,133 @@
 package xmpp
 
 import (
+    "bytes"
     "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
 )
 
 type Stanza interface {
     ToXML() (string, error)
 }
 
+// RawStanza is a top-level element that is not a message, presence or IQ,
+// such as <stream:error/> or the stream management <a/> and <r/>.
+type RawStanza struct {
+    Name xml.Name
+    Attr []xml.Attr
+    Data []byte // the element exactly as it was received
+}
+
+// ToXML returns the element as it was received.
+func (r *RawStanza) ToXML() (string, error) {
+    return string(r.Data), nil
+}
+
+// ParseStanza parses a single top-level element and returns it as a *Message,
+// *Presence or *IQ, or as a *RawStanza for any other element.
 func ParseStanza(data []byte) (Stanza, error) {
-    var msg Message
-    if err := xml.Unmarshal(data, &msg); err != nil {
+    decoder := xml.NewDecoder(bytes.NewReader(data))
+
+    var start xml.StartElement
+    for {
+        tok, err := decoder.Token()
+        if err == io.EOF {
+            return nil, errors.New("no element found")
+        }
+        if err != nil {
+            return nil, err
+        }
+        if se, ok := tok.(xml.StartElement); ok {
+            start = se
+            break
+        }
+        if !isIgnorable(tok) {
+            return nil, fmt.Errorf("unexpected %T before the stanza", tok)
+        }
+    }
+
+    offset := decoder.InputOffset()
+    stanza, err := decodeStanza(decoder, start)
+    if err != nil {
+        return nil, err
+    }
+    if raw, ok := stanza.(*RawStanza); ok {
+        // Keep the original bytes, from the start tag up to the end tag.
+        begin := bytes.LastIndex(data[:offset], []byte("<"))
+        raw.Data = append([]byte(nil), data[begin:decoder.InputOffset()]...)
+    }
+
+    // Only whitespace may follow the element.
+    for {
+        tok, err := decoder.Token()
+        if err == io.EOF {
+            return stanza, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        if !isIgnorable(tok) {
+            return nil, errors.New("trailing data after the stanza")
+        }
+    }
+}
+
+// decodeStanza decodes the element started by start into the matching stanza type.
+// Elements that are not stanzas are skipped and returned as a *RawStanza
+// without their data.
+func decodeStanza(decoder *xml.Decoder, start xml.StartElement) (Stanza, error) {
+    if !isStanzaNamespace(start.Name.Space) {
+        return skipRaw(decoder, start)
+    }
+
+    switch start.Name.Local {
+    case "message":
+        var msg Message
+        if err := decoder.DecodeElement(&msg, &start); err != nil {
+            return nil, err
+        }
+        return &msg, nil
+    case "presence":
+        var pres Presence
+        if err := decoder.DecodeElement(&pres, &start); err != nil {
+            return nil, err
+        }
+        return &pres, nil
+    case "iq":
+        var iq IQ
+        if err := decoder.DecodeElement(&iq, &start); err != nil {
+            return nil, err
+        }
+        return &iq, nil
+    }
+    return skipRaw(decoder, start)
+}
+
+func skipRaw(decoder *xml.Decoder, start xml.StartElement) (Stanza, error) {
+    if err := decoder.Skip(); err != nil {
         return nil, err
     }
-    return &msg, nil
+    return &RawStanza{Name: start.Name, Attr: start.Attr}, nil
+}
+
+// isStanzaNamespace reports whether a top-level element in space can be a stanza.
+// Elements without a namespace are accepted so that bare snippets parse too.
+func isStanzaNamespace(space string) bool {
+    return space == "" || space == "jabber:client" || space == "jabber:server"
+}
+
+// isIgnorable reports whether a token may surround a stanza: whitespace,
+// the XML declaration and comments.
+func isIgnorable(tok xml.Token) bool {
+    switch t := tok.(type) {
+    case xml.CharData:
+        return len(bytes.TrimSpace(t)) == 0
+    case xml.ProcInst:
+        return t.Target == "xml"
+    case xml.Comment:
+        return true
+    }
+    return false
 }
@@ -0,0 +1,237 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "sort"
+    "sync"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// sessionState is the data of a session that the stanza reader writes and the
+// UI reads: unread message counts, the presence of each contact's resources and the
+// vCards received. Every accessor copies what it returns, so callers never
+// share a stanza with the reader.
+type sessionState struct {
+    mu        sync.RWMutex
+    unread    map[jid.JID]int              // keyed by bare JID
+    presences map[jid.JID]*contactPresence // keyed by bare JID
+    seq       uint64                       // presences stored so far
+    vcards    map[jid.JID]*IQ              // keyed by bare JID
+    own       *Presence                    // the last presence we broadcast
+}
+
+// MarkUnread counts a message from a contact that nobody displayed yet,
+// until its conversation is opened. The message itself is in the history.
+func (h *XMPPHandler) MarkUnread(contact jid.JID) {
+    h.state.mu.Lock()
+    defer h.state.mu.Unlock()
+    if h.state.unread == nil {
+        h.state.unread = make(map[jid.JID]int)
+    }
+    h.state.unread[contact.Bare()]++
+}
+
+// MarkRead clears the count of a contact whose conversation was opened.
+func (h *XMPPHandler) MarkRead(contact jid.JID) {
+    h.state.mu.Lock()
+    defer h.state.mu.Unlock()
+    delete(h.state.unread, contact.Bare())
+}
+
+// UnreadCount returns how many messages from a contact were not displayed.
+func (h *XMPPHandler) UnreadCount(contact jid.JID) int {
+    h.state.mu.RLock()
+    defer h.state.mu.RUnlock()
+    return h.state.unread[contact.Bare()]
+}
+
+// Presence returns a copy of the presence of a contact. For a bare JID it is
+// the presence of the contact's most available resource (see Resources), or
+// the last unavailable presence once every resource went offline. For a
+// full JID it is the presence of that resource only.
+func (h *XMPPHandler) Presence(contact jid.JID) (*Presence, bool) {
+    h.state.mu.RLock()
+    defer h.state.mu.RUnlock()
+    cp, ok := h.state.presences[contact.Bare()]
+    if !ok {
+        return nil, false
+    }
+    if !contact.IsBare() {
+        entry, ok := cp.resources[contact.Resourcepart()]
+        if !ok {
+            return nil, false
+        }
+        return entry.pres.clone(), true
+    }
+    return cp.aggregate().clone(), true
+}
+
+// Presences returns a copy of the presence of every contact, aggregated as
+// Presence does, keyed by bare JID.
+func (h *XMPPHandler) Presences() map[jid.JID]*Presence {
+    h.state.mu.RLock()
+    defer h.state.mu.RUnlock()
+    presences := make(map[jid.JID]*Presence, len(h.state.presences))
+    for contact, cp := range h.state.presences {
+        presences[contact] = cp.aggregate().clone()
+    }
+    return presences
+}
+
+// Resources returns a copy of the presence of every online resource of a
+// contact, the most available first: by priority, then by show, then the
+// most recent.
+func (h *XMPPHandler) Resources(contact jid.JID) []*Presence {
+    h.state.mu.RLock()
+    defer h.state.mu.RUnlock()
+    cp, ok := h.state.presences[contact.Bare()]
+    if !ok {
+        return nil
+    }
+    entries := cp.sorted()
+    resources := make([]*Presence, len(entries))
+    for i, entry := range entries {
+        resources[i] = entry.pres.clone()
+    }
+    return resources
+}
+
+// contactPresence is what is known of the presence of a contact: the
+// presence of each online resource and the last presence received, which
+// stands for the contact once every resource is offline.
+type contactPresence struct {
+    resources map[string]resourcePresence // keyed by resource, "" for the bare JID
+    last      *Presence
+}
+
+type resourcePresence struct {
+    pres *Presence
+    seq  uint64 // order of arrival, to prefer the most recent on ties
+}
+
+// aggregate returns the presence that represents the contact.
+func (cp *contactPresence) aggregate() *Presence {
+    if entries := cp.sorted(); len(entries) > 0 {
+        return entries[0].pres
+    }
+    return cp.last
+}
+
+// sorted returns the online resources, the most available first.
+func (cp *contactPresence) sorted() []resourcePresence {
+    entries := make([]resourcePresence, 0, len(cp.resources))
+    for _, entry := range cp.resources {
+        entries = append(entries, entry)
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        a, b := entries[i], entries[j]
+        if a.pres.Priority != b.pres.Priority {
+            return a.pres.Priority > b.pres.Priority
+        }
+        if ra, rb := showRank(a.pres.Show), showRank(b.pres.Show); ra != rb {
+            return ra < rb
+        }
+        return a.seq > b.seq
+    })
+    return entries
+}
+
+// showRank orders the values of <show/> as Shows does, from the most to
+// the least available.
+func showRank(show Show) int {
+    for i, s := range Shows {
+        if s == show {
+            return i
+        }
+    }
+    return len(Shows)
+}
+
+// storePresence records an available or unavailable presence. An
+// unavailable presence only takes its own resource offline, or every
+// resource when it comes from the bare JID.
+func (h *XMPPHandler) storePresence(pres *Presence) {
+    h.state.mu.Lock()
+    defer h.state.mu.Unlock()
+    if h.state.presences == nil {
+        h.state.presences = make(map[jid.JID]*contactPresence)
+    }
+    contact := pres.From.Bare()
+    cp, ok := h.state.presences[contact]
+    if !ok {
+        cp = &contactPresence{resources: make(map[string]resourcePresence)}
+        h.state.presences[contact] = cp
+    }
+
+    stored := pres.clone()
+    resource := pres.From.Resourcepart()
+    switch {
+    case pres.IsAvailable():
+        h.state.seq++
+        cp.resources[resource] = resourcePresence{pres: stored, seq: h.state.seq}
+    case resource == "":
+        clear(cp.resources)
+    default:
+        delete(cp.resources, resource)
+    }
+    cp.last = stored
+}
+
+// VCard returns a copy of the last vCard result received from a contact.
+func (h *XMPPHandler) VCard(contact jid.JID) (*IQ, bool) {
+    h.state.mu.RLock()
+    defer h.state.mu.RUnlock()
+    iq, ok := h.state.vcards[contact.Bare()]
+    if !ok {
+        return nil, false
+    }
+    return iq.clone(), true
+}
+
+func (h *XMPPHandler) storeVCard(iq *IQ) {
+    h.state.mu.Lock()
+    defer h.state.mu.Unlock()
+    if h.state.vcards == nil {
+        h.state.vcards = make(map[jid.JID]*IQ)
+    }
+    h.state.vcards[iq.From.Bare()] = iq.clone()
+}
+
+func (m *Message) clone() *Message {
+    c := *m
+    c.Extensions = m.Extensions.clone()
+    return &c
+}
+
+func (p *Presence) clone() *Presence {
+    c := *p
+    c.Statuses = append([]LangText(nil), p.Statuses...)
+    c.Extensions = p.Extensions.clone()
+    return &c
+}
+
+func (iq *IQ) clone() *IQ {
+    c := *iq
+    if iq.Error != nil {
+        stanzaErr := *iq.Error
+        c.Error = &stanzaErr
+    }
+    c.Payload = append([]byte(nil), iq.Payload...)
+    return &c
+}
+
+func (x Extensions) clone() Extensions {
+    if x == nil {
+        return nil
+    }
+    c := make(Extensions, len(x))
+    for i, ext := range x {
+        c[i] = Extension{
+            XMLName: ext.XMLName,
+            Attr:    append([]xml.Attr(nil), ext.Attr...),
+            Inner:   append([]byte(nil), ext.Inner...),
+        }
+    }
+    return c
+}
@@ -1,13 +1,23 @@
 package xmpp
 
 import (
-    "fmt"
+    "encoding/xml"
     "io"
+    "strings"
 )
 
+const nsStream = "http://etherx.jabber.org/streams"
+
 func (xc *XMPPConnection) StartStream(domain string) error {
-    streamHeader := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", domain)
-    _, err := io.WriteString(xc.Conn, streamHeader)
+    // The stream header is never closed in the same write, so it can't be
+    // marshalled; escape the only variable part by hand.
+    var streamHeader strings.Builder
+    streamHeader.WriteString("<?xml version='1.0'?><stream:stream to='")
+    if err := xml.EscapeText(&streamHeader, []byte(domain)); err != nil {
+        return err
+    }
+    streamHeader.WriteString("' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>")
+    _, err := io.WriteString(xc.Conn, streamHeader.String())
     return err
 }
 
@@ -0,0 +1,255 @@
+package xmpp
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// SubscriptionState is the state of the presence subscriptions with a
+// contact (RFC 6121 Appendix A). To and From are the two directions:
+// whether we see the contact's presence and whether it sees ours.
+type SubscriptionState struct {
+    To          bool // we receive the contact's presence
+    From        bool // the contact receives ours
+    PendingOut  bool // we asked for the contact's presence and it didn't answer yet
+    PendingIn   bool // the contact asked for ours and we didn't answer yet
+    PreApproved bool // a request from the contact will be accepted by the server
+}
+
+// String returns the name of the state as RFC 6121 writes it, such as
+// "None + Pending Out" or "Both".
+func (s SubscriptionState) String() string {
+    var name string
+    switch {
+    case s.To && s.From:
+        name = "Both"
+    case s.To:
+        name = "To"
+    case s.From:
+        name = "From"
+    default:
+        name = "None"
+    }
+    switch {
+    case s.PendingOut && s.PendingIn:
+        name += " + Pending Out/In"
+    case s.PendingOut:
+        name += " + Pending Out"
+    case s.PendingIn:
+        name += " + Pending In"
+    }
+    if s.PreApproved {
+        name += " (pre-approved)"
+    }
+    return name
+}
+
+// SubscriptionRequest is a request to see our presence that the user didn't
+// answer yet.
+type SubscriptionRequest struct {
+    From     jid.JID // bare JID of the contact
+    Status   string  // optional message sent with the request
+    Received time.Time
+}
+
+// subscriptionInbox holds the requests that are waiting for an answer. It
+// lasts for the session only, unless it is given a SubscriptionStore.
+type subscriptionInbox struct {
+    mu      sync.Mutex
+    pending map[jid.JID]SubscriptionRequest
+    store   SubscriptionStore
+}
+
+// list returns the pending requests, oldest first. The caller holds mu.
+func (in *subscriptionInbox) list() []SubscriptionRequest {
+    requests := make([]SubscriptionRequest, 0, len(in.pending))
+    for _, request := range in.pending {
+        requests = append(requests, request)
+    }
+    sort.Slice(requests, func(i, j int) bool {
+        return requests[i].Received.Before(requests[j].Received)
+    })
+    return requests
+}
+
+// save writes the pending requests to the store, if there is one. The
+// caller holds mu.
+func (in *subscriptionInbox) save() {
+    if in.store == nil {
+        return
+    }
+    if err := in.store.SaveSubscriptions(in.list()); err != nil {
+        Logger("presence").Warn("failed to store the subscription requests", "err", err)
+    }
+}
+
+// UseSubscriptionStore loads the requests left unanswered in store and keeps
+// the inbox there from now on. Requests the roster shows as granted are
+// dropped, so the roster should be loaded first.
+func (h *XMPPHandler) UseSubscriptionStore(store SubscriptionStore) error {
+    stored, err := store.LoadSubscriptions()
+
+    h.inbox.mu.Lock()
+    defer h.inbox.mu.Unlock()
+    h.inbox.store = store
+    if err != nil {
+        return fmt.Errorf("failed to load the subscription requests: %w", err)
+    }
+    if h.inbox.pending == nil {
+        h.inbox.pending = make(map[jid.JID]SubscriptionRequest)
+    }
+    for _, request := range stored {
+        from := request.From.Bare()
+        if _, ok := h.inbox.pending[from]; ok || from.IsZero() {
+            continue
+        }
+        if item, ok := h.Roster().Item(from); ok && (item.Subscription == "from" || item.Subscription == "both") {
+            continue
+        }
+        request.From = from
+        h.inbox.pending[from] = request
+    }
+    h.inbox.save()
+    Logger("presence").Debug("subscription requests loaded", "pending", len(h.inbox.pending))
+    return nil
+}
+
+// PendingSubscriptions returns the subscription requests that were not
+// answered yet, oldest first.
+func (h *XMPPHandler) PendingSubscriptions() []SubscriptionRequest {
+    h.inbox.mu.Lock()
+    defer h.inbox.mu.Unlock()
+    return h.inbox.list()
+}
+
+// SubscriptionState returns the state of the subscriptions with a contact,
+// from its roster item and the pending requests.
+func (h *XMPPHandler) SubscriptionState(contact jid.JID) SubscriptionState {
+    var state SubscriptionState
+    if item, ok := h.Roster().Item(contact); ok {
+        state.To = item.Subscription == "to" || item.Subscription == "both"
+        state.From = item.Subscription == "from" || item.Subscription == "both"
+        state.PendingOut = item.Ask == "subscribe"
+        state.PreApproved = item.Approved
+    }
+    h.inbox.mu.Lock()
+    _, state.PendingIn = h.inbox.pending[contact.Bare()]
+    h.inbox.mu.Unlock()
+    return state
+}
+
+// handleSubscription updates the subscription state for an incoming
+// subscribe, subscribed, unsubscribe or unsubscribed presence and reports
+// whether the user has to be told about it.
+func (h *XMPPHandler) handleSubscription(pres *Presence) bool {
+    from := pres.From.Bare()
+    if from.IsZero() || h.isOwnAccount(from) {
+        Logger("presence").Warn("ignoring subscription stanza", "type", pres.Type, "from", pres.From)
+        return false
+    }
+
+    switch pres.Type {
+    case "subscribe":
+        if h.SubscriptionState(from).From {
+            // Already granted, for example from another client: confirm
+            // it again instead of asking the user.
+            h.AcceptSubscription(from)
+            return false
+        }
+        h.inbox.mu.Lock()
+        if h.inbox.pending == nil {
+            h.inbox.pending = make(map[jid.JID]SubscriptionRequest)
+        }
+        _, repeated := h.inbox.pending[from]
+        if !repeated {
+            h.inbox.pending[from] = SubscriptionRequest{From: from, Status: strings.TrimSpace(pres.Status), Received: time.Now()}
+            h.inbox.save()
+        }
+        h.inbox.mu.Unlock()
+        return !repeated
+    case "unsubscribe":
+        // The contact no longer wants our presence, nor waits for it.
+        h.answered(from)
+    }
+    return true
+}
+
+// answered removes the request of a contact from the inbox.
+func (h *XMPPHandler) answered(contact jid.JID) {
+    h.inbox.mu.Lock()
+    defer h.inbox.mu.Unlock()
+    if _, ok := h.inbox.pending[contact.Bare()]; ok {
+        delete(h.inbox.pending, contact.Bare())
+        h.inbox.save()
+    }
+}
+
+// RequestSubscription asks a contact for permission to see its presence.
+func (h *XMPPHandler) RequestSubscription(contact jid.JID) error {
+    if contact.IsZero() {
+        return errors.New("subscription request without a contact")
+    }
+    if err := h.SendStanza(NewPresence(contact.Bare(), "subscribe", "", "", 0)); err != nil {
+        Logger("presence").Error("failed to send subscription request", "to", contact, "err", err)
+        return err
+    }
+    Logger("presence").Info("subscription requested", "contact", contact)
+    return nil
+}
+
+// CancelSubscription stops receiving the presence of a contact, or
+// withdraws a request that it didn't answer yet.
+func (h *XMPPHandler) CancelSubscription(contact jid.JID) error {
+    if err := h.SendStanza(NewPresence(contact.Bare(), "unsubscribe", "", "", 0)); err != nil {
+        Logger("presence").Error("failed to send unsubscribe", "to", contact, "err", err)
+        return err
+    }
+    Logger("presence").Info("subscription cancelled", "contact", contact)
+    return nil
+}
+
+// AcceptSubscription allows a contact that asked for it to see our presence.
+// Without a pending request, it pre-approves the contact: a later request
+// from it is accepted by the server without asking (RFC 6121 §3.4). Servers
+// that don't support pre-approval ignore it.
+func (h *XMPPHandler) AcceptSubscription(from jid.JID) error {
+    err := h.SendStanza(NewPresence(from.Bare(), "subscribed", "", "", 0))
+    if err != nil {
+        Logger("presence").Error("failed to send subscription acceptance", "to", from, "err", err)
+        return err
+    }
+    h.answered(from)
+    Logger("presence").Info("subscription accepted", "contact", from)
+    return nil
+}
+
+// AcceptAndSubscribe accepts the request of a contact and, unless we already
+// see its presence or asked for it, asks for the contact's presence in turn.
+func (h *XMPPHandler) AcceptAndSubscribe(from jid.JID) error {
+    if err := h.AcceptSubscription(from); err != nil {
+        return err
+    }
+    if state := h.SubscriptionState(from); state.To || state.PendingOut {
+        return nil
+    }
+    return h.RequestSubscription(from)
+}
+
+// DenySubscription refuses a subscription request, cancels one granted
+// before or withdraws a pre-approval.
+func (h *XMPPHandler) DenySubscription(from jid.JID) error {
+    err := h.SendStanza(NewPresence(from.Bare(), "unsubscribed", "", "", 0))
+    if err != nil {
+        Logger("presence").Error("failed to send subscription rejection", "to", from, "err", err)
+        return err
+    }
+    h.answered(from)
+    Logger("presence").Info("subscription rejected", "contact", from)
+    return nil
+}
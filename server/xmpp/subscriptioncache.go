@@ -0,0 +1,70 @@
+package xmpp
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// SubscriptionStore keeps the subscription requests that were not answered
+// between sessions, so that they don't depend on the server delivering them
+// again at the next login.
+type SubscriptionStore interface {
+    // LoadSubscriptions returns the stored requests. An empty store returns no error.
+    LoadSubscriptions() ([]SubscriptionRequest, error)
+    SaveSubscriptions(requests []SubscriptionRequest) error
+}
+
+// FileSubscriptionStore stores the unanswered requests of one account in a
+// JSON file.
+type FileSubscriptionStore struct {
+    Path string
+    mu   sync.Mutex
+}
+
+// NewFileSubscriptionStore returns a store that keeps the requests of account
+// next to its cached roster.
+func NewFileSubscriptionStore(account jid.JID) (*FileSubscriptionStore, error) {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return nil, fmt.Errorf("no cache directory for the subscription requests: %v", err)
+    }
+    name := url.PathEscape(account.Bare().String()) + ".requests.json"
+    return &FileSubscriptionStore{Path: filepath.Join(dir, "xmpp-client", "roster", name)}, nil
+}
+
+// LoadSubscriptions reads the requests file. A missing file is an empty inbox.
+func (s *FileSubscriptionStore) LoadSubscriptions() ([]SubscriptionRequest, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, err := os.ReadFile(s.Path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var requests []SubscriptionRequest
+    if err := json.Unmarshal(data, &requests); err != nil {
+        return nil, fmt.Errorf("corrupt subscription requests %s: %v", s.Path, err)
+    }
+    return requests, nil
+}
+
+// SaveSubscriptions replaces the requests file.
+func (s *FileSubscriptionStore) SaveSubscriptions(requests []SubscriptionRequest) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, err := json.Marshal(requests)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(s.Path, data)
+}
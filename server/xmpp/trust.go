@@ -0,0 +1,41 @@
+package xmpp
+
+import (
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// isOwnAccount reports whether a stanza from this address comes from our own
+// account: without a from, or from our bare JID or one of its resources.
+func (h *XMPPHandler) isOwnAccount(from jid.JID) bool {
+    return from.IsZero() || (!h.JID.IsZero() && from.Bare() == h.JID.Bare())
+}
+
+// isOwnServer reports whether from is the domain of our account.
+func (h *XMPPHandler) isOwnServer(from jid.JID) bool {
+    if h.JID.IsZero() || !from.IsBare() || from.Localpart() != "" {
+        return false
+    }
+    return from.Domainpart() == h.JID.Domainpart()
+}
+
+// validRosterPush reports whether a roster push may be accepted from this
+// address: it must come from our bare JID or our server (RFC 6121 §2.1.6).
+func (h *XMPPHandler) validRosterPush(from jid.JID) bool {
+    return from.IsZero() || from == h.JID.Bare() || h.isOwnServer(from)
+}
+
+// validCarbon reports whether a carbon may be accepted from this address: it
+// must come from our bare JID (XEP-0280 §11), not even one of our resources.
+func (h *XMPPHandler) validCarbon(from jid.JID) bool {
+    return !h.JID.IsZero() && from == h.JID.Bare()
+}
+
+// validResponse reports whether from may answer an IQ that was sent to to.
+// A request to our own account, or without a to, is answered by our
+// server on its behalf; any other request must be answered by its recipient.
+func (h *XMPPHandler) validResponse(to, from jid.JID) bool {
+    if to.IsZero() || (!h.JID.IsZero() && to.Bare() == h.JID.Bare()) {
+        return from.IsZero() || from == to || from == h.JID || from == h.JID.Bare() || h.isOwnServer(from)
+    }
+    return from == to
+}
@@ -0,0 +1,295 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "fmt"
+    "strings"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// The PEP nodes of user mood (XEP-0107), activity (XEP-0108) and tune
+// (XEP-0118). Each is also the namespace of its payload.
+const (
+    NodeMood     = "http://jabber.org/protocol/mood"
+    NodeActivity = "http://jabber.org/protocol/activity"
+    NodeTune     = "http://jabber.org/protocol/tune"
+)
+
+// currentItem is the ID of the single item the user nodes keep.
+const currentItem = "current"
+
+// Moods lists the moods of XEP-0107.
+var Moods = []string{
+    "afraid", "amazed", "amorous", "angry", "annoyed", "anxious", "aroused",
+    "ashamed", "bored", "brave", "calm", "cautious", "cold", "confident",
+    "confused", "contemplative", "contented", "cranky", "crazy", "creative",
+    "curious", "dejected", "depressed", "disappointed", "disgusted",
+    "dismayed", "distracted", "embarrassed", "envious", "excited",
+    "flirtatious", "frustrated", "grateful", "grieving", "grumpy", "guilty",
+    "happy", "hopeful", "hot", "humbled", "humiliated", "hungry", "hurt",
+    "impressed", "in_awe", "in_love", "indignant", "interested",
+    "intoxicated", "invincible", "jealous", "lonely", "lost", "lucky", "mean",
+    "moody", "nervous", "neutral", "offended", "outraged", "playful", "proud",
+    "relaxed", "relieved", "remorseful", "restless", "sad", "sarcastic",
+    "satisfied", "serious", "shocked", "shy", "sick", "sleepy", "spontaneous",
+    "stressed", "strong", "surprised", "thankful", "thirsty", "tired",
+    "undefined", "weak", "worried",
+}
+
+// Activities maps the general activities of XEP-0108 to their specific
+// ones. Every general activity also accepts "other".
+var Activities = map[string][]string{
+    "doing_chores":       {"buying_groceries", "cleaning", "cooking", "doing_maintenance", "doing_the_dishes", "doing_the_laundry", "gardening", "running_an_errand", "walking_the_dog"},
+    "drinking":           {"having_a_beer", "having_coffee", "having_tea"},
+    "eating":             {"having_a_snack", "having_breakfast", "having_dinner", "having_lunch"},
+    "exercising":         {"cycling", "dancing", "hiking", "jogging", "playing_sports", "running", "skiing", "swimming", "working_out"},
+    "grooming":           {"at_the_spa", "brushing_teeth", "getting_a_haircut", "shaving", "taking_a_bath", "taking_a_shower"},
+    "having_appointment": {},
+    "inactive":           {"day_off", "hanging_out", "hiding", "on_vacation", "praying", "scheduled_holiday", "sleeping", "thinking"},
+    "relaxing":           {"fishing", "gaming", "going_out", "partying", "reading", "rehearsing", "shopping", "smoking", "socializing", "sunbathing", "watching_tv", "watching_a_movie"},
+    "talking":            {"in_real_life", "on_the_phone", "on_video_phone"},
+    "traveling":          {"commuting", "cycling", "driving", "in_a_car", "on_a_bus", "on_a_plane", "on_a_train", "on_a_trip", "walking"},
+    "undefined":          {},
+    "working":            {"coding", "in_a_meeting", "studying", "writing"},
+}
+
+// Mood is a user mood (XEP-0107). The zero Mood clears it.
+type Mood struct {
+    Value string // one of Moods
+    Text  string
+}
+
+// Activity is a user activity (XEP-0108). The zero Activity clears it.
+type Activity struct {
+    General  string // a key of Activities
+    Specific string // one of its values, "other" or empty
+    Text     string
+}
+
+// Tune is the music the user listens to (XEP-0118). The zero Tune says
+// that the user stopped listening.
+type Tune struct {
+    XMLName xml.Name `xml:"http://jabber.org/protocol/tune tune"`
+    Artist  string   `xml:"artist,omitempty"`
+    Length  int      `xml:"length,omitempty"` // seconds
+    Rating  int      `xml:"rating,omitempty"` // 1 to 10
+    Source  string   `xml:"source,omitempty"` // album or other collection
+    Title   string   `xml:"title,omitempty"`
+    Track   string   `xml:"track,omitempty"`
+    URI     string   `xml:"uri,omitempty"`
+}
+
+func init() {
+    RegisterExtension(NodeMood, "mood", Mood{})
+    RegisterExtension(NodeActivity, "activity", Activity{})
+    RegisterExtension(NodeTune, "tune", Tune{})
+}
+
+// MarshalXML writes the mood as an element named after it, and the text.
+func (m Mood) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+    start := xml.StartElement{Name: xml.Name{Space: NodeMood, Local: "mood"}}
+    if err := enc.EncodeToken(start); err != nil {
+        return err
+    }
+    if m.Value != "" {
+        if err := enc.EncodeElement("", xml.StartElement{Name: xml.Name{Local: m.Value}}); err != nil {
+            return err
+        }
+        if m.Text != "" {
+            if err := enc.EncodeElement(m.Text, xml.StartElement{Name: xml.Name{Local: "text"}}); err != nil {
+                return err
+            }
+        }
+    }
+    return enc.EncodeToken(start.End())
+}
+
+// UnmarshalXML reads the mood from the name of its element.
+func (m *Mood) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var raw struct {
+        Children []struct {
+            XMLName xml.Name
+            Text    string `xml:",chardata"`
+        } `xml:",any"`
+    }
+    if err := d.DecodeElement(&raw, &start); err != nil {
+        return err
+    }
+    *m = Mood{}
+    for _, child := range raw.Children {
+        if child.XMLName.Local == "text" {
+            m.Text = child.Text
+        } else if m.Value == "" {
+            m.Value = child.XMLName.Local
+        }
+    }
+    return nil
+}
+
+// String returns the mood as "happy (text)".
+func (m Mood) String() string {
+    return withText(strings.ReplaceAll(m.Value, "_", " "), m.Text)
+}
+
+// MarshalXML writes the general activity as an element holding the
+// specific one, and the text.
+func (a Activity) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+    start := xml.StartElement{Name: xml.Name{Space: NodeActivity, Local: "activity"}}
+    if err := enc.EncodeToken(start); err != nil {
+        return err
+    }
+    if a.General != "" {
+        general := xml.StartElement{Name: xml.Name{Local: a.General}}
+        if err := enc.EncodeToken(general); err != nil {
+            return err
+        }
+        if a.Specific != "" {
+            if err := enc.EncodeElement("", xml.StartElement{Name: xml.Name{Local: a.Specific}}); err != nil {
+                return err
+            }
+        }
+        if err := enc.EncodeToken(general.End()); err != nil {
+            return err
+        }
+        if a.Text != "" {
+            if err := enc.EncodeElement(a.Text, xml.StartElement{Name: xml.Name{Local: "text"}}); err != nil {
+                return err
+            }
+        }
+    }
+    return enc.EncodeToken(start.End())
+}
+
+// UnmarshalXML reads the activity from the names of its elements.
+func (a *Activity) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var raw struct {
+        Children []struct {
+            XMLName  xml.Name
+            Text     string `xml:",chardata"`
+            Specific []struct {
+                XMLName xml.Name
+            } `xml:",any"`
+        } `xml:",any"`
+    }
+    if err := d.DecodeElement(&raw, &start); err != nil {
+        return err
+    }
+    *a = Activity{}
+    for _, child := range raw.Children {
+        if child.XMLName.Local == "text" {
+            a.Text = child.Text
+        } else if a.General == "" {
+            a.General = child.XMLName.Local
+            if len(child.Specific) > 0 {
+                a.Specific = child.Specific[0].XMLName.Local
+            }
+        }
+    }
+    return nil
+}
+
+// String returns the activity as "relaxing: partying (text)".
+func (a Activity) String() string {
+    text := strings.ReplaceAll(a.General, "_", " ")
+    if a.Specific != "" {
+        text += ": " + strings.ReplaceAll(a.Specific, "_", " ")
+    }
+    return withText(text, a.Text)
+}
+
+// Empty reports whether the tune says that nothing is playing.
+func (t Tune) Empty() bool {
+    return t.Artist == "" && t.Title == "" && t.Source == "" && t.URI == ""
+}
+
+// String returns the tune as "Artist - Title".
+func (t Tune) String() string {
+    switch {
+    case t.Artist != "" && t.Title != "":
+        return t.Artist + " - " + t.Title
+    case t.Title != "":
+        return t.Title
+    case t.Source != "":
+        return t.Source
+    }
+    return t.Artist
+}
+
+func withText(value, text string) string {
+    if text == "" {
+        return value
+    }
+    return fmt.Sprintf("%s (%s)", value, text)
+}
+
+// PublishMood publishes our mood. The zero Mood clears it.
+func (h *XMPPHandler) PublishMood(mood Mood) error {
+    if mood.Value != "" && !knownMood(mood.Value) {
+        return fmt.Errorf("unknown mood %q", mood.Value)
+    }
+    return h.Publish(NodeMood, currentItem, mood)
+}
+
+// PublishActivity publishes our activity. The zero Activity clears it.
+func (h *XMPPHandler) PublishActivity(activity Activity) error {
+    if activity.General != "" {
+        specifics, ok := Activities[activity.General]
+        if !ok {
+            return fmt.Errorf("unknown activity %q", activity.General)
+        }
+        if activity.Specific != "" && activity.Specific != "other" && !contains(specifics, activity.Specific) {
+            return fmt.Errorf("unknown activity %q for %q", activity.Specific, activity.General)
+        }
+    }
+    return h.Publish(NodeActivity, currentItem, activity)
+}
+
+// PublishTune publishes the music we listen to. The zero Tune says that we
+// stopped listening.
+func (h *XMPPHandler) PublishTune(tune Tune) error {
+    return h.Publish(NodeTune, currentItem, tune)
+}
+
+// ContactMood returns the mood a contact published, if it has one.
+func (h *XMPPHandler) ContactMood(contact jid.JID) (Mood, bool) {
+    var mood Mood
+    ext, ok := h.PEPItem(contact, NodeMood)
+    if !ok || ext.Decode(&mood) != nil || mood.Value == "" {
+        return Mood{}, false
+    }
+    return mood, true
+}
+
+// ContactActivity returns the activity a contact published, if it has one.
+func (h *XMPPHandler) ContactActivity(contact jid.JID) (Activity, bool) {
+    var activity Activity
+    ext, ok := h.PEPItem(contact, NodeActivity)
+    if !ok || ext.Decode(&activity) != nil || activity.General == "" {
+        return Activity{}, false
+    }
+    return activity, true
+}
+
+// ContactTune returns the music a contact listens to, if it published it.
+func (h *XMPPHandler) ContactTune(contact jid.JID) (Tune, bool) {
+    var tune Tune
+    ext, ok := h.PEPItem(contact, NodeTune)
+    if !ok || ext.Decode(&tune) != nil || tune.Empty() {
+        return Tune{}, false
+    }
+    return tune, true
+}
+
+func knownMood(value string) bool {
+    return contains(Moods, value)
+}
+
+func contains(list []string, value string) bool {
+    for _, v := range list {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
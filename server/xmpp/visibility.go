@@ -0,0 +1,238 @@
+package xmpp
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+// invisibleList is the name of the privacy list used for invisibility.
+const invisibleList = "invisible"
+
+// InvisibleCommand asks the server to hide our presence (XEP-0186).
+type InvisibleCommand struct {
+    XMLName xml.Name `xml:"urn:xmpp:invisible:0 invisible"`
+}
+
+// VisibleCommand ends an InvisibleCommand.
+type VisibleCommand struct {
+    XMLName xml.Name `xml:"urn:xmpp:invisible:0 visible"`
+}
+
+// PrivacyQuery is the jabber:iq:privacy payload of XEP-0016.
+type PrivacyQuery struct {
+    XMLName xml.Name       `xml:"jabber:iq:privacy query"`
+    Active  *PrivacyActive `xml:"active"`
+    Lists   []PrivacyList  `xml:"list"`
+}
+
+// PrivacyActive names the active list; without a name it declines it.
+type PrivacyActive struct {
+    Name string `xml:"name,attr,omitempty"`
+}
+
+type PrivacyList struct {
+    Name  string        `xml:"name,attr"`
+    Items []PrivacyItem `xml:"item"`
+}
+
+// PrivacyItem is a rule of a privacy list. Without a type it matches everyone.
+type PrivacyItem struct {
+    Type        string    `xml:"type,attr,omitempty"` // "jid", "group" or "subscription"
+    Value       string    `xml:"value,attr,omitempty"`
+    Action      string    `xml:"action,attr"` // "allow" or "deny"
+    Order       int       `xml:"order,attr"`
+    PresenceOut *struct{} `xml:"presence-out"`
+}
+
+// Visibility is how the session hides its presence.
+type Visibility int
+
+const (
+    Visible                Visibility = iota
+    InvisibleByCommand                // XEP-0186 invisible command
+    InvisibleByPrivacyList            // privacy list blocking outgoing presence (XEP-0126)
+)
+
+// visibility is the invisibility state and the directed presences of a
+// session.
+type visibility struct {
+    mu       sync.Mutex
+    mode     Visibility
+    directed map[jid.JID]*Presence // available presences sent to a single entity
+}
+
+// Visibility returns how the session hides its presence.
+func (h *XMPPHandler) Visibility() Visibility {
+    h.vis.mu.Lock()
+    defer h.vis.mu.Unlock()
+    return h.vis.mode
+}
+
+// SetInvisible hides our presence from every contact, or shows it again.
+// Messages still arrive and directed presence still reaches its recipient.
+// The XEP-0186 command is used when the server supports it; otherwise a
+// privacy list blocks the outgoing presence.
+func (h *XMPPHandler) SetInvisible(invisible bool) error {
+    current := h.Visibility()
+    if invisible == (current != Visible) {
+        return nil
+    }
+
+    var err error
+    mode := Visible
+    switch {
+    case invisible:
+        mode = InvisibleByCommand
+        err = h.visibilityRequest(&InvisibleCommand{})
+        if err != nil {
+            Logger("presence").Info("invisible command not supported, using a privacy list", "err", err)
+            mode = InvisibleByPrivacyList
+            err = h.hideWithPrivacyList()
+        }
+    case current == InvisibleByCommand:
+        err = h.visibilityRequest(&VisibleCommand{})
+    default:
+        err = h.visibilityRequest(&PrivacyQuery{Active: &PrivacyActive{}})
+    }
+    if err != nil {
+        return fmt.Errorf("failed to change visibility: %w", err)
+    }
+
+    h.vis.mu.Lock()
+    h.vis.mode = mode
+    h.vis.mu.Unlock()
+    Logger("presence").Info("visibility changed", "invisible", invisible, "mode", mode)
+
+    // Send the presence again: contacts get it when we become visible, and
+    // the server keeps treating the session as available while invisible.
+    if own, ok := h.OwnPresence(); ok && own.IsAvailable() {
+        return h.SendPresence(own)
+    }
+    return nil
+}
+
+// hideWithPrivacyList goes invisible as XEP-0126 §3 does: an unavailable
+// presence first, so that the contacts see us go offline, then the list that
+// blocks our presence from now on. The available presence sent afterwards
+// only reaches the server and the entities the list allows.
+func (h *XMPPHandler) hideWithPrivacyList() error {
+    if own, ok := h.OwnPresence(); ok && own.IsAvailable() {
+        // Not through SendPresence: our own presence stays the available one.
+        if err := h.SendStanza(NewPresence(jid.JID{}, "unavailable", ShowAvailable, "", 0)); err != nil {
+            return err
+        }
+    }
+    return h.activateInvisibleList(h.directedTargets())
+}
+
+// activateInvisibleList stores a privacy list that blocks outgoing presence
+// except to the allowed entities, and makes it the active list.
+func (h *XMPPHandler) activateInvisibleList(allowed []jid.JID) error {
+    list := PrivacyList{Name: invisibleList}
+    for i, entity := range allowed {
+        list.Items = append(list.Items, PrivacyItem{Type: "jid", Value: entity.String(), Action: "allow", Order: i + 1, PresenceOut: &struct{}{}})
+    }
+    list.Items = append(list.Items, PrivacyItem{Action: "deny", Order: len(allowed) + 1, PresenceOut: &struct{}{}})
+
+    if err := h.visibilityRequest(&PrivacyQuery{Lists: []PrivacyList{list}}); err != nil {
+        return err
+    }
+    return h.visibilityRequest(&PrivacyQuery{Active: &PrivacyActive{Name: invisibleList}})
+}
+
+func (h *XMPPHandler) visibilityRequest(payload interface{}) error {
+    request := NewIQ("set", "")
+    request.SetQuery(payload)
+    response, err := h.SendIQ(request)
+    if err != nil {
+        return err
+    }
+    if response.Type == "error" {
+        if response.Error != nil {
+            return response.Error
+        }
+        return errors.New("request refused")
+    }
+    return nil
+}
+
+// DirectedPresences returns a copy of the available presences sent to single
+// entities that were not ended yet.
+func (h *XMPPHandler) DirectedPresences() []*Presence {
+    h.vis.mu.Lock()
+    presences := make([]*Presence, 0, len(h.vis.directed))
+    for _, pres := range h.vis.directed {
+        presences = append(presences, pres.clone())
+    }
+    h.vis.mu.Unlock()
+
+    sort.Slice(presences, func(i, j int) bool {
+        return presences[i].To.String() < presences[j].To.String()
+    })
+    return presences
+}
+
+// EndDirectedPresences sends unavailable presence to every entity that got a
+// directed presence, as we do on logout.
+func (h *XMPPHandler) EndDirectedPresences() error {
+    var errs []error
+    for _, pres := range h.DirectedPresences() {
+        if err := h.SendPresence(NewPresence(pres.To, "unavailable", ShowAvailable, "", 0)); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func (h *XMPPHandler) directedTargets() []jid.JID {
+    h.vis.mu.Lock()
+    defer h.vis.mu.Unlock()
+    targets := make([]jid.JID, 0, len(h.vis.directed))
+    for target := range h.vis.directed {
+        targets = append(targets, target)
+    }
+    sort.Slice(targets, func(i, j int) bool { return targets[i].String() < targets[j].String() })
+    return targets
+}
+
+// allowDirected lets a directed presence through the invisible privacy
+// list, if that is how the session is invisible.
+func (h *XMPPHandler) allowDirected(to jid.JID) error {
+    h.vis.mu.Lock()
+    mode, known := h.vis.mode, h.vis.directed[to] != nil
+    h.vis.mu.Unlock()
+    if mode != InvisibleByPrivacyList || known {
+        return nil
+    }
+    return h.activateInvisibleList(append(h.directedTargets(), to))
+}
+
+// trackDirected records a presence sent to a single entity.
+func (h *XMPPHandler) trackDirected(pres *Presence) {
+    h.vis.mu.Lock()
+    defer h.vis.mu.Unlock()
+    switch {
+    case pres.IsAvailable():
+        if h.vis.directed == nil {
+            h.vis.directed = make(map[jid.JID]*Presence)
+        }
+        h.vis.directed[pres.To] = pres.clone()
+    case pres.IsUnavailable():
+        delete(h.vis.directed, pres.To)
+    }
+}
+
+func (v Visibility) String() string {
+    switch v {
+    case InvisibleByCommand:
+        return "invisible"
+    case InvisibleByPrivacyList:
+        return "invisible (privacy list)"
+    }
+    return "visible"
+}
@@ -1,9 +1,1756 @@
 package xmpp
 
-// import (
-//     "log"
-// )
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
 
-// func LogInTest() {
-    
-// }
+    "github.com/adrianfulla/Proyecto1-Redes/server/xmpp/jid"
+)
+
+func TestParseStanza(t *testing.T) {
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {`<message from='a@b.c/d' type='chat'><body>hi</body></message>`, "*xmpp.Message"},
+        {`<?xml version='1.0'?> <presence from='a@b.c/d'><show>away</show></presence>`, "*xmpp.Presence"},
+        {`<iq xmlns='jabber:client' type='result' id='x'><query xmlns='jabber:iq:roster'/></iq>`, "*xmpp.IQ"},
+        {`<a xmlns='urn:xmpp:sm:3' h='1'/>`, "*xmpp.RawStanza"},
+        {`<r xmlns='urn:xmpp:sm:3'/>`, "*xmpp.RawStanza"},
+        {`<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>`, "*xmpp.RawStanza"},
+    }
+    for _, tt := range tests {
+        stanza, err := ParseStanza([]byte(tt.in))
+        if err != nil {
+            t.Errorf("ParseStanza(%q): %v", tt.in, err)
+            continue
+        }
+        if got := typeName(stanza); got != tt.want {
+            t.Errorf("ParseStanza(%q) = %s, want %s", tt.in, got, tt.want)
+        }
+    }
+
+    msg, _ := ParseStanza([]byte(tests[0].in))
+    if body := msg.(*Message).Body; body != "hi" {
+        t.Errorf("message body = %q", body)
+    }
+    raw, _ := ParseStanza([]byte(tests[3].in))
+    if out, _ := raw.ToXML(); out != tests[3].in {
+        t.Errorf("raw stanza = %q, want %q", out, tests[3].in)
+    }
+}
+
+func TestParseStanzaInvalid(t *testing.T) {
+    for _, in := range []string{
+        ``,
+        `hello`,
+        `<message>`,
+        `<message/><message/>`,
+        `<message from='not a jid@'/>`,
+    } {
+        if _, err := ParseStanza([]byte(in)); err == nil {
+            t.Errorf("ParseStanza(%q): expected an error", in)
+        }
+    }
+}
+
+func FuzzParseStanza(f *testing.F) {
+    f.Add(`<message to='a@b.c' type='chat'><body>a &amp; b</body><thread>t</thread></message>`)
+    f.Add(`<presence type='unavailable'><status>bye</status><priority>-1</priority></presence>`)
+    f.Add(`<iq type='error' id='1'><query xmlns='jabber:iq:register'/><error type='cancel'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>`)
+    f.Add(`<stream:features/>`)
+    f.Add(`<presence><c xmlns='http://jabber.org/protocol/caps' hash='sha-1' node='n' ver='v'/><x xmlns='vcard-temp:x:update'><photo/></x></presence>`)
+    f.Fuzz(func(t *testing.T, in string) {
+        stanza, err := ParseStanza([]byte(in))
+        if err != nil {
+            return
+        }
+        out, err := stanza.ToXML()
+        if err != nil {
+            t.Fatalf("ToXML of parsed %q: %v", in, err)
+        }
+        again, err := ParseStanza([]byte(out))
+        if err != nil {
+            t.Fatalf("re-parsing %q (from %q): %v", out, in, err)
+        }
+        if typeName(again) != typeName(stanza) {
+            t.Fatalf("re-parsing %q gave %s, want %s", out, typeName(again), typeName(stanza))
+        }
+    })
+}
+
+func TestOutboundEscaping(t *testing.T) {
+    body := `a < b && c > d</body></message><iq type='set' id='evil'/><message><body>`
+    out, err := NewMessage(jid.MustParse("a@b.c"), "chat", body).ToXML()
+    if err != nil {
+        t.Fatal(err)
+    }
+    stanza, err := ParseStanza([]byte(out))
+    if err != nil {
+        t.Fatalf("parsing %s: %v", out, err)
+    }
+    msg, ok := stanza.(*Message)
+    if !ok || msg.Body != body {
+        t.Fatalf("body did not survive escaping: %s", out)
+    }
+
+    presence := NewPresence(jid.MustParse("room@muc.b.c/nick"), "", "", `"'/><presence type='unavailable`, 0)
+    if err := presence.Extensions.Add(MUCJoin{Password: "<&>"}); err != nil {
+        t.Fatal(err)
+    }
+    out, _ = presence.ToXML()
+    parsed, err := ParsePresence([]byte(out))
+    if err != nil || parsed.Status != presence.Status || len(parsed.Extensions) != 1 {
+        t.Fatalf("presence did not survive escaping: %s (%v)", out, err)
+    }
+}
+
+type testReceipt struct {
+    XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+    ID      string   `xml:"id,attr"`
+}
+
+func TestExtensionsRoundTrip(t *testing.T) {
+    if err := RegisterExtension("urn:xmpp:receipts", "received", testReceipt{}); err != nil {
+        t.Fatal(err)
+    }
+
+    in := `<message from='a@b.c/d' to='e@f.g' type='chat'>` +
+        `<body>hi</body>` +
+        `<active xmlns='http://jabber.org/protocol/chatstates'/>` +
+        `<delay xmlns='urn:xmpp:delay' from='b.c' stamp='2024-08-14T01:29:38Z'>Offline storage</delay>` +
+        `<received xmlns='urn:xmpp:receipts' id='m1'/>` +
+        `</message>`
+    msg, err := ParseMessage([]byte(in))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(msg.Extensions) != 3 {
+        t.Fatalf("got %d extensions, want 3", len(msg.Extensions))
+    }
+
+    var receipt testReceipt
+    if found, err := msg.Extensions.Get(&receipt); !found || err != nil || receipt.ID != "m1" {
+        t.Fatalf("Get(receipt) = %v, %v, %+v", found, err, receipt)
+    }
+
+    out, err := msg.ToXML()
+    if err != nil {
+        t.Fatal(err)
+    }
+    again, err := ParseMessage([]byte(out))
+    if err != nil {
+        t.Fatalf("re-parsing %s: %v", out, err)
+    }
+    delay, ok := again.Extensions.Find("urn:xmpp:delay", "delay")
+    if !ok || string(delay.Inner) != "Offline storage" || len(delay.Attr) != 2 {
+        t.Fatalf("delay did not survive the round trip: %s", out)
+    }
+
+    // Attaching a typed payload replaces the previous one.
+    if err := again.Extensions.Add(testReceipt{ID: "m2"}); err != nil {
+        t.Fatal(err)
+    }
+    out, _ = again.ToXML()
+    if strings.Count(out, "<received") != 1 || !strings.Contains(out, `id="m2"`) {
+        t.Fatalf("unexpected receipts in %s", out)
+    }
+}
+
+func TestEvents(t *testing.T) {
+    h := &XMPPHandler{}
+    var got []Event
+    unsubscribe := h.Subscribe(SubscriberFunc(func(ev Event) {
+        got = append(got, ev)
+    }))
+
+    for _, in := range []string{
+        `<message from='a@b.c/d' type='chat'><body>hi</body></message>`,
+        `<presence from='a@b.c/d'><show>away</show></presence>`,
+        `<presence from='e@b.c' type='subscribe'/>`,
+    } {
+        stanza, err := ParseStanza([]byte(in))
+        if err != nil {
+            t.Fatal(err)
+        }
+        h.dispatchStanza(stanza)
+    }
+
+    if len(got) != 3 {
+        t.Fatalf("got %d events, want 3", len(got))
+    }
+    if ev, ok := got[0].(*MessageEvent); !ok || ev.Message.Body != "hi" {
+        t.Errorf("event 0 = %#v", got[0])
+    }
+    if ev, ok := got[1].(*PresenceEvent); !ok || ev.Presence.Show != "away" {
+        t.Errorf("event 1 = %#v", got[1])
+    }
+    if ev, ok := got[2].(*SubscriptionEvent); !ok || ev.From != jid.MustParse("e@b.c") || ev.Type != "subscribe" {
+        t.Errorf("event 2 = %#v", got[2])
+    }
+
+    unsubscribe()
+    h.DispatchMessage(&Message{Body: "later"})
+    if len(got) != 3 {
+        t.Errorf("event delivered after unsubscribing")
+    }
+}
+
+// TestConcurrentState runs the stanza reader paths and the UI accessors at the
+// same time. Run it with -race.
+func TestConcurrentState(t *testing.T) {
+    h := &XMPPHandler{}
+    unsubscribe := h.Subscribe(SubscriberFunc(func(ev Event) {
+        if ev, ok := ev.(*MessageEvent); ok {
+            h.MarkUnread(ev.Message.From)
+        }
+    }))
+    defer unsubscribe()
+
+    const n = 200
+    var wg sync.WaitGroup
+    wg.Add(3)
+    go func() {
+        defer wg.Done()
+        for i := 0; i < n; i++ {
+            h.handlePresence(incomingPresence(fmt.Sprintf("c%d@b.c/r", i%10), fmt.Sprintf("status %d", i)))
+        }
+    }()
+    go func() {
+        defer wg.Done()
+        for i := 0; i < n; i++ {
+            h.DispatchMessage(&Message{From: jid.MustParse(fmt.Sprintf("c%d@b.c/r", i%10)), Body: "hi"})
+        }
+    }()
+    go func() {
+        defer wg.Done()
+        for i := 0; i < n; i++ {
+            contact := jid.MustParse(fmt.Sprintf("c%d@b.c", i%10))
+            if pres, ok := h.Presence(contact); ok {
+                pres.Status = "changed by the UI"
+                pres.Extensions = append(pres.Extensions, Extension{})
+            }
+            for _, pres := range h.Presences() {
+                _ = pres.Status
+            }
+            h.UnreadCount(contact)
+            h.MarkRead(contact)
+            h.Subscribe(SubscriberFunc(func(Event) {}))()
+        }
+    }()
+    wg.Wait()
+
+    presences := h.Presences()
+    if len(presences) != 10 {
+        t.Fatalf("got presences for %d contacts, want 10", len(presences))
+    }
+    for contact, pres := range presences {
+        if pres.Status == "changed by the UI" || len(pres.Extensions) != 0 {
+            t.Errorf("presence of %s was modified through a copy: %+v", contact, pres)
+        }
+    }
+}
+
+func TestPresenceAPI(t *testing.T) {
+    in := `<presence from='bob@b.c/r'><show>away</show>` +
+        `<status xml:lang='es'>Almorzando</status><status>Lunch</status><status xml:lang='de-AT'>Mittagessen</status>` +
+        `<priority>-1</priority></presence>`
+    stanza, err := ParseStanza([]byte(in))
+    if err != nil {
+        t.Fatal(err)
+    }
+    pres := stanza.(*Presence)
+    if pres.Show != ShowAway || pres.Priority != -1 || pres.Status != "Lunch" || len(pres.Statuses) != 2 {
+        t.Fatalf("parsed %+v", pres)
+    }
+    if got := pres.StatusIn("es"); got != "Almorzando" {
+        t.Errorf("StatusIn(es) = %q", got)
+    }
+    if got := pres.StatusIn("de"); got != "Mittagessen" {
+        t.Errorf("StatusIn(de) = %q", got)
+    }
+    if got := pres.StatusIn("fr"); got != "Lunch" {
+        t.Errorf("StatusIn(fr) = %q", got)
+    }
+    out, _ := pres.ToXML()
+    if strings.Count(out, "<status") != 3 || !strings.Contains(out, `xml:lang="es"`) {
+        t.Errorf("marshaled %s", out)
+    }
+
+    // A translation with the same text as the default doesn't replace it.
+    same := &Presence{Status: "Lunch", Statuses: []LangText{{Lang: "en", Text: "Lunch"}, {Lang: "es", Text: "Almorzando"}}}
+    out, _ = same.ToXML()
+    stanza, err = ParseStanza([]byte(out))
+    if err != nil {
+        t.Fatal(err)
+    }
+    pres = stanza.(*Presence)
+    if pres.Status != "Lunch" || len(pres.Statuses) != 2 || !strings.Contains(out, "<status>Lunch</status>") {
+        t.Errorf("round trip of %s = %+v", out, pres)
+    }
+    if got := pres.StatusIn("fr"); got != "Lunch" {
+        t.Errorf("StatusIn(fr) after the round trip = %q", got)
+    }
+
+    invalid := []*Presence{
+        {Show: "presence"},
+        {Type: "available"},
+        {Type: "unavailable", Show: ShowDND},
+        {Priority: 128},
+        {Statuses: []LangText{{Lang: "en", Text: "a"}, {Lang: "en", Text: "b"}}},
+    }
+    for _, pres := range invalid {
+        if pres.Validate() == nil {
+            t.Errorf("%+v is valid", pres)
+        }
+    }
+    if show, err := ParseShow("Online"); err != nil || show != ShowAvailable {
+        t.Errorf("ParseShow(Online) = %q, %v", show, err)
+    }
+
+    h, sent := newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    if err := h.SetAvailability(ShowDND, "Busy", 5); err != nil {
+        t.Fatal(err)
+    }
+    if pres := (<-sent).(*Presence); pres.Show != ShowDND || pres.Priority != 5 || pres.Status != "Busy" {
+        t.Errorf("sent %+v", pres)
+    }
+    if own, ok := h.OwnPresence(); !ok || own.Show != ShowDND {
+        t.Errorf("own presence = %+v", own)
+    }
+}
+
+func TestAutoAway(t *testing.T) {
+    h, sent := newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    h.SetAvailability(ShowChat, "Around", 3)
+    <-sent
+
+    auto := NewAutoAway(h, 5*time.Minute, 15*time.Minute)
+    auto.Activity()
+    start := time.Now()
+    if err := auto.Check(start.Add(time.Minute)); err != nil {
+        t.Fatal(err)
+    }
+    steps := []struct {
+        idle time.Duration
+        want Show
+    }{
+        {6 * time.Minute, ShowAway},
+        {16 * time.Minute, ShowXA},
+    }
+    for _, step := range steps {
+        if err := auto.Check(start.Add(step.idle)); err != nil {
+            t.Fatal(err)
+        }
+        pres := (<-sent).(*Presence)
+        since, ok := pres.IdleSince()
+        if pres.Show != step.want || pres.Status != "Around" || pres.Priority != 3 || !ok || since.After(start) {
+            t.Errorf("sent %+v idle since %v, want %s", pres, since, step.want)
+        }
+    }
+
+    auto.Activity()
+    pres := (<-sent).(*Presence)
+    if _, idle := pres.IdleSince(); pres.Show != ShowChat || idle {
+        t.Errorf("restored %+v", pres)
+    }
+
+    // A presence the user chose is not replaced.
+    h.SetAvailability(ShowDND, "", 0)
+    <-sent
+    auto.Check(time.Now().Add(time.Hour))
+    select {
+    case pres := <-sent:
+        t.Errorf("sent %+v while in do not disturb", pres)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
+
+func TestPresenceHistory(t *testing.T) {
+    store := &FilePresenceHistory{Dir: t.TempDir()}
+    h, _ := newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    h.UsePresenceHistory(store)
+
+    bob := jid.MustParse("bob@b.c")
+    deliver(h, incomingPresence("bob@b.c/phone", "Around"))
+    deliver(h, incomingPresence("bob@b.c/phone", "Around")) // a repeat is not recorded
+    deliver(h, &Presence{From: jid.MustParse("bob@b.c/phone"), Type: "unavailable"})
+
+    records, err := h.PresenceHistory(bob, 0)
+    if err != nil || len(records) != 2 || !records[0].Available() || records[0].Status != "Around" || records[1].Available() {
+        t.Fatalf("history = %+v, %v", records, err)
+    }
+    if seen, ok := h.LastSeen(bob); !ok || !seen.Equal(records[1].Time) {
+        t.Errorf("last seen = %v, %v", seen, ok)
+    }
+
+    // The next session reads the last seen time from the history.
+    h, _ = newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        result := &IQ{Type: "result", ID: iq.ID, From: iq.To}
+        result.SetQuery(&LastActivity{Seconds: 3600, Status: "Gone fishing"})
+        deliver(h, result)
+    })
+    h.UsePresenceHistory(store)
+    if seen, ok := h.LastSeen(bob); !ok || !seen.Equal(records[1].Time) {
+        t.Errorf("last seen from the history = %v, %v", seen, ok)
+    }
+
+    // Without a history, the server tells.
+    carol := jid.MustParse("carol@b.c")
+    if _, ok := h.LastSeen(carol); ok {
+        t.Error("carol was never seen")
+    }
+    seen, status, err := h.QueryLastActivity(carol)
+    if err != nil || status != "Gone fishing" || time.Since(seen) < 59*time.Minute {
+        t.Fatalf("last activity = %v, %q, %v", seen, status, err)
+    }
+    if last, ok := h.LastSeen(carol); !ok || !last.Equal(seen) {
+        t.Errorf("last seen = %v, %v", last, ok)
+    }
+}
+
+func TestPEP(t *testing.T) {
+    // The example of XEP-0115 §5.2.
+    ver := capsVer([]DiscoIdentity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}}, []string{
+        "http://jabber.org/protocol/disco#info", "http://jabber.org/protocol/disco#items",
+        "http://jabber.org/protocol/muc", "http://jabber.org/protocol/caps",
+    })
+    if ver != "QgayPKawpkPSDYmwT/WM94uAlu0=" {
+        t.Errorf("caps ver = %q", ver)
+    }
+
+    var (
+        mu        sync.Mutex
+        published []PubSub
+    )
+    h, sent := newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        var query PubSub
+        iq.DecodePayload(&query)
+        mu.Lock()
+        published = append(published, query)
+        mu.Unlock()
+        deliver(h, &IQ{Type: "result", ID: iq.ID})
+    })
+    h.SetAvailability(ShowAvailable, "", 0)
+    <-sent
+    if err := h.Notify(NodeMood, true); err != nil {
+        t.Fatal(err)
+    }
+    var caps Caps
+    if found, _ := (<-sent).(*Presence).Extensions.Get(&caps); !found || caps.Ver != h.Caps().Ver {
+        t.Fatalf("presence caps = %+v, want %+v", caps, h.Caps())
+    }
+    // disco#info, caps, version, receipts, idle and mood+notify.
+    if caps.Ver != "awKjqDe9g6aII58w6185aVaJyXY=" {
+        t.Errorf("caps ver = %q", caps.Ver)
+    }
+
+    // Contacts that ask what the caps stand for learn the +notify interest.
+    deliver(h, &IQ{Type: "get", ID: "disco1", From: jid.MustParse("bob@b.c/phone"), Query: &DiscoInfo{Node: caps.Node + "#" + caps.Ver}})
+    answer := (<-sent).(*IQ)
+    var info DiscoInfo
+    if err := answer.DecodePayload(&info); err != nil || answer.Type != "result" {
+        t.Fatalf("disco answer %+v: %v", answer, err)
+    }
+    var vars []string
+    for _, feature := range info.Features {
+        vars = append(vars, feature.Var)
+    }
+    if !contains(vars, NodeMood+"+notify") || !contains(vars, nsReceipts) || !contains(vars, nsIdle) || capsVer(info.Identities, vars) != caps.Ver {
+        t.Errorf("disco features = %v", vars)
+    }
+    deliver(h, &IQ{Type: "get", ID: "disco2", From: jid.MustParse("bob@b.c/phone"), Query: &DiscoInfo{Node: caps.Node + "#stale"}})
+    if answer := (<-sent).(*IQ); answer.Type != "error" || answer.Error == nil || answer.Error.Condition != "item-not-found" {
+        t.Errorf("disco answer for an unknown node = %+v", answer)
+    }
+
+    if err := h.PublishMood(Mood{Value: "happy", Text: "Sunny"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := h.PublishMood(Mood{Value: "elated"}); err == nil {
+        t.Error("published an unknown mood")
+    }
+    mu.Lock()
+    item := published[0].Publish.Items[0]
+    mu.Unlock()
+    var mood Mood
+    if len(item.Payload) != 1 || item.Payload[0].Decode(&mood) != nil || mood.Value != "happy" || mood.Text != "Sunny" {
+        t.Errorf("published %+v", item)
+    }
+
+    var events []*PEPEvent
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        if ev, ok := ev.(*PEPEvent); ok {
+            events = append(events, ev)
+        }
+    }))
+    event := func(node string, payload interface{}) *Message {
+        ext, _ := NewExtension(payload)
+        msg := &Message{From: jid.MustParse("bob@b.c")}
+        msg.Extensions.Add(PubSubEvent{Items: PubSubEventItems{Node: node, Items: []PubSubItem{{ID: "current", Payload: Extensions{ext}}}}})
+        return msg
+    }
+    deliver(h, event(NodeMood, Mood{Value: "in_love"}))
+    h.Notify(NodeActivity, true)
+    <-sent
+    deliver(h, event(NodeActivity, Activity{General: "working", Specific: "coding", Text: "Go"}))
+    deliver(h, event(NodeTune, Tune{Title: "Song"})) // not asked for
+    bob := jid.MustParse("bob@b.c")
+    if got, ok := h.ContactMood(bob); !ok || got.Value != "in_love" || got.String() != "in love" {
+        t.Errorf("bob's mood = %+v, %v", got, ok)
+    }
+    if got, ok := h.ContactActivity(bob); !ok || got.String() != "working: coding (Go)" {
+        t.Errorf("bob's activity = %+v, %v", got, ok)
+    }
+    if _, ok := h.ContactTune(bob); ok || len(events) != 2 {
+        t.Errorf("events = %+v", events)
+    }
+
+    // An empty mood clears it.
+    deliver(h, event(NodeMood, Mood{}))
+    if got, ok := h.ContactMood(bob); ok {
+        t.Errorf("cleared mood = %+v", got)
+    }
+}
+
+func TestChatHistory(t *testing.T) {
+    store := &FileHistoryStore{Dir: t.TempDir()}
+    h, sent := newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    h.UseHistory(store)
+    var deliveries []*DeliveryEvent
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        if ev, ok := ev.(*DeliveryEvent); ok {
+            deliveries = append(deliveries, ev)
+        }
+    }))
+    bob := jid.MustParse("bob@b.c")
+
+    if err := h.SendMessage(bob, "hello"); err != nil {
+        t.Fatal(err)
+    }
+    out := (<-sent).(*Message)
+    var request ReceiptRequest
+    if found, _ := out.Extensions.Get(&request); !found || out.ID == "" {
+        t.Fatalf("sent %+v without a receipt request", out)
+    }
+
+    // Bob's client confirms it, then answers with a stored message.
+    receipt := &Message{From: jid.MustParse("bob@b.c/phone"), ID: "r1"}
+    receipt.Extensions.Add(ReceiptReceived{ID: out.ID})
+    deliver(h, receipt)
+    stamp := time.Date(2024, 8, 14, 1, 29, 38, 0, time.UTC)
+    reply := &Message{From: jid.MustParse("bob@b.c/phone"), ID: "m1", Type: "chat", Body: "hi"}
+    reply.Extensions.Add(ReceiptRequest{})
+    reply.Extensions.Add(Delay{Stamp: stamp})
+    deliver(h, reply)
+
+    var answer ReceiptReceived
+    if found, _ := (<-sent).(*Message).Extensions.Get(&answer); !found || answer.ID != "m1" {
+        t.Errorf("receipt sent = %+v", answer)
+    }
+    if len(deliveries) != 1 || deliveries[0].ID != out.ID || deliveries[0].State != MessageDelivered || deliveries[0].Contact != bob {
+        t.Errorf("delivery events = %+v", deliveries)
+    }
+
+    // The next session pages back through the conversation.
+    for i := 0; i < 3; i++ {
+        h.SendMessage(bob, fmt.Sprintf("more %d", i))
+        <-sent
+    }
+    h, _ = newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    h.UseHistory(store)
+    last, err := h.ChatHistory(bob, 0, 3)
+    if err != nil || len(last) != 3 || last[0].Body != "more 0" || last[2].Body != "more 2" {
+        t.Fatalf("last page = %+v, %v", last, err)
+    }
+    older, _ := h.ChatHistory(bob, 3, 3)
+    if len(older) != 2 {
+        t.Fatalf("older page = %+v", older)
+    }
+    if first := older[0]; first.Body != "hello" || first.Direction != Outbound || first.State != MessageDelivered {
+        t.Errorf("first message = %+v", first)
+    }
+    if second := older[1]; second.Body != "hi" || second.Direction != Inbound || second.ID != "m1" || !second.Time.Equal(stamp) {
+        t.Errorf("second message = %+v", second)
+    }
+
+    // A stanza ID only matches a message the archive IDs cannot tell apart.
+    store.AppendMessage(HistoryRecord{ID: "m2", ArchiveID: "a2", Contact: bob, Body: "archived"})
+    index, err := store.Index(bob)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !index.Holds("m1", "") || !index.Holds("m1", "a1") || !index.Holds("", "a2") || !index.Holds("m2", "") {
+        t.Errorf("index misses messages: %+v", index)
+    }
+    if index.Holds("m2", "a3") || index.Holds("m3", "") || index.Holds("", "") {
+        t.Errorf("index holds messages it should not: %+v", index)
+    }
+}
+
+func TestArchive(t *testing.T) {
+    me, bob := jid.MustParse("me@b.c"), jid.MustParse("bob@b.c")
+    base := time.Date(2024, 8, 14, 1, 0, 0, 0, time.UTC)
+    type entry struct {
+        id  string
+        msg *Message
+    }
+    var archive []entry
+    for i := 1; i <= 5; i++ {
+        msg := &Message{From: jid.MustParse("bob@b.c/phone"), To: jid.MustParse("me@b.c/r"), ID: fmt.Sprintf("m%d", i), Type: "chat", Body: fmt.Sprintf("msg %d", i)}
+        if i == 4 {
+            msg.From, msg.To = jid.MustParse("me@b.c/other"), bob
+        }
+        archive = append(archive, entry{fmt.Sprintf("a%d", i), msg})
+    }
+    stamp := func(i int) time.Time { return base.Add(time.Duration(i) * time.Minute) }
+
+    // The server returns pages of two at most.
+    var (
+        mu      sync.Mutex
+        queries []MAMQuery
+    )
+    h, _ := newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        var query MAMQuery
+        iq.DecodePayload(&query)
+        mu.Lock()
+        queries = append(queries, query)
+        forge := len(queries) == 1
+        mu.Unlock()
+
+        index := func(id string) int {
+            for i, e := range archive {
+                if e.id == id {
+                    return i
+                }
+            }
+            return -1
+        }
+        start, end := 0, len(archive)
+        if after := query.Set.After; after != nil {
+            if start = index(*after) + 1; start == 0 {
+                deliver(h, &IQ{Type: "error", ID: iq.ID, Error: &StanzaError{Type: "cancel", Condition: "item-not-found"}})
+                return
+            }
+        }
+        if before := query.Set.Before; before != nil && *before != "" {
+            end = index(*before)
+        }
+        if query.Set.Before != nil {
+            start = max(start, end-2)
+        } else {
+            end = min(end, start+2)
+        }
+        if forge {
+            result := &Message{From: jid.MustParse("eve@b.c")}
+            result.Extensions.Add(MAMResult{QueryID: query.QueryID, ID: "x", Forwarded: Forwarded{Message: &Message{From: bob, Body: "forged"}}})
+            deliver(h, result)
+        }
+        fin := &MAMFin{Complete: end == len(archive)}
+        if query.Set.Before != nil {
+            fin.Complete = start == 0
+        }
+        for i, e := range archive[start:end] {
+            result := &Message{From: me}
+            result.Extensions.Add(MAMResult{QueryID: query.QueryID, ID: e.id, Forwarded: Forwarded{Delay: &Delay{Stamp: stamp(start + i + 1)}, Message: e.msg}})
+            deliver(h, result)
+        }
+        if start < end {
+            fin.Set.First, fin.Set.Last = archive[start].id, archive[end-1].id
+        }
+        deliver(h, &IQ{Type: "result", ID: iq.ID, Query: fin})
+    })
+    store := &MemoryHistoryStore{}
+    h.UseHistory(store)
+    var syncs []*ArchiveSyncEvent
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        if ev, ok := ev.(*ArchiveSyncEvent); ok {
+            syncs = append(syncs, ev)
+        }
+    }))
+
+    // A previous session synced up to a1, then sent m4.
+    store.SetArchiveMark("a1")
+    store.AppendMessage(HistoryRecord{ID: "m4", Contact: bob, Direction: Outbound, Body: "msg 4", Time: stamp(4), State: MessageDelivered})
+
+    // This session receives m5 live, with its archive ID, before catching up.
+    // The messages archived before it are still to be synced.
+    live := &Message{From: jid.MustParse("bob@b.c/phone"), ID: "m5", Type: "chat", Body: "msg 5"}
+    live.Extensions.Add(StanzaID{By: jid.MustParse("other@b.c"), ID: "forged"})
+    live.Extensions.Add(StanzaID{By: me, ID: "a5"})
+    live.Extensions.Add(Delay{Stamp: stamp(5)})
+    deliver(h, live)
+    if mark, _ := store.ArchiveMark(); mark != "a1" {
+        t.Fatalf("mark after a live message = %q", mark)
+    }
+    if records, _ := h.ChatHistory(bob, 0, 0); len(records) != 2 || records[1].ArchiveID != "a5" {
+        t.Fatalf("history after a live message = %+v", records)
+    }
+
+    // Catching up pages from the mark, adding m2 and m3 only.
+    if err := h.CatchUp(); err != nil {
+        t.Fatal(err)
+    }
+    if len(queries) != 2 || *queries[0].Set.After != "a1" || *queries[1].Set.After != "a3" {
+        t.Errorf("catch-up queries = %+v", queries)
+    }
+    if form := queries[0].Form; form == nil || form.FormType() != nsMAM || form.Field("with") != nil {
+        t.Errorf("catch-up form = %+v", form)
+    }
+    if len(syncs) != 1 || syncs[0].Added != 2 || len(syncs[0].Contacts) != 1 || syncs[0].Contacts[0] != bob {
+        t.Errorf("sync events = %+v", syncs)
+    }
+    if mark, _ := store.ArchiveMark(); mark != "a5" {
+        t.Errorf("mark after catching up = %q", mark)
+    }
+    if err := h.CatchUp(); err != nil || len(syncs) != 1 {
+        t.Errorf("second catch-up = %v, events %+v", err, syncs)
+    }
+
+    // A mark the server forgot starts over from the last page.
+    store.SetArchiveMark("gone")
+    if err := h.CatchUp(); err != nil {
+        t.Fatal(err)
+    }
+    if mark, _ := store.ArchiveMark(); mark != "a5" || len(syncs) != 1 {
+        t.Errorf("mark after starting over = %q, events %+v", mark, syncs)
+    }
+
+    // Back-filling the conversation pages back to its start.
+    var before string
+    added := 0
+    for pages := 0; ; pages++ {
+        page, n, err := h.BackfillConversation(bob, before)
+        if err != nil {
+            t.Fatal(err)
+        }
+        added += n
+        if page.Complete || pages == 5 {
+            break
+        }
+        before = page.First
+    }
+    if added != 1 {
+        t.Errorf("back-filled %d messages, want 1", added)
+    }
+    mu.Lock()
+    last := queries[len(queries)-1]
+    mu.Unlock()
+    if with := last.Form.Field("with"); with == nil || with.Value() != "bob@b.c" {
+        t.Errorf("back-fill form = %+v", last.Form)
+    }
+
+    records, _ := h.ChatHistory(bob, 0, 0)
+    var bodies []string
+    for _, r := range records {
+        bodies = append(bodies, r.Body)
+    }
+    if got := strings.Join(bodies, ", "); got != "msg 1, msg 2, msg 3, msg 4, msg 5" {
+        t.Errorf("history = %s", got)
+    }
+    if r := records[3]; r.Direction != Outbound || r.State != MessageDelivered || r.Archived {
+        t.Errorf("our message = %+v", r)
+    }
+    if r := records[2]; r.ArchiveID != "a3" || !r.Archived || !r.Time.Equal(stamp(3)) || r.Direction != Inbound {
+        t.Errorf("archived message = %+v", r)
+    }
+}
+
+func TestInvisibleMode(t *testing.T) {
+    var (
+        mu    sync.Mutex
+        lists []PrivacyQuery
+    )
+    h, sent := newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        if iq.PayloadName().Space != "jabber:iq:privacy" {
+            // A server without XEP-0186.
+            deliver(h, &IQ{Type: "error", ID: iq.ID})
+            return
+        }
+        var query PrivacyQuery
+        iq.DecodePayload(&query)
+        mu.Lock()
+        lists = append(lists, query)
+        mu.Unlock()
+        deliver(h, &IQ{Type: "result", ID: iq.ID})
+    })
+    h.SetAvailability(ShowAvailable, "", 0)
+    <-sent
+
+    if err := h.SetInvisible(true); err != nil {
+        t.Fatal(err)
+    }
+    if h.Visibility() != InvisibleByPrivacyList {
+        t.Fatalf("visibility = %s", h.Visibility())
+    }
+    // The contacts see us go offline before the list blocks our presence.
+    if pres := (<-sent).(*Presence); !pres.To.IsZero() || pres.Type != "unavailable" {
+        t.Errorf("sent %+v before the list, want unavailable", pres)
+    }
+    if pres := (<-sent).(*Presence); !pres.IsAvailable() {
+        t.Errorf("sent %+v after the list, want available", pres)
+    }
+    if own, ok := h.OwnPresence(); !ok || !own.IsAvailable() {
+        t.Errorf("own presence = %+v", own)
+    }
+
+    // A directed presence gets through the list.
+    bob := jid.MustParse("bob@b.c")
+    if err := h.SendPresence(NewPresence(bob, "", ShowChat, "", 0)); err != nil {
+        t.Fatal(err)
+    }
+    <-sent
+    mu.Lock()
+    last := lists[len(lists)-2] // the list, then its activation
+    mu.Unlock()
+    if items := last.Lists[0].Items; len(items) != 2 || items[0].Value != "bob@b.c" || items[0].Action != "allow" {
+        t.Errorf("privacy list = %+v", items)
+    }
+    if directed := h.DirectedPresences(); len(directed) != 1 || directed[0].To != bob {
+        t.Errorf("directed presences = %+v", directed)
+    }
+
+    if err := h.EndDirectedPresences(); err != nil {
+        t.Fatal(err)
+    }
+    if pres := (<-sent).(*Presence); pres.To != bob || pres.Type != "unavailable" {
+        t.Errorf("sent %+v", pres)
+    }
+    if len(h.DirectedPresences()) != 0 {
+        t.Error("directed presence not ended")
+    }
+
+    if err := h.SetInvisible(false); err != nil || h.Visibility() != Visible {
+        t.Fatalf("visibility = %s, %v", h.Visibility(), err)
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if active := lists[len(lists)-1].Active; active == nil || active.Name != "" {
+        t.Errorf("active list not declined: %+v", lists[len(lists)-1])
+    }
+}
+
+func TestResourcePresence(t *testing.T) {
+    h := &XMPPHandler{}
+    bob := jid.MustParse("bob@b.c")
+    receive := func(from, typ string, show Show, priority int) {
+        h.handlePresence(&Presence{From: jid.MustParse(from), Type: typ, Show: show, Priority: priority})
+    }
+
+    receive("bob@b.c/laptop", "", "away", 5)
+    receive("bob@b.c/phone", "", "chat", 1)
+    receive("bob@b.c/tablet", "", "", 1)
+    if pres, _ := h.Presence(bob); pres.From.Resourcepart() != "laptop" {
+        t.Errorf("aggregate presence from %s, want laptop", pres.From)
+    }
+    var order []string
+    for _, pres := range h.Resources(bob) {
+        order = append(order, pres.From.Resourcepart())
+    }
+    if strings.Join(order, ",") != "laptop,phone,tablet" {
+        t.Errorf("resources = %v", order)
+    }
+
+    // Going offline on one device leaves the others online.
+    receive("bob@b.c/laptop", "unavailable", "", 0)
+    if pres, _ := h.Presence(bob); !pres.IsAvailable() || pres.From.Resourcepart() != "phone" {
+        t.Errorf("aggregate presence = %+v, want the phone", pres)
+    }
+    if pres, ok := h.Presence(jid.MustParse("bob@b.c/tablet")); !ok || pres.From.Resourcepart() != "tablet" {
+        t.Errorf("tablet presence = %+v, %v", pres, ok)
+    }
+
+    receive("bob@b.c", "unavailable", "", 0)
+    if pres, _ := h.Presence(bob); pres.IsAvailable() || len(h.Resources(bob)) != 0 {
+        t.Errorf("bob is still online: %+v", pres)
+    }
+}
+
+func TestInterceptors(t *testing.T) {
+    client, server := net.Pipe()
+    defer client.Close()
+    written := make(chan string, 10)
+    go func() {
+        buf := make([]byte, 4096)
+        for {
+            n, err := server.Read(buf)
+            if err != nil {
+                close(written)
+                return
+            }
+            written <- string(buf[:n])
+        }
+    }()
+
+    h := &XMPPHandler{Conn: &XMPPConnection{Conn: client}}
+    var events []Event
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        events = append(events, ev)
+    }))
+
+    // Spam filter: drop everything from spam@b.c.
+    h.AddInterceptor(InterceptorFunc(func(dir Direction, stanza Stanza) (Stanza, error) {
+        if msg, ok := stanza.(*Message); ok && dir == Inbound && msg.From.Bare() == jid.MustParse("spam@b.c") {
+            return nil, nil
+        }
+        return stanza, nil
+    }))
+    // Tag outgoing messages and answer pings locally.
+    removeTagger := h.AddInterceptor(InterceptorFunc(func(dir Direction, stanza Stanza) (Stanza, error) {
+        switch s := stanza.(type) {
+        case *Message:
+            if dir == Outbound {
+                s.Thread = "tagged"
+            }
+        case *IQ:
+            if dir == Outbound && s.PayloadName().Space == "urn:xmpp:ping" {
+                h.Inject(&IQ{Type: "result", ID: s.ID, From: s.To})
+                return nil, nil
+            }
+        }
+        return stanza, nil
+    }))
+
+    h.Inject(&Message{From: jid.MustParse("spam@b.c/x"), Body: "buy"})
+    h.Inject(&Message{From: jid.MustParse("a@b.c/x"), Body: "hi"})
+    if len(events) != 1 || events[0].(*MessageEvent).Message.Body != "hi" {
+        t.Fatalf("inbound events = %#v", events)
+    }
+
+    ping := NewIQ("get", "")
+    ping.To = jid.MustParse("b.c")
+    ping.Payload = []byte(`<ping xmlns='urn:xmpp:ping'/>`)
+    if result, err := h.SendIQ(ping); err != nil || result.Type != "result" {
+        t.Fatalf("SendIQ(ping) = %v, %v", result, err)
+    }
+
+    if err := h.SendMessage(jid.MustParse("a@b.c"), "hello"); err != nil {
+        t.Fatal(err)
+    }
+    if out := <-written; !strings.Contains(out, "<thread>tagged</thread>") || strings.Contains(out, "ping") {
+        t.Fatalf("written %s", out)
+    }
+
+    removeTagger()
+    if err := h.SendMessage(jid.MustParse("a@b.c"), "hello"); err != nil {
+        t.Fatal(err)
+    }
+    if out := <-written; strings.Contains(out, "tagged") {
+        t.Fatalf("removed interceptor still ran: %s", out)
+    }
+}
+
+func TestRedaction(t *testing.T) {
+    secrets := []string{"AGFsaWNlAGh1bnRlcjI=", "hunter2", "old-secret", "private text", "meet at noon"}
+    for _, in := range []string{
+        `<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>AGFsaWNlAGh1bnRlcjI=</auth>`,
+        `<iq type='set' id='r1'><query xmlns='jabber:iq:register'><username>alice</username><password>hunter2</password></query></iq>`,
+        `<x xmlns='jabber:x:data' type='submit'><field var='old_password'><value>old-secret</value></field>` +
+            `<field var='note' type='text-private'><value>private text</value></field><field var='username'><value>alice</value></field></x>`,
+        `<message to='a@b.c'><body>meet at noon</body></message><presence><status>busy`,
+    } {
+        out := redactXML(in)
+        for _, secret := range secrets {
+            if strings.Contains(out, secret) {
+                t.Errorf("redactXML(%s) = %s, leaks %q", in, out, secret)
+            }
+        }
+        if strings.Contains(in, "alice</") && !strings.Contains(out, "alice</") {
+            t.Errorf("redactXML(%s) = %s, lost a non-secret value", in, out)
+        }
+    }
+
+    if got := Secret("hunter2").LogValue().String(); got != redacted {
+        t.Errorf("Secret logged as %q", got)
+    }
+    SetDebug(true)
+    defer SetDebug(false)
+    if got := WireXML("<body>hi</body>").LogValue().String(); got != "<body>hi</body>" {
+        t.Errorf("debug mode logged %q", got)
+    }
+}
+
+func TestStanzaReader(t *testing.T) {
+    limits := Limits{MaxStanzaSize: 1024, MaxDepth: 4, MaxAttrs: 4, MaxTextLength: 64}
+    in := `<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>` +
+        `<message from='a@b.c/d'><body>hi</body></message> ` +
+        `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` +
+        `<iq type='result' id='1'><query xmlns='jabber:iq:version'><name>x</name></query></iq>`
+    reader := newStanzaReader(strings.NewReader(in), limits)
+    for _, want := range []string{"*xmpp.Message", "*xmpp.RawStanza", "*xmpp.IQ"} {
+        stanza, err := reader.Next()
+        if err != nil {
+            t.Fatalf("Next: %v", err)
+        }
+        if got := typeName(stanza); got != want {
+            t.Fatalf("Next = %s, want %s", got, want)
+        }
+        if raw, ok := stanza.(*RawStanza); ok && (raw.Name.Space != nsStream || raw.Name.Local != "features") {
+            t.Errorf("raw stanza name = %v", raw.Name)
+        }
+        if iq, ok := stanza.(*IQ); ok && iq.PayloadName().Space != "jabber:iq:version" {
+            t.Errorf("IQ payload was not kept: %q", iq.Payload)
+        }
+    }
+    if _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+        t.Errorf("Next at the end of the input = %v", err)
+    }
+
+    for _, tt := range []struct {
+        in        io.Reader
+        condition string
+    }{
+        {strings.NewReader(`<message><body>` + strings.Repeat("a", 100) + `</body></message>`), "policy-violation"},
+        {strings.NewReader(`<message><a><b><c><d/></c></b></a></message>`), "policy-violation"},
+        {strings.NewReader(`<message a='1' b='2' c='3' d='4' e='5'/>`), "policy-violation"},
+        {strings.NewReader(`<message to='` + strings.Repeat("a", 100) + `'/>`), "policy-violation"},
+        {strings.NewReader(`<message><body>` + strings.Repeat("<x/>", 300) + `</body></message>`), "policy-violation"},
+        // A never-ending attribute must stop at MaxStanzaSize.
+        {io.MultiReader(strings.NewReader(`<message to='`), endless{}), "policy-violation"},
+        {strings.NewReader(`<!DOCTYPE lol [<!ENTITY lol "lol">]><message/>`), "restricted-xml"},
+        {strings.NewReader(`<message><!-- hi --></message>`), "restricted-xml"},
+        {strings.NewReader(`<?php echo 1; ?>`), "restricted-xml"},
+        {strings.NewReader(`<message><body><?pi x?></body></message>`), "restricted-xml"},
+        {strings.NewReader(`<message>&lol;</message>`), "not-well-formed"},
+        {strings.NewReader(`<message></presence>`), "not-well-formed"},
+        {strings.NewReader(`hello`), "bad-format"},
+    } {
+        _, err := newStanzaReader(tt.in, limits).Next()
+        streamErr, ok := err.(*StreamError)
+        if !ok || streamErr.Condition != tt.condition {
+            t.Errorf("got %v, want a %s stream error", err, tt.condition)
+        }
+    }
+}
+
+func FuzzStanzaReader(f *testing.F) {
+    f.Add(`<message from='a@b.c/d'><body>hi</body></message><presence/>`)
+    f.Add(`<?xml version='1.0'?><stream:stream xmlns:stream='http://etherx.jabber.org/streams'><iq type='get' id='1'/></stream:stream>`)
+    f.Add(`<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>`)
+    f.Fuzz(func(t *testing.T, in string) {
+        reader := newStanzaReader(strings.NewReader(in), Limits{MaxStanzaSize: 512, MaxDepth: 8, MaxAttrs: 8, MaxTextLength: 128})
+        for i := 0; i < 100; i++ {
+            stanza, err := reader.Next()
+            if err != nil {
+                return
+            }
+            if stanza == nil {
+                t.Fatal("Next returned neither a stanza nor an error")
+            }
+        }
+    })
+}
+
+// endless is a reader that never ends.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+    for i := range p {
+        p[i] = 'a'
+    }
+    return len(p), nil
+}
+
+func TestStreamErrorShutdown(t *testing.T) {
+    client, server := net.Pipe()
+    h := &XMPPHandler{Conn: &XMPPConnection{Conn: client}}
+    done := make(chan error)
+    go func() {
+        done <- h.HandleIncomingStanzas()
+    }()
+
+    go server.Write([]byte(`<message><!-- x --></message>`))
+    out, _ := io.ReadAll(server)
+    want := `<stream:error><restricted-xml xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>`
+    if !strings.HasPrefix(string(out), want) || !strings.HasSuffix(string(out), "</stream:stream>") {
+        t.Errorf("sent %s", out)
+    }
+    if err, ok := (<-done).(*StreamError); !ok || err.Condition != "restricted-xml" {
+        t.Errorf("HandleIncomingStanzas returned %v", err)
+    }
+
+    // A stream error from the server is returned, and we close our side.
+    client, server = net.Pipe()
+    h.Conn = &XMPPConnection{Conn: client}
+    go func() {
+        done <- h.HandleIncomingStanzas()
+    }()
+    go server.Write([]byte(`<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/><text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>replaced</text></stream:error>`))
+    if out, _ := io.ReadAll(server); string(out) != "</stream:stream>" {
+        t.Errorf("sent %s", out)
+    }
+    if err, ok := (<-done).(*StreamError); !ok || err.Condition != "conflict" || err.Text != "replaced" {
+        t.Errorf("HandleIncomingStanzas returned %v", err)
+    }
+}
+
+func TestSenderValidation(t *testing.T) {
+    client, server := net.Pipe()
+    defer client.Close()
+    written := make(chan string, 10)
+    go func() {
+        buf := make([]byte, 4096)
+        for {
+            n, err := server.Read(buf)
+            if err != nil {
+                return
+            }
+            written <- string(buf[:n])
+        }
+    }()
+
+    h := &XMPPHandler{Conn: &XMPPConnection{Conn: client}, JID: jid.MustParse("me@b.c/r")}
+    var events []Event
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        events = append(events, ev)
+    }))
+
+    push := `<query xmlns='jabber:iq:roster'><item jid='x@y.z'/></query>`
+    for _, tt := range []struct {
+        from  string
+        valid bool
+    }{
+        {"", true},
+        {"me@b.c", true},
+        {"b.c", true},
+        {"me@b.c/other", false},
+        {"mallory@evil.example", false},
+        {"evil.example", false},
+    } {
+        events = nil
+        iq := &IQ{Type: "set", ID: "push", Payload: []byte(push)}
+        if tt.from != "" {
+            iq.From = jid.MustParse(tt.from)
+        }
+        h.Inject(iq)
+        if tt.valid {
+            <-written // the result acknowledging the push
+        }
+        if got := len(events) == 1; got != tt.valid {
+            t.Errorf("roster push from %q: accepted = %v, want %v", tt.from, got, tt.valid)
+        }
+    }
+
+    // Only the entity we asked may answer.
+    go func() {
+        var request IQ
+        xml.Unmarshal([]byte(<-written), &request)
+        h.Inject(&IQ{Type: "result", ID: request.ID, From: jid.MustParse("mallory@evil.example")})
+        h.Inject(&IQ{Type: "result", ID: request.ID, From: jid.MustParse("bob@b.c/x"), Payload: []byte("<genuine xmlns='x'/>")})
+    }()
+    request := NewIQ("get", "")
+    request.To = jid.MustParse("bob@b.c/x")
+    response, err := h.SendIQ(request)
+    if err != nil || response.PayloadName().Local != "genuine" {
+        t.Fatalf("SendIQ = %+v, %v", response, err)
+    }
+
+    // Carbons are only trusted from our bare JID.
+    carbon := `<message from='%s' to='me@b.c/r'><received xmlns='urn:xmpp:carbons:2'><forwarded xmlns='urn:xmpp:forward:0'>` +
+        `<message xmlns='jabber:client' from='alice@b.c/x' to='me@b.c/other' type='chat'><body>hi</body></message>` +
+        `</forwarded></received></message>`
+    for _, from := range []string{"mallory@evil.example", "me@b.c/other", "me@b.c"} {
+        events = nil
+        stanza, err := ParseStanza([]byte(fmt.Sprintf(carbon, from)))
+        if err != nil {
+            t.Fatal(err)
+        }
+        h.Inject(stanza)
+        if from != "me@b.c" {
+            if len(events) != 0 {
+                t.Errorf("forged carbon was dispatched: %#v", events)
+            }
+            continue
+        }
+        if len(events) != 1 {
+            t.Fatalf("got %d events for a carbon", len(events))
+        }
+        ev := events[0].(*MessageEvent)
+        if ev.Sent || ev.Message.From != jid.MustParse("alice@b.c/x") || ev.Message.Body != "hi" {
+            t.Errorf("carbon dispatched as %+v", ev)
+        }
+    }
+}
+
+func TestNoteFeatures(t *testing.T) {
+    conn := &XMPPConnection{}
+    conn.noteFeatures([]byte(`<stream:features xmlns:stream='http://etherx.jabber.org/streams'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>`))
+    if conn.RosterVer {
+        t.Fatal("roster versioning noted without the feature")
+    }
+    conn.noteFeatures([]byte(`<stream:features xmlns:stream='http://etherx.jabber.org/streams'><ver xmlns='urn:xmpp:features:rosterver'/></stream:features><iq`))
+    if !conn.RosterVer {
+        t.Error("roster versioning not noted")
+    }
+}
+
+func TestParseBindResult(t *testing.T) {
+    in := `<iq type='result' id='bind_1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>Me@B.c/mainbinding</jid></bind></iq>`
+    bound, err := parseBindResult([]byte(in), "bind_1")
+    if err != nil || bound != jid.MustParse("me@b.c/mainbinding") {
+        t.Errorf("parseBindResult = %v, %v", bound, err)
+    }
+    in = `<iq type='error' id='bind_1'><error type='cancel'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>`
+    if _, err := parseBindResult([]byte(in), "bind_1"); err == nil {
+        t.Error("parseBindResult accepted an error")
+    }
+}
+
+func TestRoster(t *testing.T) {
+    h, _ := newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        var query RosterQuery
+        iq.DecodePayload(&query)
+        switch iq.Type {
+        case "get":
+            if strings.Contains(string(iq.Payload), "ver=") {
+                panic("ver sent to a server without roster versioning")
+            }
+            // A legacy entry with an invalid JID doesn't spoil the roster.
+            result, err := ParseStanza([]byte(fmt.Sprintf(`<iq type='result' id='%s'><query xmlns='jabber:iq:roster'>`+
+                `<item jid='bob@b.c' name='Bob' subscription='both'><group>Friends</group></item>`+
+                `<item jid='icq user@icq.b.c' subscription='both'/>`+
+                `<item jid='alice@b.c' subscription='to'/></query></iq>`, iq.ID)))
+            if err != nil {
+                panic(err)
+            }
+            h.Inject(result)
+        case "set":
+            // Like a server: push the item to every resource, then acknowledge.
+            push := &IQ{Type: "set", ID: "push" + iq.ID}
+            push.SetQuery(&query)
+            deliver(h, push)
+            deliver(h, &IQ{Type: "result", ID: iq.ID})
+        }
+    })
+    var events []*RosterEvent
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        if ev, ok := ev.(*RosterEvent); ok {
+            events = append(events, ev)
+        }
+    }))
+
+    if err := h.Roster().Fetch(); err != nil {
+        t.Fatal(err)
+    }
+    items := h.Roster().Items()
+    if len(items) != 2 || items[0].JID != jid.MustParse("alice@b.c") || !items[1].HasGroup("Friends") {
+        t.Fatalf("roster = %+v", items)
+    }
+    if groups := h.Roster().Groups(); len(groups) != 1 || groups[0] != "Friends" {
+        t.Errorf("roster groups = %q", groups)
+    }
+
+    if err := h.Roster().Set(RosterItem{JID: jid.MustParse("carol@b.c/phone"), Name: " Carol ", Groups: []string{"Work", "", "Work"}}); err != nil {
+        t.Fatal(err)
+    }
+    carol, ok := h.Roster().Item(jid.MustParse("carol@b.c"))
+    if !ok || carol.Name != "Carol" || len(carol.Groups) != 1 {
+        t.Fatalf("carol = %+v, %v", carol, ok)
+    }
+
+    if err := h.Roster().Remove(jid.MustParse("bob@b.c")); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := h.Roster().Item(jid.MustParse("bob@b.c")); ok {
+        t.Fatal("bob is still in the roster")
+    }
+
+    if len(events) != 3 || !events[0].Full || events[2].Items[0].Subscription != "remove" {
+        t.Errorf("roster events = %+v", events)
+    }
+
+    push, err := ParseStanza([]byte(`<iq type='set' id='p1'><query xmlns='jabber:iq:roster'>` +
+        `<item jid='icq user@icq.b.c' subscription='none'/><item jid='dave@b.c' subscription='none'/></query></iq>`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    h.Inject(push)
+    if _, ok := h.Roster().Item(jid.MustParse("dave@b.c")); !ok || len(h.Roster().Items()) != 3 {
+        t.Errorf("roster after a push with an invalid item = %+v", h.Roster().Items())
+    }
+}
+
+func TestRosterVersioning(t *testing.T) {
+    store := &FileRosterStore{Path: t.TempDir() + "/roster.json"}
+
+    // First login: no cached version, so an empty one asks the server for
+    // the whole roster and its version.
+    var firstGet string
+    h, _ := newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        firstGet = string(iq.Payload)
+        result := &IQ{Type: "result", ID: iq.ID}
+        result.SetQuery(&RosterQuery{Ver: "v1", Items: []RosterItem{
+            {JID: jid.MustParse("bob@b.c"), Name: "Bob", Subscription: "both"},
+        }})
+        deliver(h, result)
+    })
+    h.Conn.RosterVer = true
+    if err := h.Roster().UseStore(store); err != nil {
+        t.Fatal(err)
+    }
+    if err := h.Roster().Fetch(); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(firstGet, `ver=""`) {
+        t.Errorf("first roster get = %s, want an empty ver", firstGet)
+    }
+    if ver, items, err := store.LoadRoster(); err != nil || ver != "v1" || len(items) != 1 {
+        t.Fatalf("stored roster = %q, %+v, %v", ver, items, err)
+    }
+
+    // Second login: the cache is used right away and only the changes come in.
+    var sentVer string
+    h, _ = newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        var query RosterQuery
+        iq.DecodePayload(&query)
+        sentVer = query.Ver
+        // The pushes go first so that they are applied when Fetch returns.
+        push := &IQ{Type: "set", ID: "push1"}
+        push.SetQuery(&RosterQuery{Ver: "v2", Items: []RosterItem{
+            {JID: jid.MustParse("carol@b.c"), Subscription: "none"},
+        }})
+        deliver(h, push)
+        deliver(h, &IQ{Type: "result", ID: iq.ID})
+    })
+    h.Conn.RosterVer = true
+    if err := h.Roster().UseStore(store); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := h.Roster().Item(jid.MustParse("bob@b.c")); !ok || h.Roster().Loaded() {
+        t.Fatal("cached roster not loaded before the fetch")
+    }
+    if err := h.Roster().Fetch(); err != nil {
+        t.Fatal(err)
+    }
+    if sentVer != "v1" {
+        t.Errorf("roster get sent ver %q, want v1", sentVer)
+    }
+    if ver, items, _ := store.LoadRoster(); ver != "v2" || len(items) != 2 {
+        t.Errorf("stored roster = %q, %+v", ver, items)
+    }
+
+    // A refusal with no error element is not an empty, up to date roster.
+    h, _ = newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        refusal, _ := ParseStanza([]byte(`<iq type="error" id="` + iq.ID + `"/>`))
+        h.Inject(refusal)
+    })
+    h.Conn.RosterVer = true
+    if err := h.Roster().UseStore(store); err != nil {
+        t.Fatal(err)
+    }
+    var events int
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        if _, ok := ev.(*RosterEvent); ok {
+            events++
+        }
+    }))
+    if err := h.Roster().Fetch(); err == nil {
+        t.Error("Fetch() of a refused roster succeeded")
+    }
+    if h.Roster().Loaded() || events != 0 {
+        t.Errorf("refused roster loaded = %v, with %d events", h.Roster().Loaded(), events)
+    }
+}
+
+func TestSubscriptions(t *testing.T) {
+    h, sent := newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    h.Roster().apply(RosterQuery{Items: []RosterItem{
+        {JID: jid.MustParse("carol@b.c"), Subscription: "from", Ask: "subscribe"},
+    }})
+    var events []*SubscriptionEvent
+    h.Subscribe(SubscriberFunc(func(ev Event) {
+        if ev, ok := ev.(*SubscriptionEvent); ok {
+            events = append(events, ev)
+        }
+    }))
+    subscribe := func(from string) {
+        deliver(h, &Presence{From: jid.MustParse(from), Type: "subscribe", Status: "hi"})
+    }
+
+    subscribe("bob@b.c/phone")
+    subscribe("bob@b.c/laptop")
+    pending := h.PendingSubscriptions()
+    if len(pending) != 1 || pending[0].From != jid.MustParse("bob@b.c") || pending[0].Status != "hi" || len(events) != 1 {
+        t.Fatalf("pending = %+v, events = %d", pending, len(events))
+    }
+    if got := h.SubscriptionState(jid.MustParse("bob@b.c")).String(); got != "None + Pending In" {
+        t.Errorf("bob's state = %q", got)
+    }
+    if got := h.SubscriptionState(jid.MustParse("carol@b.c")).String(); got != "From + Pending Out" {
+        t.Errorf("carol's state = %q", got)
+    }
+
+    // Carol already sees our presence: her request is confirmed without asking.
+    subscribe("carol@b.c")
+    if stanza := <-sent; stanza.(*Presence).Type != "subscribed" || len(events) != 1 {
+        t.Fatalf("sent %+v, events = %d", stanza, len(events))
+    }
+
+    if err := h.AcceptAndSubscribe(jid.MustParse("bob@b.c")); err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{"subscribed", "subscribe"} {
+        if pres := (<-sent).(*Presence); pres.Type != want || pres.To != jid.MustParse("bob@b.c") {
+            t.Errorf("sent %s to %s, want %s", pres.Type, pres.To, want)
+        }
+    }
+    if pending := h.PendingSubscriptions(); len(pending) != 0 {
+        t.Errorf("pending after accepting = %+v", pending)
+    }
+
+    // With a store, unanswered requests outlive the session.
+    store := &FileSubscriptionStore{Path: t.TempDir() + "/requests.json"}
+    h, _ = newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    if err := h.UseSubscriptionStore(store); err != nil {
+        t.Fatal(err)
+    }
+    deliver(h, &Presence{From: jid.MustParse("dave@b.c/phone"), Type: "subscribe", Status: "it's Dave"})
+    deliver(h, &Presence{From: jid.MustParse("erin@b.c"), Type: "subscribe"})
+    h, _ = newTestSession(t, func(h *XMPPHandler, iq *IQ) {})
+    // Erin's request was granted from another client in the meantime.
+    h.Roster().apply(RosterQuery{Items: []RosterItem{{JID: jid.MustParse("erin@b.c"), Subscription: "from"}}})
+    if err := h.UseSubscriptionStore(store); err != nil {
+        t.Fatal(err)
+    }
+    pending = h.PendingSubscriptions()
+    if len(pending) != 1 || pending[0].From != jid.MustParse("dave@b.c") || pending[0].Status != "it's Dave" {
+        t.Fatalf("pending in the next session = %+v", pending)
+    }
+
+    // So is Dave's, announced by a roster push.
+    push := &IQ{Type: "set", ID: "push1"}
+    push.SetQuery(&RosterQuery{Items: []RosterItem{{JID: jid.MustParse("dave@b.c"), Subscription: "both"}}})
+    deliver(h, push)
+    if pending := h.PendingSubscriptions(); len(pending) != 0 {
+        t.Errorf("pending after the push = %+v", pending)
+    }
+    if stored, err := store.LoadSubscriptions(); err != nil || len(stored) != 0 {
+        t.Errorf("stored requests = %+v, %v", stored, err)
+    }
+}
+
+func TestRegistrationForm(t *testing.T) {
+    // A server asking for the plain fields.
+    query, err := FetchRegistrationForm(registrationServer(t, `<iq type='result' id='reg_form1'>
+        <query xmlns='jabber:iq:register'>
+            <instructions>Choose a username and password.</instructions>
+            <username/><password/><email/>
+        </query></iq>`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if query.Instructions != "Choose a username and password." || query.Form != nil || len(query.Fields) != 3 || query.Field("email") == nil {
+        t.Fatalf("plain form = %+v", query)
+    }
+    if query.IsRedirect() || !query.SetValue("username", "alice") || !query.SetValue("password", "secret") || query.SetValue("ocr", "x") {
+        t.Errorf("plain fields not filled as asked: %+v", query.Fields)
+    }
+    if missing := query.missingFields(); len(missing) != 1 || missing[0] != "email" {
+        t.Errorf("missing plain fields = %v", missing)
+    }
+    query.SetValue("email", "alice@example.org")
+    out, _ := xml.Marshal(query.submission())
+    for _, want := range []string{`>alice</username>`, `>secret</password>`, `>alice@example.org</email>`} {
+        if !strings.Contains(string(out), want) || strings.Contains(string(out), `xmlns=""`) {
+            t.Errorf("plain submission = %s", out)
+        }
+    }
+
+    // A server asking for a data form with a CAPTCHA, whose image comes next
+    // to the query.
+    query, err = FetchRegistrationForm(registrationServer(t, `<iq type='result' id='reg_form1'>
+        <query xmlns='jabber:iq:register'>
+            <x xmlns='jabber:x:data' type='form'>
+                <title>Sign up</title>
+                <field type='hidden' var='FORM_TYPE'><value>jabber:iq:register</value></field>
+                <field type='fixed'><value>Fill in every field</value></field>
+                <field type='text-single' var='username' label='User'><required/></field>
+                <field type='text-private' var='password'><required/></field>
+                <field type='text-single' var='ocr' label='Enter the text you see'><required/>
+                    <media xmlns='urn:xmpp:media-element' height='80' width='290'>
+                        <uri type='image/png'>cid:sha1+8f35fef1@bob.xmpp.org</uri>
+                    </media>
+                </field>
+            </x>
+        </query>
+        <data xmlns='urn:xmpp:bob' cid='sha1+8f35fef1@bob.xmpp.org' type='image/png' max-age='0'>aGVsbG8=</data>
+        </iq>`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    form := query.Form
+    if form == nil || form.Title != "Sign up" || form.FormType() != nsRegister || len(form.Fields) != 5 {
+        t.Fatalf("data form = %+v", form)
+    }
+    ocr := form.Field("ocr")
+    if ocr == nil || len(ocr.Media) != 1 || len(ocr.Media[0].URIs) != 1 || ocr.Media[0].Width != 290 {
+        t.Fatalf("CAPTCHA field = %+v", ocr)
+    }
+    bob, ok := query.BoB(ocr.Media[0].URIs[0].Value)
+    if !ok || bob.Type != "image/png" {
+        t.Fatalf("CAPTCHA data = %+v, %v", bob, ok)
+    }
+    if data, err := bob.Bytes(); err != nil || string(data) != "hello" {
+        t.Errorf("CAPTCHA bytes = %q, %v", data, err)
+    }
+    if _, ok := query.BoB("cid:sha1+unknown@bob.xmpp.org"); ok {
+        t.Error("found data that was not sent")
+    }
+
+    if !query.SetValue("username", "alice") || query.SetValue("email", "alice@example.org") {
+        t.Errorf("form fields not filled as asked: %+v", form.Fields)
+    }
+    if missing := form.MissingFields(); len(missing) != 2 || missing[0] != "password" || missing[1] != "Enter the text you see" {
+        t.Errorf("missing form fields = %v", missing)
+    }
+    query.SetValue("password", "secret")
+    query.SetValue("ocr", "7xk2")
+    if missing := query.missingFields(); len(missing) != 0 {
+        t.Errorf("missing form fields after filling = %v", missing)
+    }
+    submit := query.submission().Form
+    if submit.Type != "submit" || len(submit.Fields) != 4 {
+        t.Fatalf("submitted form = %+v", submit)
+    }
+    for _, f := range submit.Fields {
+        if f.Type != "" || f.Label != "" || f.Required != nil || len(f.Media) != 0 {
+            t.Errorf("submitted field %q carries more than its value: %+v", f.Var, f)
+        }
+    }
+    if f := submit.Field("ocr"); f == nil || f.Value() != "7xk2" {
+        t.Errorf("submitted CAPTCHA = %+v", f)
+    }
+}
+
+func TestRegistrationRedirect(t *testing.T) {
+    // A server that only registers on the web sends nothing but the URL.
+    query, err := FetchRegistrationForm(registrationServer(t, `<iq type='result' id='reg_form1'>
+        <query xmlns='jabber:iq:register'>
+            <instructions>Register on our web site.</instructions>
+            <x xmlns='jabber:x:oob'><url>https://example.org/register</url></x>
+        </query></iq>`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !query.IsRedirect() {
+        t.Fatalf("redirect not recognized: %+v", query)
+    }
+    var redirect *RedirectError
+    if err := SubmitRegistration(nil, query); !errors.As(err, &redirect) || redirect.URL != "https://example.org/register" {
+        t.Errorf("SubmitRegistration() = %v, want a redirect", err)
+    }
+
+    // Others only redirect once the form is submitted.
+    conn := registrationServer(t, `<iq type='error' id='register1'>
+        <query xmlns='jabber:iq:register'>
+            <x xmlns='jabber:x:oob'><url>https://example.org/signup</url></x>
+        </query>
+        <error type='cancel'><not-allowed xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>
+        </iq>`)
+    query = &RegisterQuery{Fields: []RegisterField{{XMLName: xml.Name{Local: "username"}, Value: "alice"}}}
+    if err := SubmitRegistration(conn, query); !errors.As(err, &redirect) || redirect.URL != "https://example.org/signup" {
+        t.Errorf("SubmitRegistration() = %v, want a redirect", err)
+    }
+
+    conn = registrationServer(t, `<iq type='error' id='register1'>
+        <error type='cancel'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>
+        </iq>`)
+    if err := SubmitRegistration(conn, query); err != ErrUserExists {
+        t.Errorf("SubmitRegistration() = %v, want ErrUserExists", err)
+    }
+}
+
+func TestChangePassword(t *testing.T) {
+    server := jid.MustParse("b.c")
+    var requests []string
+    var answer func(h *XMPPHandler, iq *IQ)
+    h, _ := newTestSession(t, func(h *XMPPHandler, iq *IQ) {
+        requests = append(requests, string(iq.Payload))
+        answer(h, iq)
+    })
+    h.Conn.Domain = "b.c"
+    h.Username, h.Password = "me", "old"
+    result := func(h *XMPPHandler, iq *IQ) { deliver(h, &IQ{From: server, Type: "result", ID: iq.ID}) }
+    formError := func(form *DataForm) func(h *XMPPHandler, iq *IQ) {
+        return func(h *XMPPHandler, iq *IQ) {
+            response := &IQ{From: server, Type: "error", ID: iq.ID, Error: &StanzaError{Type: "modify", Condition: "not-authorized"}}
+            response.SetQuery(&RegisterQuery{Form: form})
+            deliver(h, response)
+        }
+    }
+    passwordForm := func(extra ...FormField) *DataForm {
+        return &DataForm{Type: "form", Fields: append([]FormField{
+            {Var: "FORM_TYPE", Type: "hidden", Values: []string{nsRegister}},
+            {Var: "username", Type: "text-single", Required: &struct{}{}},
+            {Var: "old_password", Type: "text-private", Required: &struct{}{}},
+            {Var: "password", Type: "text-private", Required: &struct{}{}},
+        }, extra...)}
+    }
+
+    // The plain request.
+    answer = result
+    if err := h.ChangePassword("new1"); err != nil {
+        t.Fatal(err)
+    }
+    if plain := requests[0]; !strings.Contains(plain, ">me</username>") || !strings.Contains(plain, ">new1</password>") || strings.Contains(plain, `xmlns=""`) {
+        t.Errorf("plain request = %s", plain)
+    }
+    if h.Password != "new1" {
+        t.Errorf("password after the change = %q", h.Password)
+    }
+
+    // A form the handler can fill in by itself is submitted right away.
+    requests = nil
+    answer = func(h *XMPPHandler, iq *IQ) {
+        if len(requests) == 1 {
+            formError(passwordForm())(h, iq)
+            return
+        }
+        result(h, iq)
+    }
+    if err := h.ChangePassword("new2"); err != nil {
+        t.Fatal(err)
+    }
+    if len(requests) != 2 || !strings.Contains(requests[1], `type="submit"`) || !strings.Contains(requests[1], "<value>new1</value>") {
+        t.Errorf("requests = %q", requests)
+    }
+    if h.Password != "new2" {
+        t.Errorf("password after the form = %q", h.Password)
+    }
+
+    // A form with a field the handler can't fill in is handed back.
+    requests = nil
+    answer = formError(passwordForm(FormField{Var: "captcha", Label: "Enter the text", Required: &struct{}{}}))
+    err := h.ChangePassword("new3")
+    var formErr *FormRequiredError
+    if !errors.As(err, &formErr) {
+        t.Fatalf("ChangePassword() = %v, want a form", err)
+    }
+    form := formErr.Form
+    if got := form.Field("old_password").Value(); got != "new2" {
+        t.Errorf("old_password = %q", got)
+    }
+    if missing := form.MissingFields(); len(missing) != 1 || missing[0] != "Enter the text" {
+        t.Errorf("missing fields = %v", missing)
+    }
+    if err := h.SubmitPasswordForm(form, "new3"); err == nil || len(requests) != 1 {
+        t.Errorf("SubmitPasswordForm() of an incomplete form = %v, sent %d requests", err, len(requests))
+    }
+    form.Field("captcha").SetValue("7xk2")
+    answer = result
+    if err := h.SubmitPasswordForm(form, "new3"); err != nil {
+        t.Fatal(err)
+    }
+    if len(requests) != 2 || !strings.Contains(requests[1], "<value>7xk2</value>") || h.Password != "new3" {
+        t.Errorf("requests = %q, password = %q", requests, h.Password)
+    }
+
+    // Each refusal reads as what went wrong, and keeps the password.
+    for _, tt := range []struct {
+        condition string
+        want      string
+    }{
+        {"not-authorized", "not allowed to change the password"},
+        {"not-acceptable", "rejected the new password"},
+        {"not-allowed", "does not allow changing the password"},
+        {"internal-server-error", "failed to change password"},
+    } {
+        answer = func(h *XMPPHandler, iq *IQ) {
+            deliver(h, &IQ{From: server, Type: "error", ID: iq.ID, Error: &StanzaError{Type: "cancel", Condition: tt.condition}})
+        }
+        err := h.ChangePassword("new4")
+        var stanzaErr *StanzaError
+        if !errors.As(err, &stanzaErr) || stanzaErr.Condition != tt.condition || !strings.Contains(err.Error(), tt.want) {
+            t.Errorf("%s: ChangePassword() = %v", tt.condition, err)
+        }
+    }
+    if h.Password != "new3" {
+        t.Errorf("password after refusals = %q", h.Password)
+    }
+    if err := passwordChangeError(nil); err == nil || !strings.Contains(err.Error(), "unexpected response") {
+        t.Errorf("passwordChangeError(nil) = %v", err)
+    }
+}
+
+// registrationServer returns a connection to a fake server that reads a
+// request and sends the next answer, for each of answers.
+func registrationServer(t *testing.T, answers ...string) *XMPPConnection {
+    client, server := net.Pipe()
+    t.Cleanup(func() { client.Close() })
+    go func() {
+        reader := newStanzaReader(server, Limits{})
+        for _, answer := range answers {
+            if _, err := reader.Next(); err != nil {
+                return
+            }
+            if _, err := server.Write([]byte(answer)); err != nil {
+                return
+            }
+        }
+    }()
+    return &XMPPConnection{Conn: client, Domain: "b.c"}
+}
+
+// newTestSession returns a handler connected to a fake server. Every IQ the
+// handler sends is passed to serve; stanzas of other types are collected in
+// the returned channel.
+func newTestSession(t *testing.T, serve func(h *XMPPHandler, iq *IQ)) (*XMPPHandler, chan Stanza) {
+    client, server := net.Pipe()
+    t.Cleanup(func() { client.Close() })
+    h := &XMPPHandler{Conn: &XMPPConnection{Conn: client}, JID: jid.MustParse("me@b.c/r")}
+    others := make(chan Stanza, 100)
+    go func() {
+        reader := newStanzaReader(server, Limits{})
+        for {
+            stanza, err := reader.Next()
+            if err != nil {
+                return
+            }
+            if iq, ok := stanza.(*IQ); ok && (iq.Type == "get" || iq.Type == "set") {
+                go serve(h, iq)
+            } else {
+                others <- stanza
+            }
+        }
+    }()
+    return h, others
+}
+
+// deliver hands a stanza to the handler as if it came from the wire.
+func deliver(h *XMPPHandler, stanza Stanza) {
+    out, err := stanza.ToXML()
+    if err != nil {
+        panic(err)
+    }
+    parsed, err := ParseStanza([]byte(out))
+    if err != nil {
+        panic(err)
+    }
+    h.Inject(parsed)
+}
+
+// incomingPresence builds an incoming presence for the tests.
+func incomingPresence(from, status string) *Presence {
+    return &Presence{From: jid.MustParse(from), Status: status}
+}
+
+func typeName(s Stanza) string {
+    switch s.(type) {
+    case *Message:
+        return "*xmpp.Message"
+    case *Presence:
+        return "*xmpp.Presence"
+    case *IQ:
+        return "*xmpp.IQ"
+    case *RawStanza:
+        return "*xmpp.RawStanza"
+    }
+    return "unknown"
+}